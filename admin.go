@@ -0,0 +1,320 @@
+package magicsockets
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AdminOpts struct {
+	// Called before every request. Returning an error rejects it with 401 Unauthorized.
+	// When nil, every request is rejected: the admin API must be explicitly protected.
+	Authorize func(r *http.Request) error
+}
+
+// Client as returned by the admin API.
+type AdminClient struct {
+	ID              string    `json:"id"`
+	Key             string    `json:"key"`
+	Topics          []string  `json:"topics"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	RemoteAddr      string    `json:"remote_addr"`
+	DroppedMessages uint64    `json:"dropped_messages"`
+}
+
+type AdminClientList struct {
+	Clients []AdminClient `json:"clients"`
+	// Amount of clients matching the filters, before pagination.
+	Total int `json:"total"`
+}
+
+type AdminEmitRequest struct {
+	Rules []EmitRule `json:"rules"`
+	// Sent as a text message.
+	Message string `json:"message"`
+}
+
+type adminTopicsRequest struct {
+	Topics []string `json:"topics"`
+}
+
+type adminKeyRequest struct {
+	Key string `json:"key"`
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+const (
+	_DEFAULT_ADMIN_PAGE_LIMIT = 100
+	_MAX_ADMIN_PAGE_LIMIT     = 1000
+)
+
+var (
+	ErrAdminUnauthorized = errors.New("unauthorized")
+)
+
+type adminHandler struct {
+	opts AdminOpts
+
+	getServer func() *magicSocket
+}
+
+// Returns an http.Handler to inspect and manage the connected clients. Mount it under a prefix with http.StripPrefix.
+//
+//	GET    /clients?key=&topic=&offset=&limit=  Lists the clients, oldest first.
+//	GET    /clients/{id}                        Looks up a client.
+//	PUT    /clients/{id}/topics                 Replaces its topics. Body: {"topics": [...]}
+//	PUT    /clients/{id}/key                    Updates its key. Body: {"key": "..."}
+//	DELETE /clients/{id}                        Disconnects it.
+//	POST   /emit                                Emits a message. Body: {"rules": [...], "message": "..."}
+func (ms *magicSocket) AdminHandler(opts AdminOpts) http.Handler {
+	return &adminHandler{
+		opts: opts,
+		getServer: func() *magicSocket {
+			return ms
+		},
+	}
+}
+
+func (ah *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if ah.opts.Authorize == nil {
+		writeAdminError(w, http.StatusUnauthorized, ErrAdminUnauthorized)
+		return
+	}
+	if err := ah.opts.Authorize(r); err != nil {
+		writeAdminError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "clients":
+		if r.Method != http.MethodGet {
+			writeAdminMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		ah.listClients(w, r)
+	case len(path) == 2 && path[0] == "clients":
+		switch r.Method {
+		case http.MethodGet:
+			ah.getClient(w, path[1])
+		case http.MethodDelete:
+			ah.disconnectClient(w, path[1])
+		default:
+			writeAdminMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case len(path) == 3 && path[0] == "clients" && path[2] == "topics":
+		if r.Method != http.MethodPut {
+			writeAdminMethodNotAllowed(w, http.MethodPut)
+			return
+		}
+		ah.setTopics(w, r, path[1])
+	case len(path) == 3 && path[0] == "clients" && path[2] == "key":
+		if r.Method != http.MethodPut {
+			writeAdminMethodNotAllowed(w, http.MethodPut)
+			return
+		}
+		ah.updateKey(w, r, path[1])
+	case len(path) == 1 && path[0] == "emit":
+		if r.Method != http.MethodPost {
+			writeAdminMethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		ah.emit(w, r)
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// Without a key filter, only clients connected to this instance are listed.
+func (ah *adminHandler) listClients(w http.ResponseWriter, r *http.Request) {
+	ms := ah.getServer()
+	query := r.URL.Query()
+
+	offset, err := parseAdminInt(query.Get("offset"), 0)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, errors.New("invalid offset"))
+		return
+	}
+	limit, err := parseAdminInt(query.Get("limit"), _DEFAULT_ADMIN_PAGE_LIMIT)
+	if err != nil || limit == 0 {
+		writeAdminError(w, http.StatusBadRequest, errors.New("invalid limit"))
+		return
+	}
+	if limit > _MAX_ADMIN_PAGE_LIMIT {
+		limit = _MAX_ADMIN_PAGE_LIMIT
+	}
+
+	var clients []ClientConn
+	if query.Has("key") {
+		clients, err = ms.LookupClientsByKey(query.Get("key"))
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		for _, client := range ms.clients.all() {
+			clients = append(clients, client)
+		}
+	}
+
+	list := AdminClientList{Clients: []AdminClient{}}
+	matching := []AdminClient{}
+	for _, client := range clients {
+		if query.Has("topic") && !contains(client.GetTopics(), query.Get("topic")) {
+			continue
+		}
+		matching = append(matching, newAdminClient(client))
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		if !matching[i].ConnectedAt.Equal(matching[j].ConnectedAt) {
+			return matching[i].ConnectedAt.Before(matching[j].ConnectedAt)
+		}
+		return matching[i].ID < matching[j].ID
+	})
+
+	list.Total = len(matching)
+	if offset < len(matching) {
+		end := offset + limit
+		if end > len(matching) {
+			end = len(matching)
+		}
+		list.Clients = matching[offset:end]
+	}
+
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+func (ah *adminHandler) getClient(w http.ResponseWriter, clientID string) {
+	client, ok := ah.lookupClient(w, clientID)
+	if !ok {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, newAdminClient(client))
+}
+
+func (ah *adminHandler) disconnectClient(w http.ResponseWriter, clientID string) {
+	client, ok := ah.lookupClient(w, clientID)
+	if !ok {
+		return
+	}
+	if err := client.Close(); err != nil {
+		writeAdminClientError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah *adminHandler) setTopics(w http.ResponseWriter, r *http.Request, clientID string) {
+	var body adminTopicsRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, errors.New("invalid body"))
+		return
+	}
+
+	client, ok := ah.lookupClient(w, clientID)
+	if !ok {
+		return
+	}
+	client.SetTopics(body.Topics)
+	writeAdminJSON(w, http.StatusOK, newAdminClient(client))
+}
+
+func (ah *adminHandler) updateKey(w http.ResponseWriter, r *http.Request, clientID string) {
+	var body adminKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Key == "" {
+		writeAdminError(w, http.StatusBadRequest, errors.New("invalid body"))
+		return
+	}
+
+	client, ok := ah.lookupClient(w, clientID)
+	if !ok {
+		return
+	}
+	if err := client.UpdateKey(body.Key); err != nil {
+		writeAdminClientError(w, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, newAdminClient(client))
+}
+
+func (ah *adminHandler) emit(w http.ResponseWriter, r *http.Request) {
+	var body AdminEmitRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAdminError(w, http.StatusBadRequest, errors.New("invalid body"))
+		return
+	}
+
+	ah.getServer().Emit(EmitOpts{Rules: body.Rules}, []byte(body.Message))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Writes the error response if the client can't be found.
+func (ah *adminHandler) lookupClient(w http.ResponseWriter, clientID string) (ClientConn, bool) {
+	client, err := ah.getServer().LookupClient(clientID)
+	if err != nil {
+		writeAdminClientError(w, err)
+		return nil, false
+	}
+	return client, true
+}
+
+func newAdminClient(client ClientConn) AdminClient {
+	topics := client.GetTopics()
+	if topics == nil {
+		topics = []string{}
+	}
+	return AdminClient{
+		ID:              client.GetID(),
+		Key:             client.GetKey(),
+		Topics:          topics,
+		ConnectedAt:     client.GetConnectedAt(),
+		RemoteAddr:      client.GetRemoteAddr(),
+		DroppedMessages: client.GetDroppedMessages(),
+	}
+}
+
+func parseAdminInt(value string, defaultValue int) (int, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, errors.New("invalid integer")
+	}
+	return parsed, nil
+}
+
+func writeAdminClientError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrClientNotFound):
+		writeAdminError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrKeyInUse), errors.Is(err, ErrKeyLimitReached):
+		writeAdminError(w, http.StatusConflict, err)
+	case errors.Is(err, ErrRemoteCommandTimeout):
+		writeAdminError(w, http.StatusGatewayTimeout, err)
+	default:
+		writeAdminError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeAdminMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, adminError{Error: err.Error()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,183 @@
+package magicsockets_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Admin API", func() {
+	var (
+		ms      magicsockets.MagicSocket
+		address string
+		admin   http.Handler
+
+		keys []string
+	)
+
+	BeforeEach(func() {
+		keys = []string{gofakeit.UUID(), gofakeit.UUID()}
+		ms, address = startMagicSocket(magicsockets.MagicSocketOpts{
+			KeyConflictPolicy: magicsockets.KeyConflictReject,
+		})
+
+		connected := 0
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			key := keys[connected]
+			connected++
+			return magicsockets.RegisterClientOpts{
+				Key:    key,
+				Topics: []string{"topic-" + key},
+			}, nil
+		})
+
+		admin = ms.AdminHandler(magicsockets.AdminOpts{
+			Authorize: func(r *http.Request) error {
+				if r.Header.Get("Authorization") != "Bearer secret" {
+					return errors.New("invalid token")
+				}
+				return nil
+			},
+		})
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	listClients := func(path string) magicsockets.AdminClientList {
+		recorder := request(http.MethodGet, path, "")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		var list magicsockets.AdminClientList
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &list)).To(Succeed())
+		return list
+	}
+
+	connect := func() *websocket.Conn {
+		conn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+
+	It("Rejects unauthorized requests", func() {
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/clients", nil))
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		recorder = httptest.NewRecorder()
+		ms.AdminHandler(magicsockets.AdminOpts{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/clients", nil))
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("Lists and paginates clients", func() {
+		first := connect()
+		defer first.Close()
+		// Guarantees a distinct connection time.
+		time.Sleep(time.Millisecond * 10)
+		second := connect()
+		defer second.Close()
+
+		list := listClients("/clients")
+		Expect(list.Total).To(Equal(2))
+		Expect(list.Clients).To(HaveLen(2))
+		Expect(list.Clients[0].Key).To(Equal(keys[0]))
+		Expect(list.Clients[0].Topics).To(Equal([]string{"topic-" + keys[0]}))
+		Expect(list.Clients[0].RemoteAddr).ToNot(BeEmpty())
+		Expect(list.Clients[0].ConnectedAt).To(BeTemporally("<", list.Clients[1].ConnectedAt))
+
+		list = listClients("/clients?offset=1&limit=1")
+		Expect(list.Total).To(Equal(2))
+		Expect(list.Clients).To(HaveLen(1))
+		Expect(list.Clients[0].Key).To(Equal(keys[1]))
+
+		list = listClients("/clients?key=" + keys[1])
+		Expect(list.Clients).To(HaveLen(1))
+		Expect(list.Clients[0].Key).To(Equal(keys[1]))
+
+		list = listClients("/clients?topic=topic-" + keys[0])
+		Expect(list.Clients).To(HaveLen(1))
+		Expect(list.Clients[0].Key).To(Equal(keys[0]))
+
+		Expect(request(http.MethodGet, "/clients?limit=abc", "").Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("Manages a client", func() {
+		conn := connect()
+		defer conn.Close()
+
+		id := listClients("/clients").Clients[0].ID
+
+		recorder := request(http.MethodGet, "/clients/"+id, "")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(ContainSubstring(keys[0]))
+
+		recorder = request(http.MethodPut, "/clients/"+id+"/topics", `{"topics": ["news"]}`)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(ms.GetClientsByKey(keys[0])[0].GetTopics()).To(Equal([]string{"news"}))
+
+		recorder = request(http.MethodPut, "/clients/"+id+"/key", `{"key": "`+keys[1]+`"}`)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(ms.GetClientsByKey(keys[1])).To(HaveLen(1))
+
+		Expect(request(http.MethodPost, "/clients/"+id, "").Code).To(Equal(http.StatusMethodNotAllowed))
+
+		recorder = request(http.MethodDelete, "/clients/"+id, "")
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+		Expect(ms.GetClients()).To(BeEmpty())
+
+		Expect(request(http.MethodGet, "/clients/"+id, "").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("Rejects key updates that conflict", func() {
+		first := connect()
+		defer first.Close()
+		second := connect()
+		defer second.Close()
+
+		id := listClients("/clients?key=" + keys[0]).Clients[0].ID
+		recorder := request(http.MethodPut, "/clients/"+id+"/key", `{"key": "`+keys[1]+`"}`)
+		Expect(recorder.Code).To(Equal(http.StatusConflict))
+	})
+
+	It("Emits messages", func() {
+		first := connect()
+		defer first.Close()
+		second := connect()
+		defer second.Close()
+
+		recorder := request(
+			http.MethodPost,
+			"/emit",
+			`{"rules": [{"only_keys": ["`+keys[1]+`"], "any_of_topics": null}], "message": "hello"}`,
+		)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		_, message, err := second.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal("hello"))
+
+		first.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		_, _, err = first.ReadMessage()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,157 @@
+package magicsockets
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Limits the connections the server accepts. Zero values disable the corresponding limit.
+// Connections sharing a key are limited by MagicSocketOpts.MaxConnectionsPerKey.
+type AdmissionLimit struct {
+	// Handshakes above it are rejected with 503 Service Unavailable.
+	MaxConnections int
+	// Connections from the same RemoteIP. Handshakes above it are rejected with 429 Too Many Requests.
+	MaxConnectionsPerIP int
+	// Handshakes in progress, including OnConnect. Handshakes above it are rejected with 503 Service Unavailable.
+	MaxConcurrentHandshakes int
+
+	// Sent as the Retry-After header of rejected handshakes. Defaults to _DEFAULT_ADMISSION_RETRY_AFTER.
+	RetryAfter time.Duration
+	// Address connections are counted by for MaxConnectionsPerIP, e.g. read from X-Forwarded-For behind a trusted proxy.
+	// Defaults to the host of r.RemoteAddr.
+	RemoteIP func(r *http.Request) string
+}
+
+const (
+	_DEFAULT_ADMISSION_RETRY_AFTER = time.Second * 5
+)
+
+var (
+	ErrTooManyConnections      = errors.New("maximum amount of connections reached")
+	ErrTooManyConnectionsPerIP = errors.New("maximum amount of connections for remote IP reached")
+	ErrTooManyHandshakes       = errors.New("maximum amount of concurrent handshakes reached")
+)
+
+// Handshake refused by the admission limits, see MagicSocketOpts.OnAdmissionRejected.
+type AdmissionRejection struct {
+	Request *http.Request
+	// One of ErrTooManyConnections, ErrTooManyConnectionsPerIP, ErrTooManyHandshakes or ErrKeyLimitReached.
+	Err error
+	// Status the handshake was rejected with.
+	// Zero if the connection was already upgraded, it's then closed with 1013 Try Again Later.
+	Status int
+
+	RemoteIP string
+	// Empty when rejected before OnConnect.
+	Key string
+	// When the handshake was rejected.
+	Time time.Time
+}
+
+func (al AdmissionLimit) remoteIP(r *http.Request) string {
+	if al.RemoteIP != nil {
+		return al.RemoteIP(r)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Retry-After header value, in whole seconds.
+func (al AdmissionLimit) retryAfter() string {
+	retryAfter := al.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = _DEFAULT_ADMISSION_RETRY_AFTER
+	}
+	return strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+}
+
+// Counts a handshake in progress. Returns false, without counting it, if there are too many already.
+// Must be followed by endHandshake if it returns true.
+func (ms *magicSocket) startHandshake() bool {
+	limit := ms.admission.MaxConcurrentHandshakes
+	if limit <= 0 {
+		return true
+	}
+
+	if ms.handshakes.Add(1) > int64(limit) {
+		ms.handshakes.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (ms *magicSocket) endHandshake() {
+	if ms.admission.MaxConcurrentHandshakes > 0 {
+		ms.handshakes.Add(-1)
+	}
+}
+
+// Whether another connection from remoteIP can be registered.
+// Checked before OnConnect, then again while holding the server mutex before registering,
+// since it only reads the registry.
+func (ms *magicSocket) checkAdmission(remoteIP string) error {
+	if limit := ms.admission.MaxConnections; limit > 0 && ms.clients.len() >= limit {
+		return ErrTooManyConnections
+	}
+	if limit := ms.admission.MaxConnectionsPerIP; limit > 0 && ms.clients.countIP(remoteIP) >= limit {
+		return ErrTooManyConnectionsPerIP
+	}
+	return nil
+}
+
+func isAdmissionError(err error) bool {
+	return errors.Is(err, ErrTooManyConnections) ||
+		errors.Is(err, ErrTooManyConnectionsPerIP) ||
+		errors.Is(err, ErrTooManyHandshakes) ||
+		errors.Is(err, ErrKeyLimitReached)
+}
+
+// Responds to a handshake refused before being upgraded, by the admission limits or a key conflict.
+func (ms *magicSocket) refuseHandshake(w http.ResponseWriter, r *http.Request, key string, remoteIP string, err error) {
+	status := http.StatusConflict
+	switch {
+	case errors.Is(err, ErrTooManyConnections), errors.Is(err, ErrTooManyHandshakes):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrTooManyConnectionsPerIP), errors.Is(err, ErrKeyLimitReached):
+		status = http.StatusTooManyRequests
+	}
+
+	if !isAdmissionError(err) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Retry-After", ms.admission.retryAfter())
+	http.Error(w, err.Error(), status)
+	ms.admissionRejected(AdmissionRejection{
+		Request:  r,
+		Err:      err,
+		Status:   status,
+		RemoteIP: remoteIP,
+		Key:      key,
+		Time:     time.Now(),
+	})
+}
+
+// Reports a rejection. Must not be called while holding the server mutex, see runAfterUnlock.
+func (ms *magicSocket) admissionRejected(rejection AdmissionRejection) {
+	ms.logger.Warn(
+		"Handshake rejected by admission limits",
+		zap.String("Remote IP", rejection.RemoteIP),
+		zap.Error(rejection.Err),
+	)
+	ms.metrics.admissionRejected(ms.namespace, rejection.Err)
+	if ms.hooks.onAdmissionRejected != nil {
+		ms.hooks.onAdmissionRejected(rejection)
+	}
+}
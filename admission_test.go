@@ -0,0 +1,181 @@
+package magicsockets_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Admission limits", func() {
+	var (
+		ms         magicsockets.MagicSocket
+		httpServer *httptest.Server
+		opts       magicsockets.MagicSocketOpts
+
+		rejections chan magicsockets.AdmissionRejection
+	)
+
+	BeforeEach(func() {
+		rejections = make(chan magicsockets.AdmissionRejection, 10)
+		opts = magicsockets.MagicSocketOpts{
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{Key: r.URL.Query().Get("key")}, nil
+			},
+			OnAdmissionRejected: func(rejection magicsockets.AdmissionRejection) {
+				rejections <- rejection
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		ms = magicsockets.New(opts)
+		handler, err := ms.Handler()
+		Expect(err).ToNot(HaveOccurred())
+		httpServer = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+		httpServer.Close()
+	})
+
+	dial := func(key string, header http.Header) (*websocket.Conn, *http.Response, error) {
+		url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/?key=" + key
+		conn, res, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil {
+			DeferCleanup(func() { conn.Close() })
+		}
+		return conn, res, err
+	}
+
+	expectRejected := func(key string, header http.Header, status int, reason error) {
+		_, res, err := dial(key, header)
+		ExpectWithOffset(1, err).To(MatchError(websocket.ErrBadHandshake))
+		ExpectWithOffset(1, res.StatusCode).To(Equal(status))
+		ExpectWithOffset(1, res.Header.Get("Retry-After")).ToNot(BeEmpty())
+
+		var rejection magicsockets.AdmissionRejection
+		EventuallyWithOffset(1, rejections).Should(Receive(&rejection))
+		ExpectWithOffset(1, rejection.Err).To(MatchError(reason))
+		ExpectWithOffset(1, rejection.Status).To(Equal(status))
+	}
+
+	Context("With a maximum amount of connections", func() {
+		BeforeEach(func() {
+			opts.AdmissionLimit = magicsockets.AdmissionLimit{MaxConnections: 2, RetryAfter: 1500 * time.Millisecond}
+		})
+
+		It("Rejects connections above it until one disconnects", func() {
+			first, _, err := dial("a", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = dial("b", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, res, err := dial("c", nil)
+			Expect(err).To(MatchError(websocket.ErrBadHandshake))
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(res.Header.Get("Retry-After")).To(Equal("2"))
+			Eventually(rejections).Should(Receive(HaveField("Err", MatchError(magicsockets.ErrTooManyConnections))))
+
+			first.Close()
+			Eventually(ms.GetClients).Should(HaveLen(1))
+			_, _, err = dial("c", nil)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Rejects connections above it before calling OnConnect", func() {
+			connecting := make(chan string, 10)
+			onConnect := opts.OnConnect
+			ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				connecting <- r.URL.Query().Get("key")
+				return onConnect(r)
+			})
+
+			for _, key := range []string{"a", "b"} {
+				_, _, err := dial(key, nil)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			expectRejected("c", nil, http.StatusServiceUnavailable, magicsockets.ErrTooManyConnections)
+
+			Expect(connecting).To(Receive(Equal("a")))
+			Expect(connecting).To(Receive(Equal("b")))
+			Consistently(connecting).ShouldNot(Receive())
+		})
+	})
+
+	Context("With a maximum amount of connections per IP", func() {
+		BeforeEach(func() {
+			opts.AdmissionLimit = magicsockets.AdmissionLimit{
+				MaxConnectionsPerIP: 1,
+				RemoteIP: func(r *http.Request) string {
+					return r.Header.Get("X-Forwarded-For")
+				},
+			}
+		})
+
+		It("Counts the connections of each IP", func() {
+			_, _, err := dial("a", http.Header{"X-Forwarded-For": {"10.0.0.1"}})
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = dial("b", http.Header{"X-Forwarded-For": {"10.0.0.2"}})
+			Expect(err).ToNot(HaveOccurred())
+
+			expectRejected("c", http.Header{"X-Forwarded-For": {"10.0.0.1"}}, http.StatusTooManyRequests, magicsockets.ErrTooManyConnectionsPerIP)
+		})
+	})
+
+	Context("With a maximum amount of concurrent handshakes", func() {
+		var entered, release chan struct{}
+
+		BeforeEach(func() {
+			entered = make(chan struct{})
+			release = make(chan struct{})
+			onConnect := opts.OnConnect
+			opts.OnConnect = func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				if r.URL.Query().Get("key") == "slow" {
+					close(entered)
+					<-release
+				}
+				return onConnect(r)
+			}
+			opts.AdmissionLimit = magicsockets.AdmissionLimit{MaxConcurrentHandshakes: 1}
+		})
+
+		It("Rejects handshakes while others are in progress", func() {
+			done := make(chan error, 1)
+			go func() {
+				_, _, err := dial("slow", nil)
+				done <- err
+			}()
+			Eventually(entered).Should(BeClosed())
+			expectRejected("fast", nil, http.StatusServiceUnavailable, magicsockets.ErrTooManyHandshakes)
+
+			close(release)
+			Eventually(done).Should(Receive(BeNil()))
+			_, _, err := dial("fast", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ms.GetClientsByKey("slow")).To(HaveLen(1))
+		})
+	})
+
+	Context("With a maximum amount of connections per key", func() {
+		BeforeEach(func() {
+			opts.KeyConflictPolicy = magicsockets.KeyConflictAllow
+			opts.MaxConnectionsPerKey = 1
+		})
+
+		It("Reports the rejections", func() {
+			_, _, err := dial("a", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			expectRejected("a", nil, http.StatusTooManyRequests, magicsockets.ErrKeyLimitReached)
+		})
+	})
+})
@@ -0,0 +1,102 @@
+package magicsockets
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Distributes emitted messages between MagicSocket instances,
+// so that each of them applies the emit rules to its own clients.
+type Broker interface {
+	// Delivers the message to every subscriber of the broker.
+	Publish(message BrokerMessage) error
+
+	// Registers a handler for the messages published to the broker.
+	// The returned function removes the handler.
+	Subscribe(handler func(BrokerMessage)) (unsubscribe func(), err error)
+}
+
+type BrokerMessage struct {
+	// ID of the MagicSocket instance that published the message.
+	Origin string
+	// ID of the only MagicSocket instance that should handle the message.
+	// Empty for messages handled by every instance.
+	Target string `json:",omitempty"`
+
+	// Set for emitted messages.
+	Opts    EmitOpts
+	Message []byte
+
+	// Set for operations on clients connected to another instance.
+	Command *ClientCommand      `json:",omitempty"`
+	Reply   *ClientCommandReply `json:",omitempty"`
+}
+
+func (ms *magicSocket) handleBrokerMessage(message BrokerMessage) {
+	// Local clients were already reached when the message was emitted.
+	if message.Origin == ms.id {
+		return
+	}
+	if message.Target != "" && message.Target != ms.id {
+		return
+	}
+
+	ms.logger.Debug("Received message from broker", zap.String("Origin", message.Origin))
+
+	switch {
+	case message.Command != nil:
+		// Handled asynchronously so slow clients don't block the broker.
+		go ms.handleClientCommand(message.Origin, *message.Command)
+	case message.Reply != nil:
+		ms.handleClientCommandReply(*message.Reply)
+	default:
+		// Can't fail without a deadline.
+		ms.emitLocal(context.Background(), message.Opts, message.Message)
+	}
+}
+
+// Keeps track of the handlers subscribed to a Broker.
+type brokerSubscribers struct {
+	mutex *sync.RWMutex
+
+	handlers      map[int]func(BrokerMessage)
+	nextHandlerID int
+}
+
+func newBrokerSubscribers() *brokerSubscribers {
+	return &brokerSubscribers{
+		mutex:    &sync.RWMutex{},
+		handlers: make(map[int]func(BrokerMessage)),
+	}
+}
+
+func (bs *brokerSubscribers) subscribe(handler func(BrokerMessage)) func() {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	id := bs.nextHandlerID
+	bs.nextHandlerID++
+	bs.handlers[id] = handler
+
+	return func() {
+		bs.mutex.Lock()
+		defer bs.mutex.Unlock()
+		delete(bs.handlers, id)
+	}
+}
+
+// Handlers are called outside of the lock, so they may subscribe or unsubscribe.
+func (bs *brokerSubscribers) dispatch(message BrokerMessage) {
+	bs.mutex.RLock()
+	handlers := make([]func(BrokerMessage), 0, len(bs.handlers))
+	for _, handler := range bs.handlers {
+		handlers = append(handlers, handler)
+	}
+	bs.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
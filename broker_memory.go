@@ -0,0 +1,22 @@
+package magicsockets
+
+// In-process Broker, useful for tests or for several MagicSocket instances in the same binary.
+// Share the same MemoryBroker between the instances.
+type MemoryBroker struct {
+	subscribers *brokerSubscribers
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subscribers: newBrokerSubscribers(),
+	}
+}
+
+func (mb *MemoryBroker) Publish(message BrokerMessage) error {
+	mb.subscribers.dispatch(message)
+	return nil
+}
+
+func (mb *MemoryBroker) Subscribe(handler func(BrokerMessage)) (func(), error) {
+	return mb.subscribers.subscribe(handler), nil
+}
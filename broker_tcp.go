@@ -0,0 +1,446 @@
+package magicsockets
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Broker that connects MagicSocket instances directly to each other over TCP,
+// without any external service.
+//
+// Every instance listens for its peers and dials each of the peers it knows about.
+// Peers prove they know the shared secret when connecting, then messages are sent as newline delimited JSON.
+//
+// Messages carry emits and operations on clients, so the listening port must only be reachable by the other instances.
+type TCPBroker struct {
+	mutex  *sync.Mutex
+	logger *zap.Logger
+
+	listener    net.Listener
+	subscribers *brokerSubscribers
+
+	peers    map[string]*tcpPeer
+	accepted map[net.Conn]struct{}
+
+	secret         []byte
+	tlsConfig      *tls.Config
+	maxMessageSize int
+
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+
+	closed bool
+}
+
+type TCPBrokerOpts struct {
+	// Address to listen for other instances, e.g. "10.0.0.2:9090".
+	// Bind it to a private network: it must never be exposed publicly, even with Secret and TLSConfig set.
+	ListenAddress string
+	// Addresses of the other instances.
+	Peers []string
+
+	// Shared by every instance. Required.
+	// Peers answer a challenge with it when connecting, so it's never sent over the connection.
+	Secret string
+	// Encrypts the connections between instances when set, otherwise messages are sent in plain text.
+	// Used both to listen, with Certificates, and to dial the peers, verifying theirs.
+	TLSConfig *tls.Config
+	// Size above which published messages are refused, and peers sending them disconnected.
+	// Defaults to _DEFAULT_TCP_BROKER_MAX_MESSAGE_SIZE.
+	MaxMessageSize int
+
+	// Also bounds the handshake of the peers connecting to the broker.
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	Logger *zap.Logger
+}
+
+type tcpPeer struct {
+	mutex   *sync.Mutex
+	address string
+
+	conn net.Conn
+}
+
+const (
+	_DEFAULT_TCP_BROKER_DIAL_TIMEOUT     = time.Second * 2
+	_DEFAULT_TCP_BROKER_WRITE_TIMEOUT    = time.Second * 2
+	_DEFAULT_TCP_BROKER_MAX_MESSAGE_SIZE = 1 << 20
+
+	// Size of the challenge sent to connecting peers.
+	_TCP_BROKER_CHALLENGE_SIZE = 32
+	// Size above which handshake lines are refused.
+	_TCP_BROKER_MAX_HANDSHAKE_SIZE = 256
+	// Sent once a peer answered the challenge.
+	_TCP_BROKER_ACCEPTED = "ok"
+)
+
+var (
+	ErrBrokerClosed            = errors.New("broker closed")
+	ErrTCPBrokerSecretRequired = errors.New("tcp broker secret is required")
+	ErrBrokerMessageTooLarge   = errors.New("broker message too large")
+)
+
+// Starts listening for other instances right away.
+// Peers are dialed lazily, when the first message is published.
+func NewTCPBroker(opts TCPBrokerOpts) (*TCPBroker, error) {
+	if opts.Secret == "" {
+		return nil, ErrTCPBrokerSecretRequired
+	}
+
+	listener, err := net.Listen("tcp", opts.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for peers: %w", err)
+	}
+	if opts.TLSConfig != nil {
+		listener = tls.NewListener(listener, opts.TLSConfig)
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	dialTimeout := opts.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = _DEFAULT_TCP_BROKER_DIAL_TIMEOUT
+	}
+	writeTimeout := opts.WriteTimeout
+	if writeTimeout == 0 {
+		writeTimeout = _DEFAULT_TCP_BROKER_WRITE_TIMEOUT
+	}
+	maxMessageSize := opts.MaxMessageSize
+	if maxMessageSize == 0 {
+		maxMessageSize = _DEFAULT_TCP_BROKER_MAX_MESSAGE_SIZE
+	}
+
+	tb := &TCPBroker{
+		mutex:  &sync.Mutex{},
+		logger: logger.With(zap.String("Broker Address", listener.Addr().String())),
+
+		listener:    listener,
+		subscribers: newBrokerSubscribers(),
+
+		peers:    make(map[string]*tcpPeer),
+		accepted: make(map[net.Conn]struct{}),
+
+		secret:         []byte(opts.Secret),
+		tlsConfig:      opts.TLSConfig,
+		maxMessageSize: maxMessageSize,
+
+		dialTimeout:  dialTimeout,
+		writeTimeout: writeTimeout,
+	}
+	for _, address := range opts.Peers {
+		tb.AddPeer(address)
+	}
+
+	go tb.acceptPeers()
+
+	return tb, nil
+}
+
+// Address the broker is listening on.
+func (tb *TCPBroker) Addr() net.Addr {
+	return tb.listener.Addr()
+}
+
+// Adds an instance to publish messages to. No-op if it was already added.
+func (tb *TCPBroker) AddPeer(address string) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	if _, ok := tb.peers[address]; ok {
+		return
+	}
+	tb.peers[address] = &tcpPeer{
+		mutex:   &sync.Mutex{},
+		address: address,
+	}
+}
+
+// Stops publishing messages to an instance.
+func (tb *TCPBroker) RemovePeer(address string) {
+	tb.mutex.Lock()
+	peer, ok := tb.peers[address]
+	delete(tb.peers, address)
+	tb.mutex.Unlock()
+
+	if ok {
+		peer.close()
+	}
+}
+
+// Sends the message to every peer.
+// Failing peers are redialed on the next publish.
+func (tb *TCPBroker) Publish(message BrokerMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if len(data) > tb.maxMessageSize {
+		return fmt.Errorf("%w: %d bytes", ErrBrokerMessageTooLarge, len(data))
+	}
+	data = append(data, '\n')
+
+	tb.mutex.Lock()
+	if tb.closed {
+		tb.mutex.Unlock()
+		return ErrBrokerClosed
+	}
+	peers := make([]*tcpPeer, 0, len(tb.peers))
+	for _, peer := range tb.peers {
+		peers = append(peers, peer)
+	}
+	tb.mutex.Unlock()
+
+	failed := []string{}
+	for _, peer := range peers {
+		if err := peer.send(data, tb.dialPeer, tb.writeTimeout); err != nil {
+			tb.logger.Warn("Failed to publish message to peer", zap.String("Peer", peer.address), zap.Error(err))
+			failed = append(failed, peer.address)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to publish message to peers %v", failed)
+	}
+	return nil
+}
+
+func (tb *TCPBroker) Subscribe(handler func(BrokerMessage)) (func(), error) {
+	return tb.subscribers.subscribe(handler), nil
+}
+
+// Stops listening and closes every connection to the peers.
+func (tb *TCPBroker) Close() error {
+	tb.mutex.Lock()
+	if tb.closed {
+		tb.mutex.Unlock()
+		return nil
+	}
+	tb.closed = true
+
+	peers := tb.peers
+	tb.peers = make(map[string]*tcpPeer)
+	accepted := tb.accepted
+	tb.accepted = make(map[net.Conn]struct{})
+	tb.mutex.Unlock()
+
+	for _, peer := range peers {
+		peer.close()
+	}
+	for conn := range accepted {
+		conn.Close()
+	}
+
+	return tb.listener.Close()
+}
+
+func (tb *TCPBroker) acceptPeers() {
+	for {
+		conn, err := tb.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			tb.logger.Error("Failed to accept peer connection", zap.Error(err))
+			continue
+		}
+
+		tb.mutex.Lock()
+		if tb.closed {
+			tb.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		tb.accepted[conn] = struct{}{}
+		tb.mutex.Unlock()
+
+		go tb.readPeer(conn)
+	}
+}
+
+func (tb *TCPBroker) readPeer(conn net.Conn) {
+	logger := tb.logger.With(zap.String("Peer", conn.RemoteAddr().String()))
+
+	defer func() {
+		tb.mutex.Lock()
+		delete(tb.accepted, conn)
+		tb.mutex.Unlock()
+
+		conn.Close()
+		logger.Debug("Peer disconnected")
+	}()
+
+	// Lines hold the message and its delimiter.
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, _TCP_BROKER_MAX_HANDSHAKE_SIZE), tb.maxMessageSize+1)
+
+	if err := tb.challengePeer(conn, scanner); err != nil {
+		logger.Warn("Refused peer connection", zap.Error(err))
+		return
+	}
+	logger.Debug("Peer connected")
+
+	for scanner.Scan() {
+		var message BrokerMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			logger.Warn("Received invalid message from peer", zap.Error(err))
+			return
+		}
+
+		tb.subscribers.dispatch(message)
+	}
+
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		if errors.Is(err, bufio.ErrTooLong) {
+			logger.Warn("Peer sent a message above the size limit", zap.Int("Max Message Size", tb.maxMessageSize))
+			return
+		}
+		logger.Debug("Stopped reading from peer", zap.Error(err))
+	}
+}
+
+// Checks that a connecting peer knows the secret, by having it sign a random challenge.
+func (tb *TCPBroker) challengePeer(conn net.Conn, scanner *bufio.Scanner) error {
+	conn.SetDeadline(time.Now().Add(tb.dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := make([]byte, _TCP_BROKER_CHALLENGE_SIZE)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "%x\n", challenge); err != nil {
+		return err
+	}
+
+	answer, err := readHandshakeLine(scanner)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(answer), []byte(tb.sign(challenge))) {
+		return errors.New("peer answered the challenge with another secret")
+	}
+
+	_, err = fmt.Fprintf(conn, "%s\n", _TCP_BROKER_ACCEPTED)
+	return err
+}
+
+// Connects to a peer, answering its challenge.
+func (tb *TCPBroker) dialPeer(address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: tb.dialTimeout}
+
+	var conn net.Conn
+	var err error
+	if tb.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tb.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tb.answerChallenge(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("peer handshake failed: %w", err)
+	}
+	return conn, nil
+}
+
+func (tb *TCPBroker) answerChallenge(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(tb.dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, _TCP_BROKER_MAX_HANDSHAKE_SIZE), _TCP_BROKER_MAX_HANDSHAKE_SIZE)
+
+	line, err := readHandshakeLine(scanner)
+	if err != nil {
+		return err
+	}
+	challenge, err := hex.DecodeString(line)
+	if err != nil {
+		return fmt.Errorf("invalid challenge: %w", err)
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", tb.sign(challenge)); err != nil {
+		return err
+	}
+
+	// The peer closes the connection instead when the secrets don't match.
+	line, err = readHandshakeLine(scanner)
+	if err != nil {
+		return err
+	}
+	if line != _TCP_BROKER_ACCEPTED {
+		return fmt.Errorf("unexpected handshake answer %q", line)
+	}
+	return nil
+}
+
+func (tb *TCPBroker) sign(challenge []byte) string {
+	mac := hmac.New(sha256.New, tb.secret)
+	mac.Write(challenge)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func readHandshakeLine(scanner *bufio.Scanner) (string, error) {
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.ErrUnexpectedEOF
+	}
+	if len(scanner.Bytes()) > _TCP_BROKER_MAX_HANDSHAKE_SIZE {
+		return "", bufio.ErrTooLong
+	}
+	return scanner.Text(), nil
+}
+
+// Writes a newline delimited message, connecting to the peer first if needed.
+func (tp *tcpPeer) send(data []byte, dial func(address string) (net.Conn, error), writeTimeout time.Duration) error {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	if tp.conn == nil {
+		conn, err := dial(tp.address)
+		if err != nil {
+			return err
+		}
+		tp.conn = conn
+	}
+
+	tp.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := tp.conn.Write(data); err != nil {
+		tp.conn.Close()
+		tp.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (tp *tcpPeer) close() {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	if tp.conn != nil {
+		tp.conn.Close()
+		tp.conn = nil
+	}
+}
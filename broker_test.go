@@ -0,0 +1,189 @@
+package magicsockets_test
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Broker", func() {
+	var (
+		brokerA, brokerB magicsockets.Broker
+
+		msA, msB magicsockets.MagicSocket
+		addressB string
+
+		key string
+
+		websocketClientConn *websocket.Conn
+	)
+
+	JustBeforeEach(func() {
+		key = gofakeit.UUID()
+
+		msA, _ = startMagicSocket(magicsockets.MagicSocketOpts{Broker: brokerA})
+		msB, addressB = startMagicSocket(magicsockets.MagicSocketOpts{Broker: brokerB})
+		msB.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key: key,
+			}, nil
+		})
+
+		var err error
+		websocketClientConn, err = newWebsocketClientConn(addressB)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		websocketClientConn.Close()
+		Expect(msA.Stop()).To(Succeed())
+		Expect(msB.Stop()).To(Succeed())
+	})
+
+	itEmitsToOtherInstances := func() {
+		It("Emits to clients connected to other instances", func() {
+			testMessage := gofakeit.BuzzWord()
+			msA.Emit(magicsockets.EmitOpts{
+				Rules: []magicsockets.EmitRule{
+					{
+						OnlyKeys: []string{key},
+					},
+				},
+			}, []byte(testMessage))
+
+			_, message, err := websocketClientConn.ReadMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(message)).To(Equal(testMessage))
+		})
+	}
+
+	Context("In memory", func() {
+		BeforeEach(func() {
+			broker := magicsockets.NewMemoryBroker()
+			brokerA, brokerB = broker, broker
+		})
+
+		itEmitsToOtherInstances()
+	})
+
+	Context("Over TCP", func() {
+		var tcpBrokerA, tcpBrokerB *magicsockets.TCPBroker
+
+		startTCPBrokers := func(tlsConfig *tls.Config) {
+			var err error
+			tcpBrokerA, err = magicsockets.NewTCPBroker(magicsockets.TCPBrokerOpts{
+				ListenAddress: "127.0.0.1:0",
+				Secret:        "secret",
+				TLSConfig:     tlsConfig,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			tcpBrokerB, err = magicsockets.NewTCPBroker(magicsockets.TCPBrokerOpts{
+				ListenAddress: "127.0.0.1:0",
+				Peers:         []string{tcpBrokerA.Addr().String()},
+				Secret:        "secret",
+				TLSConfig:     tlsConfig,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			tcpBrokerA.AddPeer(tcpBrokerB.Addr().String())
+
+			brokerA, brokerB = tcpBrokerA, tcpBrokerB
+		}
+
+		// Subscribes to the messages tcpBrokerA receives from its peers.
+		subscribeA := func() chan magicsockets.BrokerMessage {
+			received := make(chan magicsockets.BrokerMessage, 1)
+			unsubscribe, err := tcpBrokerA.Subscribe(func(message magicsockets.BrokerMessage) {
+				select {
+				case received <- message:
+				default:
+				}
+			})
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(unsubscribe)
+			return received
+		}
+
+		AfterEach(func() {
+			Expect(tcpBrokerA.Close()).To(Succeed())
+			Expect(tcpBrokerB.Close()).To(Succeed())
+		})
+
+		Context("In plain text", func() {
+			BeforeEach(func() {
+				startTCPBrokers(nil)
+			})
+
+			itEmitsToOtherInstances()
+
+			It("Requires a secret", func() {
+				_, err := magicsockets.NewTCPBroker(magicsockets.TCPBrokerOpts{ListenAddress: "127.0.0.1:0"})
+				Expect(err).To(MatchError(magicsockets.ErrTCPBrokerSecretRequired))
+			})
+
+			It("Refuses peers with another secret", func() {
+				received := subscribeA()
+
+				intruder, err := magicsockets.NewTCPBroker(magicsockets.TCPBrokerOpts{
+					ListenAddress: "127.0.0.1:0",
+					Peers:         []string{tcpBrokerA.Addr().String()},
+					Secret:        "guess",
+				})
+				Expect(err).ToNot(HaveOccurred())
+				defer intruder.Close()
+
+				Expect(intruder.Publish(magicsockets.BrokerMessage{Origin: "intruder"})).ToNot(Succeed())
+				Consistently(received, time.Millisecond*200).ShouldNot(Receive())
+			})
+
+			It("Limits the size of messages", func() {
+				received := subscribeA()
+
+				large := magicsockets.BrokerMessage{Origin: "large", Message: make([]byte, 2<<20)}
+				Expect(tcpBrokerB.Publish(large)).To(MatchError(magicsockets.ErrBrokerMessageTooLarge))
+
+				// Peers with a larger limit are disconnected when sending messages above it.
+				unlimited, err := magicsockets.NewTCPBroker(magicsockets.TCPBrokerOpts{
+					ListenAddress:  "127.0.0.1:0",
+					Peers:          []string{tcpBrokerA.Addr().String()},
+					Secret:         "secret",
+					MaxMessageSize: 4 << 20,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				defer unlimited.Close()
+
+				unlimited.Publish(large)
+				Consistently(received, time.Millisecond*200).ShouldNot(Receive())
+
+				// Written to the closed connection until the peer is redialed.
+				Eventually(func() chan magicsockets.BrokerMessage {
+					unlimited.Publish(magicsockets.BrokerMessage{Origin: "small"})
+					return received
+				}).Should(Receive(HaveField("Origin", "small")))
+			})
+		})
+
+		Context("With TLS", func() {
+			BeforeEach(func() {
+				// Certificate valid for 127.0.0.1, and the pool trusting it.
+				server := httptest.NewTLSServer(nil)
+				server.Close()
+
+				startTCPBrokers(&tls.Config{
+					Certificates: server.TLS.Certificates,
+					RootCAs:      server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+				})
+			})
+
+			itEmitsToOtherInstances()
+		})
+	})
+})
@@ -1,11 +1,13 @@
 package magicsockets
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"net"
 	"net/http"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -16,17 +18,47 @@ type client struct {
 	mutex  *sync.Mutex
 	logger *zap.Logger
 
-	id  string
-	key string
+	id string
 
-	onIncoming   func(messageType int, data []byte) error
-	onOutgoing   func(messageType int, data []byte) error
-	onPing       func() error
-	onDisconnect func() error
+	// Guards key and topics, which are changed while also holding the server mutex.
+	stateMutex *sync.RWMutex
+	key        string
+	topics     []string
+
+	connectedAt time.Time
+	remoteAddr  string
+	// Counted by AdmissionLimit.MaxConnectionsPerIP.
+	remoteIP string
+
+	// Cancelled once the client is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	onIncoming   func(ctx context.Context, client ClientConn, messageType int, data []byte) error
+	onOutgoing   func(ctx context.Context, client ClientConn, messageType int, data []byte) error
+	onPing       func(ctx context.Context, client ClientConn) error
+	onDisconnect func(ctx context.Context, client ClientConn) error
+	// Nil when events aren't routed for this client.
+	events *EventRouter
+	// Nil when messages are exchanged as they are.
+	protocol clientProtocol
 
 	getServer func() *magicSocket
 
-	topics []string
+	// Nil when incoming messages aren't limited.
+	inboundLimiter *rateLimiter
+
+	// Nil when emitted messages are written right away.
+	outbound        *outboundQueue
+	droppedMessages *atomic.Uint64
+
+	// Changes of the registry entry are queued while holding the server mutex, see syncRegistry.
+	// queuedRegistryChanges is guarded by the server mutex, appliedRegistryChange by registryMutex.
+	registryMutex         *sync.Mutex
+	queuedRegistryChanges uint64
+	appliedRegistryChange uint64
+
+	conn Conn
 }
 
 type RegisterClientOpts struct {
@@ -36,6 +68,23 @@ type RegisterClientOpts struct {
 	OnOutgoing   func(messageType int, data []byte) error
 	OnPing       func() error
 	OnDisconnect func() error
+
+	// Variants of the hooks above receiving the context of the client, see ClientConn.Context,
+	// and the client they fire for. Used instead of them when set.
+	// See ClientHooks for what they may call.
+	OnIncomingContext   func(ctx context.Context, client ClientConn, messageType int, data []byte) error
+	OnOutgoingContext   func(ctx context.Context, client ClientConn, messageType int, data []byte) error
+	OnPingContext       func(ctx context.Context, client ClientConn) error
+	OnDisconnectContext func(ctx context.Context, client ClientConn) error
+
+	// Routes the incoming messages of this client by event name, after the OnIncoming hook.
+	// Its handlers take precedence over those of MagicSocketOpts.Events.
+	Events *EventRouter
+
+	// Overrides MagicSocketOpts.RateLimit for this client.
+	RateLimit *RateLimit
+	// Overrides MagicSocketOpts.OutboundLimit for this client.
+	OutboundLimit *OutboundLimit
 }
 
 type ClientConn interface {
@@ -48,69 +97,203 @@ type ClientConn interface {
 	UpdateKey(string) error
 	SetTopics([]string)
 
+	// Amount of emitted messages discarded because the client couldn't keep up.
+	GetDroppedMessages() uint64
+
+	GetConnectedAt() time.Time
+	// Network address of the client, as seen by the server.
+	GetRemoteAddr() string
+
+	// Carries the values of the context of the handshake request, and is cancelled once the client is disconnected.
+	Context() context.Context
+
 	WriteMessage(messageType int, data []byte) error
 	ReadMessage() (messageType int, p []byte, err error)
 }
 
-func (ms *magicSocket) registerClient(w http.ResponseWriter, r *http.Request, opts RegisterClientOpts) error {
-	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
+// newProtocol is nil for clients exchanging messages as they are, and requires a websocket connection.
+func (ms *magicSocket) registerClient(
+	w http.ResponseWriter,
+	r *http.Request,
+	opts RegisterClientOpts,
+	upgrade upgradeFunc,
+	newProtocol newClientProtocol,
+) error {
+	// Deferred before unlocking so the hook runs without holding the mutex.
+	var conflict *KeyConflict
+	defer func() {
+		if conflict != nil && ms.onKeyConflict != nil {
+			ms.onKeyConflict(*conflict)
+		}
+	}()
+
+	remoteIP := ms.admission.remoteIP(r)
 
-	if _, ok := ms.clients[opts.Key]; ok {
-		return errors.New("client already registered")
+	// Refused before upgrading, so the client gets a status; the handshake doesn't hold the server mutex.
+	// Connections upgraded already are only checked below, which closes them instead.
+	// The admission limits were checked before OnConnect, see handshakeWith.
+	if !isUpgraded(r) {
+		if err := ms.checkKey(opts.Key); err != nil {
+			ms.refuseHandshake(w, r, opts.Key, remoteIP, err)
+			return err
+		}
 	}
 
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow any origin
-		},
+	conn, err := upgrade(w, r)
+	if err != nil {
+		return err
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	ms.mutex.Lock()
+	defer ms.unlock()
+
+	// The connection, or the key, was taken by another handshake during OnConnect or while upgrading.
+	err = ms.checkAdmission(remoteIP)
+	if err == nil {
+		conflict, err = ms.claimKey(opts.Key)
+	}
 	if err != nil {
+		closeCode := websocket.ClosePolicyViolation
+		if isAdmissionError(err) {
+			closeCode = websocket.CloseTryAgainLater
+			rejection := AdmissionRejection{
+				Request:  r,
+				Err:      err,
+				RemoteIP: remoteIP,
+				Key:      opts.Key,
+				Time:     time.Now(),
+			}
+			ms.runAfterUnlock(func() {
+				ms.admissionRejected(rejection)
+			})
+		}
+		if controlConn, ok := conn.(ControlConn); ok {
+			closeConn(controlConn, closeCode, err.Error())
+		} else {
+			conn.Close()
+		}
 		return err
 	}
 
+	rateLimit := ms.rateLimit
+	if opts.RateLimit != nil {
+		rateLimit = *opts.RateLimit
+	}
+	outboundLimit := ms.outboundLimit
+	if opts.OutboundLimit != nil {
+		outboundLimit = *opts.OutboundLimit
+	}
+
+	hooks := opts.hooks(ms.clientHooks)
 	clientID := uuid.New().String()
 	logger := ms.logger.With(zap.String("Client ID", clientID))
+	// The request context is cancelled as soon as the handshake is done.
+	ctx, cancel := context.WithCancel(detachedContext{parent: r.Context()})
 	client := client{
 		mutex:        &sync.Mutex{},
 		logger:       logger,
 		id:           clientID,
+		stateMutex:   &sync.RWMutex{},
 		key:          opts.Key,
 		topics:       opts.Topics,
-		onIncoming:   opts.OnIncoming,
-		onOutgoing:   opts.OnOutgoing,
-		onPing:       opts.OnPing,
-		onDisconnect: opts.OnDisconnect,
+		connectedAt:  time.Now(),
+		remoteAddr:   r.RemoteAddr,
+		remoteIP:     remoteIP,
+		ctx:          ctx,
+		cancel:       cancel,
+		onIncoming:   hooks.OnIncoming,
+		onOutgoing:   hooks.OnOutgoing,
+		onPing:       hooks.OnPing,
+		onDisconnect: hooks.OnDisconnect,
+		events:       opts.Events,
 		getServer: func() *magicSocket {
 			return ms
 		},
+		inboundLimiter:  newRateLimiter(rateLimit),
+		outbound:        newOutboundQueue(outboundLimit),
+		droppedMessages: &atomic.Uint64{},
+		registryMutex:   &sync.Mutex{},
+		conn:            conn,
 	}
 
-	ms.connections[clientID] = conn
-	ms.clients[clientID] = &client
+	// Pings and protocols are only available over connections supporting control frames.
+	controlConn, isControlConn := conn.(ControlConn)
+
+	// Started before the client is registered, since emits don't wait for the registration to be done.
+	if isControlConn && newProtocol != nil {
+		client.protocol = newProtocol(&client)
+		if err := client.protocol.start(controlConn); err != nil {
+			cancel()
+			conn.Close()
+			return fmt.Errorf("failed to start protocol: %w", err)
+		}
+	}
+
+	ms.clients.add(&client)
+	ms.putRegistryEntry(&client)
+	ms.metrics.connected(ms.namespace)
+	if ms.hooks.onClientConnected != nil {
+		ms.runAfterUnlock(func() {
+			ms.hooks.onClientConnected(&client)
+		})
+	}
+
+	if isControlConn {
+		if client.onPing != nil {
+			controlConn.SetPingHandler(func(appData string) error {
+				return client.handlePing(controlConn, appData)
+			})
+		}
+		if ms.heartbeat.enabled() && (client.protocol == nil || !client.protocol.ownsLiveness()) {
+			client.startHeartbeat(controlConn, ms.heartbeat)
+		}
+	}
 
 	go ms.startIncomingMessagesChannel(client.id, opts)
+	if client.outbound != nil {
+		go client.writeOutbound()
+	}
 
 	return nil
 }
 
 func (cc *client) UpdateKey(newKey string) error {
 	ms := cc.getServer()
+
+	// Deferred before unlocking so the hook runs without holding the mutex.
+	var conflict *KeyConflict
+	defer func() {
+		if conflict != nil && ms.onKeyConflict != nil {
+			conflict.Client = cc
+			ms.onKeyConflict(*conflict)
+		}
+	}()
+
 	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
+	defer ms.unlock()
 
-	_, ok := ms.clientKeys[newKey]
-	if ok {
-		return fmt.Errorf("key %s already in use", newKey)
+	// Not a conflict with itself, whatever the policy.
+	if newKey == cc.key {
+		return nil
 	}
 
-	delete(ms.clientKeys, cc.key)
+	conflict, err := ms.claimKey(newKey)
+	if err != nil {
+		return fmt.Errorf("failed to update key to %s: %w", newKey, err)
+	}
+
+	oldKey := cc.key
+	cc.stateMutex.Lock()
 	cc.key = newKey
-	ms.clientKeys[newKey] = cc.id
+	cc.stateMutex.Unlock()
+	ms.clients.rekey(cc, oldKey, newKey)
+	ms.putRegistryEntry(cc)
+
+	if ms.hooks.onKeyChanged != nil {
+		ms.runAfterUnlock(func() {
+			ms.hooks.onKeyChanged(cc, oldKey, newKey)
+		})
+	}
 
 	return nil
 }
@@ -118,12 +301,25 @@ func (cc *client) UpdateKey(newKey string) error {
 func (cc *client) SetTopics(topics []string) {
 	ms := cc.getServer()
 	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
+	defer ms.unlock()
 
+	oldTopics := cc.topics
+	cc.stateMutex.Lock()
 	cc.topics = topics
+	cc.stateMutex.Unlock()
+	ms.putRegistryEntry(cc)
+
+	if ms.hooks.onTopicsChanged != nil {
+		ms.runAfterUnlock(func() {
+			ms.hooks.onTopicsChanged(cc, oldTopics, topics)
+		})
+	}
 }
 
 func (cc *client) GetKey() string {
+	cc.stateMutex.RLock()
+	defer cc.stateMutex.RUnlock()
+
 	return cc.key
 }
 
@@ -132,68 +328,198 @@ func (cc *client) GetID() string {
 }
 
 func (cc *client) GetTopics() []string {
+	cc.stateMutex.RLock()
+	defer cc.stateMutex.RUnlock()
+
 	return cc.topics
 }
 
+func (cc *client) GetDroppedMessages() uint64 {
+	return cc.droppedMessages.Load()
+}
+
+func (cc *client) GetConnectedAt() time.Time {
+	return cc.connectedAt
+}
+
+func (cc *client) GetRemoteAddr() string {
+	return cc.remoteAddr
+}
+
+func (cc *client) Context() context.Context {
+	return cc.ctx
+}
+
+// Answers pings after calling the OnPing hook, like the default ping handler of the connection.
+func (cc *client) handlePing(conn ControlConn, appData string) error {
+	ms := cc.getServer()
+	if err := cc.onPing(cc.ctx, cc); err != nil {
+		cc.logger.Error("onPing error", zap.Error(err))
+		ms.metrics.hookFailed(ms.namespace, "on_ping")
+	}
+
+	err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+	if err == websocket.ErrCloseSent {
+		return nil
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// Why a client was disconnected.
+type DisconnectReason string
+
+const (
+	// Close was called.
+	DisconnectClosed DisconnectReason = "closed"
+	// The connection was closed by the client, or failed.
+	DisconnectConnectionLost DisconnectReason = "connection_lost"
+	// Another connection took its key with KeyConflictReplace.
+	DisconnectReplaced DisconnectReason = "replaced"
+	// Exceeded its rate limit with RateLimitClose.
+	DisconnectRateLimited DisconnectReason = "rate_limited"
+	// Exceeded its outbound limits with SlowConsumerDisconnect.
+	DisconnectSlowConsumer DisconnectReason = "slow_consumer"
+	// The server was stopped.
+	DisconnectServerStopped DisconnectReason = "server_stopped"
+	// Didn't answer the heartbeat pings in time.
+	DisconnectHeartbeatTimeout DisconnectReason = "heartbeat_timeout"
+)
+
 func (cc *client) Close() error {
+	return cc.closeFor(DisconnectClosed)
+}
+
+func (cc *client) closeFor(reason DisconnectReason) error {
 	ms := cc.getServer()
 
 	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
+	defer ms.unlock()
 
-	cc.logger.Debug("Closing client connection")
+	return cc.close(reason)
+}
 
-	if ms.connections[cc.id] != nil {
-		err := ms.connections[cc.id].Close()
-		if err != nil {
-			cc.logger.Error("Failed to close client connection", zap.Error(err))
-			return err
+// Sends a close frame with the given code and text before closing the client.
+// Must be called while holding the server mutex.
+func (cc *client) closeWithCode(code int, text string, reason DisconnectReason) error {
+	if conn, ok := cc.conn.(ControlConn); ok {
+		message := websocket.FormatCloseMessage(code, text)
+		if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+			cc.logger.Debug("Failed to send close message", zap.Error(err))
 		}
 	}
 
+	return cc.close(reason)
+}
+
+// Must be called while holding the server mutex.
+func (cc *client) close(reason DisconnectReason) error {
+	ms := cc.getServer()
+
+	// Already closed.
+	if !ms.clients.contains(cc) {
+		return nil
+	}
+
+	cc.logger.Debug("Closing client connection", zap.String("Reason", string(reason)))
+
+	if err := cc.conn.Close(); err != nil {
+		cc.logger.Error("Failed to close client connection", zap.Error(err))
+		return err
+	}
+
+	// Runs once the client is removed and the mutex released, so it may call back into the server.
 	if cc.onDisconnect != nil {
-		if err := cc.onDisconnect(); err != nil {
-			cc.logger.Error("Failed to process onDisconnect", zap.Error(err))
-		}
+		ms.runAfterUnlock(func() {
+			if err := cc.onDisconnect(cc.ctx, cc); err != nil {
+				cc.logger.Error("Failed to process onDisconnect", zap.Error(err))
+				ms.metrics.hookFailed(ms.namespace, "on_disconnect")
+			}
+		})
 	}
 
-	delete(ms.connections, cc.id)
-	delete(ms.clients, cc.id)
-	delete(ms.clientKeys, cc.key)
+	ms.clients.remove(cc)
+	ms.deleteRegistryEntry(cc)
+	if cc.outbound != nil {
+		cc.outbound.close()
+	}
+	// After OnDisconnect, which still sees the context of the client.
+	ms.runAfterUnlock(cc.cancel)
+	if cc.protocol != nil {
+		ms.runAfterUnlock(cc.protocol.closed)
+	}
+	ms.metrics.disconnected(ms.namespace, reason)
+	if ms.hooks.onClientDisconnected != nil {
+		ms.runAfterUnlock(func() {
+			ms.hooks.onClientDisconnected(cc, reason)
+		})
+	}
 
-	cc = nil
 	return nil
 }
 
 // Sends a message to the client.
 func (cc *client) WriteMessage(messageType int, data []byte) error {
+	return cc.writeMessage(context.Background(), messageType, data)
+}
+
+// Fails if ctx is done, and bounds the write by its deadline.
+// Messages are framed by the protocol of the client, if any.
+func (cc *client) writeMessage(ctx context.Context, messageType int, data []byte) error {
+	return cc.writePrepared(ctx, messageType, data, nil)
+}
+
+// Like writeMessage, but writes prepared instead if the connection supports it, see PreparedConn.
+// prepared is ignored when the message is framed by a protocol.
+func (cc *client) writePrepared(ctx context.Context, messageType int, data []byte, prepared *websocket.PreparedMessage) error {
+	if cc.protocol == nil {
+		return cc.writeFrames(ctx, frame{messageType: messageType, data: data, prepared: prepared})
+	}
+
+	frames, err := cc.protocol.encode(ctx, messageType, data)
+	if err != nil {
+		return err
+	}
+	return cc.writeFrames(ctx, frames...)
+}
+
+// Writes frames as they are, e.g. those of the protocol of the client.
+func (cc *client) writeFrames(ctx context.Context, frames ...frame) error {
 	cc.mutex.Lock()
 	defer cc.mutex.Unlock()
 
-	defer func() {
-		val := recover()
-		if val != nil {
-			valString := fmt.Sprintf("%+v", val)
-			if strings.Contains(valString, "invalid memory address or nil pointer dereference") {
-				cc.logger.Debug("Client connection closed abruptly. Removing client...")
-				cc.Close()
-
-				return
-			}
-		}
-
-	}()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	ms := cc.getServer()
-	conn := ms.connections[cc.id]
-	if conn == nil {
+	// Cancelled once the client is closed.
+	if cc.ctx.Err() != nil {
 		return fmt.Errorf("connection already closed")
 	}
-	return ms.connections[cc.id].WriteMessage(messageType, data)
+
+	conn := cc.conn
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	preparedConn, _ := conn.(PreparedConn)
+	for _, frame := range frames {
+		var err error
+		if frame.prepared != nil && preparedConn != nil {
+			err = preparedConn.WritePreparedMessage(frame.prepared)
+		} else {
+			err = conn.WriteMessage(frame.messageType, frame.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Consumes a message sent from the client.
 func (cc *client) ReadMessage() (messageType int, p []byte, err error) {
-	s := cc.getServer()
-	return s.connections[cc.id].ReadMessage()
+	return cc.conn.ReadMessage()
 }
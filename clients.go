@@ -0,0 +1,195 @@
+package magicsockets
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Amount of shards of the client registry, a power of two.
+	_CLIENT_REGISTRY_SHARDS = 64
+)
+
+// Clients connected to this instance, by Client ID and by Client Key, and counted by remote IP.
+//
+// Sharded so that emits and lookups from many goroutines don't contend on a single lock:
+// readers only take the read locks of the shards they read, and never the server mutex.
+// Changes are serialized by the server mutex, and applied to one shard at a time, in an order
+// keeping every client found by its key also found by its ID.
+type clientRegistry struct {
+	shards [_CLIENT_REGISTRY_SHARDS]*clientShard
+	size   *atomic.Int64
+}
+
+type clientShard struct {
+	mutex *sync.RWMutex
+
+	// Clients whose ID belongs to the shard.
+	clients map[string]*client
+	// Key is a Client Key belonging to the shard.
+	// Value is the set of clients using that key, by Client ID.
+	keys map[string]map[string]*client
+	// Key is a remote IP belonging to the shard, value is the amount of clients connected from it.
+	ips map[string]int
+}
+
+func newClientRegistry() *clientRegistry {
+	cr := &clientRegistry{size: &atomic.Int64{}}
+	for i := range cr.shards {
+		cr.shards[i] = &clientShard{
+			mutex:   &sync.RWMutex{},
+			clients: make(map[string]*client),
+			keys:    make(map[string]map[string]*client),
+			ips:     make(map[string]int),
+		}
+	}
+	return cr
+}
+
+// Shard of a Client ID, Client Key or remote IP, using FNV-1a.
+func (cr *clientRegistry) shard(s string) *clientShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= 16777619
+	}
+	return cr.shards[hash&(_CLIENT_REGISTRY_SHARDS-1)]
+}
+
+// Must be called while holding the server mutex.
+func (cr *clientRegistry) add(cc *client) {
+	shard := cr.shard(cc.id)
+	shard.mutex.Lock()
+	shard.clients[cc.id] = cc
+	shard.mutex.Unlock()
+	cr.size.Add(1)
+
+	cr.addKey(cc.key, cc)
+	cr.addIP(cc.remoteIP, 1)
+}
+
+// No-op if the client isn't registered.
+// Must be called while holding the server mutex.
+func (cr *clientRegistry) remove(cc *client) {
+	if !cr.contains(cc) {
+		return
+	}
+
+	cr.removeKey(cc.key, cc)
+	cr.addIP(cc.remoteIP, -1)
+
+	shard := cr.shard(cc.id)
+	shard.mutex.Lock()
+	delete(shard.clients, cc.id)
+	shard.mutex.Unlock()
+	cr.size.Add(-1)
+}
+
+// Moves the client from oldKey to newKey. The client is briefly found by both.
+// Must be called while holding the server mutex.
+func (cr *clientRegistry) rekey(cc *client, oldKey string, newKey string) {
+	cr.addKey(newKey, cc)
+	cr.removeKey(oldKey, cc)
+}
+
+func (cr *clientRegistry) addKey(key string, cc *client) {
+	shard := cr.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	holders, ok := shard.keys[key]
+	if !ok {
+		holders = make(map[string]*client)
+		shard.keys[key] = holders
+	}
+	holders[cc.id] = cc
+}
+
+func (cr *clientRegistry) removeKey(key string, cc *client) {
+	shard := cr.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	holders, ok := shard.keys[key]
+	if !ok {
+		return
+	}
+	delete(holders, cc.id)
+	if len(holders) == 0 {
+		delete(shard.keys, key)
+	}
+}
+
+func (cr *clientRegistry) addIP(remoteIP string, delta int) {
+	shard := cr.shard(remoteIP)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	shard.ips[remoteIP] += delta
+	if shard.ips[remoteIP] <= 0 {
+		delete(shard.ips, remoteIP)
+	}
+}
+
+func (cr *clientRegistry) get(clientID string) (*client, bool) {
+	shard := cr.shard(clientID)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	cc, ok := shard.clients[clientID]
+	return cc, ok
+}
+
+// Whether this client, and not just a client with its ID, is registered.
+func (cr *clientRegistry) contains(cc *client) bool {
+	registered, ok := cr.get(cc.id)
+	return ok && registered == cc
+}
+
+func (cr *clientRegistry) byKey(key string) []*client {
+	shard := cr.shard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	holders := shard.keys[key]
+	clients := make([]*client, 0, len(holders))
+	for _, cc := range holders {
+		clients = append(clients, cc)
+	}
+	return clients
+}
+
+// Amount of clients using the key.
+func (cr *clientRegistry) countKey(key string) int {
+	shard := cr.shard(key)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	return len(shard.keys[key])
+}
+
+// Amount of clients connected from the remote IP.
+func (cr *clientRegistry) countIP(remoteIP string) int {
+	shard := cr.shard(remoteIP)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	return shard.ips[remoteIP]
+}
+
+// Snapshot of every client. Clients registered or removed while it's taken may or may not be included.
+func (cr *clientRegistry) all() []*client {
+	clients := make([]*client, 0, cr.len())
+	for _, shard := range cr.shards {
+		shard.mutex.RLock()
+		for _, cc := range shard.clients {
+			clients = append(clients, cc)
+		}
+		shard.mutex.RUnlock()
+	}
+	return clients
+}
+
+func (cr *clientRegistry) len() int {
+	return int(cr.size.Load())
+}
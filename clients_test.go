@@ -0,0 +1,128 @@
+package magicsockets_test
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Client registry", func() {
+	const (
+		workers          = 16
+		clientsPerWorker = 8
+		keys             = 4
+	)
+
+	var (
+		ms        magicsockets.MagicSocket
+		transport *magicsockets.PipeTransport
+		handler   http.Handler
+	)
+
+	BeforeEach(func() {
+		transport = magicsockets.NewPipeTransport()
+		ms = magicsockets.New(magicsockets.MagicSocketOpts{
+			Transport:         transport,
+			KeyConflictPolicy: magicsockets.KeyConflictAllow,
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{
+					Key:    r.URL.Query().Get("key"),
+					Topics: r.URL.Query()["topic"],
+				}, nil
+			},
+		})
+
+		var err error
+		handler, err = ms.Handler()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	// Reads the messages of the connection until it's closed, so emits never block on it.
+	drain := func(conn *magicsockets.PipeConn) {
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	expectConsistent := func(connected int) {
+		total, usedKeys := 0, 0
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("user-%d", k)
+			clients := ms.GetClientsByKey(key)
+			if len(clients) > 0 {
+				usedKeys++
+			}
+			for _, client := range clients {
+				ExpectWithOffset(1, client.GetKey()).To(Equal(key))
+
+				found, err := ms.LookupClient(client.GetID())
+				ExpectWithOffset(1, err).ToNot(HaveOccurred())
+				ExpectWithOffset(1, found).To(BeIdenticalTo(client))
+				total++
+			}
+		}
+		ExpectWithOffset(1, total).To(Equal(connected))
+		ExpectWithOffset(1, ms.GetClients()).To(HaveLen(usedKeys))
+	}
+
+	It("Stays consistent while clients connect, change and disconnect concurrently", func() {
+		wg := &sync.WaitGroup{}
+		for w := 0; w < workers; w++ {
+			w := w
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				for c := 0; c < clientsPerWorker; c++ {
+					target := fmt.Sprintf("/?key=user-%d&topic=news", (w+c)%keys)
+					conn, err := transport.Dial(handler, target, nil)
+					Expect(err).ToNot(HaveOccurred())
+					drain(conn)
+
+					ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{"news"}}}}, []byte("hello"))
+					ms.GetClients()
+					for _, client := range ms.GetClientsByKey(fmt.Sprintf("user-%d", c%keys)) {
+						client.GetTopics()
+					}
+				}
+
+				for _, client := range ms.GetClientsByKey(fmt.Sprintf("user-%d", w%keys)) {
+					client.SetTopics([]string{"sports"})
+					// Fails if the client was closed by another worker.
+					client.UpdateKey(fmt.Sprintf("user-%d", (w+1)%keys))
+				}
+			}()
+		}
+		wg.Wait()
+		expectConsistent(workers * clientsPerWorker)
+
+		closed := 0
+		for _, client := range ms.GetClientsByKey("user-0") {
+			wg.Add(1)
+			closed++
+			go func(client magicsockets.ClientConn) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				Expect(client.Close()).To(Succeed())
+			}(client)
+		}
+		wg.Wait()
+		expectConsistent(workers*clientsPerWorker - closed)
+		Expect(ms.GetClientsByKey("user-0")).To(BeEmpty())
+	})
+})
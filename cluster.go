@@ -0,0 +1,402 @@
+package magicsockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Operation on a client, forwarded to the instance it is connected to.
+type ClientCommand struct {
+	ID       string
+	Action   ClientCommandAction
+	ClientID string
+
+	Key         string   `json:",omitempty"`
+	Topics      []string `json:",omitempty"`
+	MessageType int      `json:",omitempty"`
+	Data        []byte   `json:",omitempty"`
+}
+
+type ClientCommandAction string
+
+const (
+	ClientCommandSetTopics    ClientCommandAction = "set_topics"
+	ClientCommandUpdateKey    ClientCommandAction = "update_key"
+	ClientCommandWriteMessage ClientCommandAction = "write_message"
+	ClientCommandClose        ClientCommandAction = "close"
+)
+
+type ClientCommandReply struct {
+	CommandID string
+	// Empty if the command succeeded.
+	Error string `json:",omitempty"`
+	// Identifies the sentinel error matched by Error, if any, so errors.Is holds for the instance that sent the command.
+	// See clientCommandErrors.
+	ErrorCode string `json:",omitempty"`
+}
+
+const (
+	_DEFAULT_REMOTE_COMMAND_TIMEOUT = time.Second * 5
+)
+
+// Sentinel errors of client commands, by the ErrorCode they're sent with.
+var clientCommandErrors = map[string]error{
+	"client_not_found":  ErrClientNotFound,
+	"key_in_use":        ErrKeyInUse,
+	"key_limit_reached": ErrKeyLimitReached,
+}
+
+var (
+	ErrNoBroker             = errors.New("a broker is required to reach clients connected to other instances")
+	ErrRemoteCommandTimeout = errors.New("timed out waiting for the instance the client is connected to")
+	ErrRemoteClientRead     = errors.New("can't read messages from a client connected to another instance")
+)
+
+// Proxy to a client connected to another instance.
+type remoteClient struct {
+	// Guards entry, whose key and topics are updated once changed on the other instance.
+	mutex *sync.RWMutex
+	entry RegistryEntry
+
+	getServer func() *magicSocket
+}
+
+func (ms *magicSocket) LookupClient(clientID string) (ClientConn, error) {
+	if ms.registry == nil {
+		client, ok := ms.clients.get(clientID)
+		if !ok {
+			return nil, ErrClientNotFound
+		}
+		return client, nil
+	}
+
+	entry, err := ms.registry.GetByID(clientID)
+	if err != nil {
+		return nil, err
+	}
+	return ms.clientFromEntry(entry)
+}
+
+func (ms *magicSocket) LookupClientsByKey(key string) ([]ClientConn, error) {
+	if ms.registry == nil {
+		return ms.GetClientsByKey(key), nil
+	}
+
+	entries, err := ms.registry.GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := []ClientConn{}
+	for _, entry := range entries {
+		client, err := ms.clientFromEntry(entry)
+		if err != nil {
+			// The client disconnected after being looked up.
+			if errors.Is(err, ErrClientNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+func (ms *magicSocket) clientFromEntry(entry RegistryEntry) (ClientConn, error) {
+	if entry.NodeID != ms.id {
+		return &remoteClient{
+			mutex: &sync.RWMutex{},
+			entry: entry,
+			getServer: func() *magicSocket {
+				return ms
+			},
+		}, nil
+	}
+
+	client, ok := ms.clients.get(entry.ClientID)
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+	return client, nil
+}
+
+// Stores the current state of the client in the registry, once the server mutex is released.
+// Must be called while holding the server mutex.
+func (ms *magicSocket) putRegistryEntry(cc *client) {
+	if ms.registry == nil {
+		return
+	}
+
+	entry := RegistryEntry{
+		ClientID: cc.id,
+		Key:      cc.key,
+		Topics:   cc.topics,
+
+		ConnectedAt: cc.connectedAt,
+		RemoteAddr:  cc.remoteAddr,
+
+		NodeID: ms.id,
+	}
+	ms.syncRegistry(cc, func() {
+		if err := ms.registry.Put(entry); err != nil {
+			cc.logger.Error("Failed to update client in registry", zap.Error(err))
+		}
+	})
+}
+
+// Removes the client from the registry, once the server mutex is released.
+// Must be called while holding the server mutex.
+func (ms *magicSocket) deleteRegistryEntry(cc *client) {
+	if ms.registry == nil {
+		return
+	}
+
+	ms.syncRegistry(cc, func() {
+		if err := ms.registry.Delete(cc.id); err != nil {
+			cc.logger.Error("Failed to remove client from registry", zap.Error(err))
+		}
+	})
+}
+
+// Queues a change of the registry entry of the client, so the registry isn't called while holding the server mutex.
+// Changes queued by different unlocks may run concurrently: each of them replaces the whole entry,
+// so those queued before the last one applied are skipped.
+// Must be called while holding the server mutex.
+func (ms *magicSocket) syncRegistry(cc *client, change func()) {
+	cc.queuedRegistryChanges++
+	queued := cc.queuedRegistryChanges
+
+	ms.runAfterUnlock(func() {
+		cc.registryMutex.Lock()
+		defer cc.registryMutex.Unlock()
+
+		if queued <= cc.appliedRegistryChange {
+			return
+		}
+		cc.appliedRegistryChange = queued
+		change()
+	})
+}
+
+// Publishes the command to the instance the client is connected to, and waits for its reply.
+func (ms *magicSocket) sendClientCommand(nodeID string, command ClientCommand) error {
+	if ms.broker == nil {
+		return ErrNoBroker
+	}
+
+	command.ID = uuid.NewString()
+	reply := make(chan ClientCommandReply, 1)
+
+	ms.pendingCommandsMutex.Lock()
+	ms.pendingCommands[command.ID] = reply
+	ms.pendingCommandsMutex.Unlock()
+
+	defer func() {
+		ms.pendingCommandsMutex.Lock()
+		delete(ms.pendingCommands, command.ID)
+		ms.pendingCommandsMutex.Unlock()
+	}()
+
+	err := ms.broker.Publish(BrokerMessage{
+		Origin:  ms.id,
+		Target:  nodeID,
+		Command: &command,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish client command: %w", err)
+	}
+
+	select {
+	case r := <-reply:
+		if r.Error == "" {
+			return nil
+		}
+		return remoteCommandError{message: r.Error, err: clientCommandErrors[r.ErrorCode]}
+	case <-time.After(ms.remoteCommandTimeout):
+		return ErrRemoteCommandTimeout
+	}
+}
+
+func (ms *magicSocket) handleClientCommand(origin string, command ClientCommand) {
+	logger := ms.logger.With(
+		zap.String("Client ID", command.ClientID),
+		zap.String("Command", string(command.Action)),
+		zap.String("Origin", origin),
+	)
+	logger.Debug("Received client command")
+
+	err := func() error {
+		client, ok := ms.clients.get(command.ClientID)
+		if !ok {
+			return ErrClientNotFound
+		}
+
+		switch command.Action {
+		case ClientCommandSetTopics:
+			client.SetTopics(command.Topics)
+			return nil
+		case ClientCommandUpdateKey:
+			return client.UpdateKey(command.Key)
+		case ClientCommandWriteMessage:
+			return client.WriteMessage(command.MessageType, command.Data)
+		case ClientCommandClose:
+			return client.Close()
+		default:
+			return fmt.Errorf("unknown client command %s", command.Action)
+		}
+	}()
+
+	reply := ClientCommandReply{CommandID: command.ID}
+	if err != nil {
+		logger.Debug("Client command failed", zap.Error(err))
+		reply.Error = err.Error()
+		for code, sentinel := range clientCommandErrors {
+			if errors.Is(err, sentinel) {
+				reply.ErrorCode = code
+				break
+			}
+		}
+	}
+
+	err = ms.broker.Publish(BrokerMessage{
+		Origin: ms.id,
+		Target: origin,
+		Reply:  &reply,
+	})
+	if err != nil {
+		logger.Error("Failed to publish client command reply", zap.Error(err))
+	}
+}
+
+// Error of a command run by another instance, wrapping the sentinel error it matched there, if any.
+type remoteCommandError struct {
+	message string
+	err     error
+}
+
+func (e remoteCommandError) Error() string {
+	return e.message
+}
+
+func (e remoteCommandError) Unwrap() error {
+	return e.err
+}
+
+// Only the first reply to a command is delivered: the entry is removed before sending,
+// so duplicate or late replies are ignored instead of blocking on the channel.
+func (ms *magicSocket) handleClientCommandReply(reply ClientCommandReply) {
+	ms.pendingCommandsMutex.Lock()
+	ch, ok := ms.pendingCommands[reply.CommandID]
+	delete(ms.pendingCommands, reply.CommandID)
+	ms.pendingCommandsMutex.Unlock()
+
+	// The command may have already timed out.
+	if ok {
+		ch <- reply
+	}
+}
+
+func (rc *remoteClient) GetID() string {
+	return rc.entry.ClientID
+}
+
+func (rc *remoteClient) GetKey() string {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+
+	return rc.entry.Key
+}
+
+func (rc *remoteClient) GetTopics() []string {
+	rc.mutex.RLock()
+	defer rc.mutex.RUnlock()
+
+	return rc.entry.Topics
+}
+
+// Not tracked for clients connected to other instances.
+func (rc *remoteClient) GetDroppedMessages() uint64 {
+	return 0
+}
+
+func (rc *remoteClient) GetConnectedAt() time.Time {
+	return rc.entry.ConnectedAt
+}
+
+func (rc *remoteClient) GetRemoteAddr() string {
+	return rc.entry.RemoteAddr
+}
+
+// Not tracked for clients connected to other instances.
+func (rc *remoteClient) Context() context.Context {
+	return context.Background()
+}
+
+// ID of the instance the client is connected to.
+func (rc *remoteClient) GetNodeID() string {
+	return rc.entry.NodeID
+}
+
+func (rc *remoteClient) Close() error {
+	return rc.getServer().sendClientCommand(rc.entry.NodeID, ClientCommand{
+		Action:   ClientCommandClose,
+		ClientID: rc.entry.ClientID,
+	})
+}
+
+func (rc *remoteClient) UpdateKey(newKey string) error {
+	err := rc.getServer().sendClientCommand(rc.entry.NodeID, ClientCommand{
+		Action:   ClientCommandUpdateKey,
+		ClientID: rc.entry.ClientID,
+		Key:      newKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	rc.mutex.Lock()
+	rc.entry.Key = newKey
+	rc.mutex.Unlock()
+	return nil
+}
+
+// Errors are logged, since the ClientConn interface doesn't return them.
+func (rc *remoteClient) SetTopics(topics []string) {
+	ms := rc.getServer()
+	err := ms.sendClientCommand(rc.entry.NodeID, ClientCommand{
+		Action:   ClientCommandSetTopics,
+		ClientID: rc.entry.ClientID,
+		Topics:   topics,
+	})
+	if err != nil {
+		ms.logger.Error(
+			"Failed to set topics of remote client",
+			zap.String("Client ID", rc.entry.ClientID),
+			zap.Error(err),
+		)
+		return
+	}
+
+	rc.mutex.Lock()
+	rc.entry.Topics = topics
+	rc.mutex.Unlock()
+}
+
+func (rc *remoteClient) WriteMessage(messageType int, data []byte) error {
+	return rc.getServer().sendClientCommand(rc.entry.NodeID, ClientCommand{
+		Action:      ClientCommandWriteMessage,
+		ClientID:    rc.entry.ClientID,
+		MessageType: messageType,
+		Data:        data,
+	})
+}
+
+func (rc *remoteClient) ReadMessage() (int, []byte, error) {
+	return 0, nil, ErrRemoteClientRead
+}
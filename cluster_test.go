@@ -0,0 +1,176 @@
+package magicsockets_test
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+// Publishes every command reply several times, as a broker redelivering messages would.
+type duplicatingBroker struct {
+	magicsockets.Broker
+}
+
+func (b duplicatingBroker) Publish(message magicsockets.BrokerMessage) error {
+	copies := 1
+	if message.Reply != nil {
+		copies = 3
+	}
+	for i := 0; i < copies; i++ {
+		if err := b.Broker.Publish(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ = Describe("Cluster", func() {
+	var (
+		msA, msB magicsockets.MagicSocket
+		addressB string
+
+		key string
+
+		websocketClientConn *websocket.Conn
+	)
+
+	BeforeEach(func() {
+		key = gofakeit.UUID()
+
+		broker := duplicatingBroker{Broker: magicsockets.NewMemoryBroker()}
+		registry := magicsockets.NewMemoryRegistry()
+		msA, _ = startMagicSocket(magicsockets.MagicSocketOpts{Broker: broker, Registry: registry})
+		msB, addressB = startMagicSocket(magicsockets.MagicSocketOpts{
+			Broker:            broker,
+			Registry:          registry,
+			KeyConflictPolicy: magicsockets.KeyConflictReject,
+		})
+		msB.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key: key,
+			}, nil
+		})
+
+		var err error
+		websocketClientConn, err = newWebsocketClientConn(addressB)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		websocketClientConn.Close()
+		Expect(msA.Stop()).To(Succeed())
+		Expect(msB.Stop()).To(Succeed())
+	})
+
+	lookupRemoteClient := func() magicsockets.ClientConn {
+		clients, err := msA.LookupClientsByKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(clients).To(HaveLen(1))
+		return clients[0]
+	}
+
+	It("Finds clients connected to other instances", func() {
+		Expect(msA.GetClientsByKey(key)).To(BeEmpty())
+
+		client := lookupRemoteClient()
+		Expect(client.GetKey()).To(Equal(key))
+
+		found, err := msA.LookupClient(client.GetID())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found.GetID()).To(Equal(client.GetID()))
+
+		_, err = msA.LookupClient(gofakeit.UUID())
+		Expect(err).To(MatchError(magicsockets.ErrClientNotFound))
+	})
+
+	It("Writes messages to clients connected to other instances", func() {
+		testMessage := gofakeit.BuzzWord()
+		Expect(lookupRemoteClient().WriteMessage(websocket.TextMessage, []byte(testMessage))).To(Succeed())
+
+		_, message, err := websocketClientConn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal(testMessage))
+	})
+
+	It("Updates clients connected to other instances", func() {
+		topics := []string{gofakeit.BuzzWord()}
+		lookupRemoteClient().SetTopics(topics)
+		Expect(msB.GetClients()[key].GetTopics()).To(Equal(topics))
+
+		newKey := gofakeit.UUID()
+		Expect(lookupRemoteClient().UpdateKey(newKey)).To(Succeed())
+		Expect(msB.GetClientsByKey(newKey)).To(HaveLen(1))
+
+		clients, err := msA.LookupClientsByKey(newKey)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(clients).To(HaveLen(1))
+		Expect(clients[0].GetTopics()).To(Equal(topics))
+	})
+
+	It("Returns the errors of clients connected to other instances", func() {
+		client := lookupRemoteClient()
+
+		key = gofakeit.UUID()
+		otherConn, err := newWebsocketClientConn(addressB)
+		Expect(err).ToNot(HaveOccurred())
+		defer otherConn.Close()
+
+		err = client.UpdateKey(key)
+		Expect(errors.Is(err, magicsockets.ErrKeyInUse)).To(BeTrue(), "expected ErrKeyInUse, got %v", err)
+		Expect(err.Error()).To(ContainSubstring(key))
+	})
+
+	It("Ignores duplicate replies to commands", func() {
+		client := lookupRemoteClient()
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+
+			for i := 0; i < 3; i++ {
+				client.SetTopics([]string{gofakeit.BuzzWord()})
+			}
+		}()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("Reads proxies to clients connected to other instances while they're updated", func() {
+		client := lookupRemoteClient()
+
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+
+			for i := 0; i < 100; i++ {
+				client.GetKey()
+				client.GetTopics()
+			}
+		}()
+
+		newKey := gofakeit.UUID()
+		Expect(client.UpdateKey(newKey)).To(Succeed())
+		client.SetTopics([]string{gofakeit.BuzzWord()})
+		Eventually(done).Should(BeClosed())
+		Expect(client.GetKey()).To(Equal(newKey))
+	})
+
+	It("Closes clients connected to other instances", func() {
+		Expect(lookupRemoteClient().Close()).To(Succeed())
+
+		_, _, err := websocketClientConn.ReadMessage()
+		Expect(err).To(HaveOccurred())
+
+		clients, err := msA.LookupClientsByKey(key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(clients).To(BeEmpty())
+	})
+})
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+const (
+	_DEFAULT_PORT = 8080
+
+	_UNIX_SOCKET_PREFIX = "unix:"
+)
+
+// Reads the config file, if any, and the MAGICSOCKETS_* environment variables with magicsockets.LoadConfig,
+// then overrides them with the flags that were set.
+func loadConfig(args []string, output io.Writer) (magicsockets.Config, error) {
+	flags := flag.NewFlagSet("magicsockets", flag.ContinueOnError)
+	flags.SetOutput(output)
+
+	configFile := flags.String("config", "", "Path to a YAML or JSON config file.")
+	port := flags.Int("port", _DEFAULT_PORT, "Port of the websockets server.")
+	namespace := flags.String("namespace", "", "Identifies the server in metrics.")
+	logLevel := flags.String("log-level", "", "Log level. Defaults to MAGICSOCKETS_LOG_LEVEL.")
+	logEncoding := flags.String("log-encoding", "", "Log encoding: console or json.")
+	tlsCert := flags.String("tls-cert", "", "TLS certificate file.")
+	tlsKey := flags.String("tls-key", "", "TLS key file.")
+	allowedOrigins := flags.String("allowed-origins", "", `Comma separated origins allowed to connect, or "*" for any.`)
+	authTokens := flags.String("auth-tokens", "", "Comma separated tokens accepted from clients.")
+	publishAddress := flags.String("publish-address", "", `Address of the publish API: "host:port" or "unix:/path/to/socket".`)
+	publishToken := flags.String("publish-token", "", "Bearer token required by the publish API.")
+
+	if err := flags.Parse(args); err != nil {
+		return magicsockets.Config{}, err
+	}
+
+	cfg, err := magicsockets.LoadConfig(*configFile)
+	if err != nil {
+		return magicsockets.Config{}, err
+	}
+	if cfg.Port == 0 {
+		cfg.Port = _DEFAULT_PORT
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "namespace":
+			cfg.Namespace = *namespace
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-encoding":
+			cfg.Log.Encoding = *logEncoding
+		case "tls-cert":
+			cfg.TLS.CertFile = *tlsCert
+		case "tls-key":
+			cfg.TLS.KeyFile = *tlsKey
+		case "allowed-origins":
+			cfg.AllowedOrigins = splitList(*allowedOrigins)
+		case "auth-tokens":
+			cfg.AuthTokens = splitList(*authTokens)
+		case "publish-address":
+			cfg.Publish.Address = *publishAddress
+		case "publish-token":
+			cfg.Publish.Token = *publishToken
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
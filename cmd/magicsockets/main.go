@@ -0,0 +1,194 @@
+// Runs a standalone MagicSocket server.
+//
+// Clients connect to the websockets server with their key and topics in the query string:
+//
+//	wss://host:8080/?key=user-1&topic=news&topic=sports&token=secret
+//
+// Other services emit messages through the publish API, which serves the emit route of the MagicSocket admin API:
+//
+//	curl --unix-socket /run/magicsockets.sock -X POST http://localhost/emit \
+//		-d '{"rules": [{"only_keys": null, "any_of_topics": ["news"]}], "message": "hello"}'
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:])
+	stop()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Runs the servers until one of them fails, or ctx is done.
+func run(ctx context.Context, args []string) error {
+	cfg, err := loadConfig(args, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	ms, err := newMagicSocket(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var publishServer *http.Server
+	publishErr := make(chan error, 1)
+	if cfg.Publish.Address != "" {
+		listener, err := listenPublish(cfg.Publish.Address)
+		if err != nil {
+			return err
+		}
+
+		publishServer = &http.Server{
+			Handler: publishHandler(ms, cfg.Publish.Token),
+		}
+		go func() {
+			if err := publishServer.Serve(listener); err != http.ErrServerClosed {
+				publishErr <- err
+				cancel()
+			}
+		}()
+	}
+
+	err = ms.Run(ctx)
+
+	if publishServer != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancelShutdown()
+		publishServer.Shutdown(shutdownCtx)
+	}
+
+	select {
+	case publishErr := <-publishErr:
+		return fmt.Errorf("publish API failed: %w", publishErr)
+	default:
+		return err
+	}
+}
+
+// Creates the server from the config, with the hooks of the command.
+func newMagicSocket(cfg magicsockets.Config) (magicsockets.MagicSocket, error) {
+	return magicsockets.NewFromConfig(cfg, magicsockets.MagicSocketOpts{
+		// Replaced by the allowed origins, if any.
+		CheckOrigin: sameOrigin,
+		OnConnect:   onConnect(cfg.AuthTokens),
+	})
+}
+
+// Registers clients with the key and topics in their query string, after checking their token.
+func onConnect(tokens []string) func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+	return func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+		query := r.URL.Query()
+
+		if len(tokens) > 0 {
+			token := bearerToken(r)
+			if token == "" {
+				token = query.Get("token")
+			}
+			if !containsToken(tokens, token) {
+				return magicsockets.RegisterClientOpts{}, errUnauthorized
+			}
+		}
+
+		key := query.Get("key")
+		if key == "" {
+			key = uuid.NewString()
+		}
+
+		return magicsockets.RegisterClientOpts{
+			Key:    key,
+			Topics: query["topic"],
+		}, nil
+	}
+}
+
+// Accepts requests from the same origin as the server, or without an Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Only serves the emit route of the admin API: publishers can't inspect nor disconnect clients.
+func publishHandler(ms magicsockets.MagicSocket, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/emit", ms.AdminHandler(magicsockets.AdminOpts{
+		Authorize: authorizePublisher(token),
+	}))
+	return mux
+}
+
+// Publishers aren't authenticated without a token, which is only allowed over unix sockets.
+func authorizePublisher(token string) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		if token != "" && !containsToken([]string{token}, bearerToken(r)) {
+			return errUnauthorized
+		}
+		return nil
+	}
+}
+
+func listenPublish(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, _UNIX_SOCKET_PREFIX) {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, _UNIX_SOCKET_PREFIX)
+	// Left behind by a previous run that didn't exit cleanly.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove existing unix socket: %w", err)
+	}
+	return net.Listen("unix", path)
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
+func containsToken(tokens []string, token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Config", func() {
+	It("Overrides the config file and environment variables with flags", func() {
+		path := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		Expect(os.WriteFile(path, []byte(`
+port: 9000
+log:
+  level: debug
+allowed_origins: [https://example.com]
+publish:
+  address: unix:/tmp/magicsockets.sock
+heartbeat:
+  interval: 30s
+`), 0o600)).To(Succeed())
+		Expect(os.Setenv("MAGICSOCKETS_NAMESPACE", "chat")).To(Succeed())
+		DeferCleanup(os.Unsetenv, "MAGICSOCKETS_NAMESPACE")
+
+		cfg, err := loadConfig([]string{"-config", path, "-port", "9001", "-auth-tokens", "a, b"}, io.Discard)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cfg.Port).To(Equal(9001))
+		Expect(cfg.Namespace).To(Equal("chat"))
+		Expect(cfg.Log.Level).To(Equal("debug"))
+		Expect(cfg.Heartbeat.Interval).To(Equal(magicsockets.Duration(30 * time.Second)))
+		Expect(cfg.AllowedOrigins).To(Equal([]string{"https://example.com"}))
+		Expect(cfg.AuthTokens).To(Equal([]string{"a", "b"}))
+		Expect(cfg.Publish.Address).To(Equal("unix:/tmp/magicsockets.sock"))
+	})
+
+	It("Rejects invalid configs", func() {
+		_, err := loadConfig([]string{"-tls-cert", "cert.pem"}, io.Discard)
+		Expect(err).To(MatchError(ContainSubstring("tls")))
+
+		_, err = loadConfig([]string{"-publish-address", "127.0.0.1:9000"}, io.Discard)
+		Expect(err).To(MatchError(ContainSubstring("publish.token")))
+
+		_, err = loadConfig([]string{"-publish-address", "unix:/tmp/magicsockets.sock"}, io.Discard)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = loadConfig([]string{"-log-level", "loud"}, io.Discard)
+		Expect(err).To(MatchError(ContainSubstring("log.level")))
+	})
+})
+
+var _ = Describe("Command", func() {
+	var (
+		port       int
+		socketPath string
+		cancel     context.CancelFunc
+		done       chan error
+
+		publisher *http.Client
+	)
+
+	BeforeEach(func() {
+		port = gofakeit.IntRange(10000, 30000)
+		socketPath = filepath.Join(GinkgoT().TempDir(), "publish.sock")
+		done = make(chan error, 1)
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go func() {
+			done <- run(ctx, []string{
+				"-port", fmt.Sprint(port),
+				"-auth-tokens", "secret",
+				"-allowed-origins", "https://example.com",
+				"-publish-address", "unix:" + socketPath,
+				"-publish-token", "publisher",
+			})
+		}()
+
+		publisher = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	dial := func(query string, header http.Header) (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/?%s", port, query), header)
+	}
+
+	// Returns the status of the response. Fails until the publish API is listening.
+	request := func(method string, path string, token string, body string) (int, error) {
+		req, err := http.NewRequest(method, "http://magicsockets"+path, strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		res, err := publisher.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	publish := func(token string, body string) (int, error) {
+		return request(http.MethodPost, "/emit", token, body)
+	}
+
+	It("Emits messages published through the unix socket", func() {
+		var conn *websocket.Conn
+		Eventually(func() error {
+			var err error
+			conn, _, err = dial("key=user-1&topic=news&token=secret", nil)
+			return err
+		}).Should(Succeed())
+		defer conn.Close()
+
+		Eventually(func() (int, error) {
+			return publish("publisher", `{"rules": [{"only_keys": null, "any_of_topics": ["news"]}], "message": "hello"}`)
+		}).Should(Equal(http.StatusAccepted))
+
+		_, message, err := conn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal("hello"))
+
+		Expect(publish("wrong", `{"rules": [], "message": "hello"}`)).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("Only serves the emit route of the admin API", func() {
+		Eventually(func() (int, error) {
+			return publish("publisher", `{"rules": [], "message": "hello"}`)
+		}).Should(Equal(http.StatusAccepted))
+
+		Expect(request(http.MethodGet, "/clients", "publisher", "")).To(Equal(http.StatusNotFound))
+		Expect(request(http.MethodDelete, "/clients/"+gofakeit.UUID(), "publisher", "")).To(Equal(http.StatusNotFound))
+	})
+
+	It("Authenticates clients and checks their origin", func() {
+		Eventually(func() error {
+			conn, _, err := dial("token=secret", http.Header{"Origin": {"https://example.com"}})
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+
+		_, res, err := dial("token=wrong", nil)
+		Expect(err).To(HaveOccurred())
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+
+		_, res, err = dial("", http.Header{"Authorization": {"Bearer secret"}, "Origin": {"https://evil.com"}})
+		Expect(err).To(HaveOccurred())
+		Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+	})
+})
@@ -0,0 +1,502 @@
+package magicsockets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+// Declarative settings of a MagicSocket, loaded from YAML or JSON files and MAGICSOCKETS_* environment variables.
+// Zero values leave the corresponding MagicSocketOpts untouched.
+//
+// Each setting can be overridden by an environment variable named after its path,
+// e.g. MAGICSOCKETS_RATE_LIMIT_MESSAGES_PER_SECOND for rate_limit.messages_per_second.
+// Lists are comma separated.
+type Config struct {
+	Port        int      `json:"port" yaml:"port"`
+	GracePeriod Duration `json:"grace_period" yaml:"grace_period"`
+	Namespace   string   `json:"namespace" yaml:"namespace"`
+
+	Log LogConfig `json:"log" yaml:"log"`
+	TLS TLSConfig `json:"tls" yaml:"tls"`
+
+	// One of "reject", "replace" or "allow".
+	KeyConflictPolicy    string `json:"key_conflict_policy" yaml:"key_conflict_policy"`
+	MaxConnectionsPerKey int    `json:"max_connections_per_key" yaml:"max_connections_per_key"`
+
+	RemoteCommandTimeout Duration `json:"remote_command_timeout" yaml:"remote_command_timeout"`
+
+	AdmissionLimit AdmissionLimitConfig `json:"admission_limit" yaml:"admission_limit"`
+	RateLimit      RateLimitConfig      `json:"rate_limit" yaml:"rate_limit"`
+	OutboundLimit  OutboundLimitConfig  `json:"outbound_limit" yaml:"outbound_limit"`
+	Heartbeat      HeartbeatConfig      `json:"heartbeat" yaml:"heartbeat"`
+	Upgrader       UpgraderConfig       `json:"upgrader" yaml:"upgrader"`
+
+	// Origins allowed to connect from browsers. "*" allows any origin.
+	// When empty, MagicSocketOpts.CheckOrigin is left untouched.
+	AllowedOrigins []string `json:"allowed_origins" yaml:"allowed_origins"`
+
+	// Settings of the magicsockets command, not applied to MagicSocketOpts.
+
+	// Tokens accepted from clients, in the Authorization header or the token query parameter.
+	// When empty, clients aren't authenticated.
+	AuthTokens []string      `json:"auth_tokens" yaml:"auth_tokens"`
+	Publish    PublishConfig `json:"publish" yaml:"publish"`
+}
+
+type LogConfig struct {
+	// One of "debug", "info", "warn", "error", "dpanic", "panic" or "fatal".
+	Level string `json:"level" yaml:"level"`
+	// One of "console" or "json".
+	Encoding string `json:"encoding" yaml:"encoding"`
+}
+
+type TLSConfig struct {
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+}
+
+type AdmissionLimitConfig struct {
+	MaxConnections          int      `json:"max_connections" yaml:"max_connections"`
+	MaxConnectionsPerIP     int      `json:"max_connections_per_ip" yaml:"max_connections_per_ip"`
+	MaxConcurrentHandshakes int      `json:"max_concurrent_handshakes" yaml:"max_concurrent_handshakes"`
+	RetryAfter              Duration `json:"retry_after" yaml:"retry_after"`
+}
+
+type RateLimitConfig struct {
+	MessagesPerSecond float64 `json:"messages_per_second" yaml:"messages_per_second"`
+	MessageBurst      int     `json:"message_burst" yaml:"message_burst"`
+	BytesPerSecond    float64 `json:"bytes_per_second" yaml:"bytes_per_second"`
+	ByteBurst         int     `json:"byte_burst" yaml:"byte_burst"`
+	// One of "drop", "delay", "error" or "close".
+	Action       string `json:"action" yaml:"action"`
+	ErrorMessage string `json:"error_message" yaml:"error_message"`
+}
+
+type OutboundLimitConfig struct {
+	MaxQueuedMessages int `json:"max_queued_messages" yaml:"max_queued_messages"`
+	MaxQueuedBytes    int `json:"max_queued_bytes" yaml:"max_queued_bytes"`
+	// One of "drop_newest", "drop_oldest", "coalesce" or "disconnect".
+	Policy string `json:"policy" yaml:"policy"`
+}
+
+type HeartbeatConfig struct {
+	Interval Duration `json:"interval" yaml:"interval"`
+	Timeout  Duration `json:"timeout" yaml:"timeout"`
+}
+
+// Serves the emit route of the admin API, so other services can emit messages.
+type PublishConfig struct {
+	// "host:port", or "unix:/path/to/socket". The publish API is disabled when empty.
+	Address string `json:"address" yaml:"address"`
+	// Required from publishers as a bearer token.
+	// Can only be empty, not authenticating publishers, when listening on a unix socket.
+	Token string `json:"token" yaml:"token"`
+}
+
+type UpgraderConfig struct {
+	ReadBufferSize    int      `json:"read_buffer_size" yaml:"read_buffer_size"`
+	WriteBufferSize   int      `json:"write_buffer_size" yaml:"write_buffer_size"`
+	HandshakeTimeout  Duration `json:"handshake_timeout" yaml:"handshake_timeout"`
+	EnableCompression bool     `json:"enable_compression" yaml:"enable_compression"`
+	Subprotocols      []string `json:"subprotocols" yaml:"subprotocols"`
+}
+
+// time.Duration written as a string, such as "5s" or "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", text)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Invalid setting. Field is its path in the config file, or the environment variable it was read from.
+type ConfigError struct {
+	Field string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// Every invalid setting of a Config.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return "invalid magicsockets config: " + strings.Join(messages, "; ")
+}
+
+const (
+	_CONFIG_ENV_PREFIX = "MAGICSOCKETS"
+
+	// Prefix of publish addresses listening on a unix socket.
+	_UNIX_SOCKET_PREFIX = "unix:"
+)
+
+// Reads the YAML or JSON file at path, by its extension, and overrides it with MAGICSOCKETS_* environment variables.
+// With an empty path, only environment variables are read.
+func LoadConfig(path string) (Config, error) {
+	config := Config{}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("failed to read config file: %w", err)
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			decoder := yaml.NewDecoder(bytes.NewReader(data))
+			decoder.KnownFields(true)
+			if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+				return Config{}, fmt.Errorf("failed to parse config file %s: %w", path, err)
+			}
+		case ".json":
+			decoder := json.NewDecoder(bytes.NewReader(data))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&config); err != nil {
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &typeErr) {
+					err = &ConfigError{Field: typeErr.Field, Err: fmt.Errorf("expected %s", typeErr.Type)}
+				}
+				return Config{}, fmt.Errorf("failed to parse config file %s: %w", path, err)
+			}
+		default:
+			return Config{}, fmt.Errorf("unsupported config file extension %s, expected .yaml, .yml or .json", filepath.Ext(path))
+		}
+	}
+
+	if errs := loadConfigEnv(reflect.ValueOf(&config).Elem(), _CONFIG_ENV_PREFIX); len(errs) > 0 {
+		return Config{}, errs
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// Overrides the fields of the struct with the environment variables named after their yaml tags.
+func loadConfigEnv(value reflect.Value, prefix string) ConfigErrors {
+	errs := ConfigErrors{}
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := strings.Split(value.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		envName := prefix + "_" + strings.ToUpper(name)
+
+		if field.Kind() == reflect.Struct {
+			errs = append(errs, loadConfigEnv(field, envName)...)
+			continue
+		}
+
+		env, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+		if err := setConfigField(field, env); err != nil {
+			errs = append(errs, &ConfigError{Field: envName, Err: err})
+		}
+	}
+
+	return errs
+}
+
+func setConfigField(field reflect.Value, env string) error {
+	if field.Type() == reflect.TypeOf(Duration(0)) {
+		return field.Addr().Interface().(*Duration).UnmarshalText([]byte(env))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(env)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", env)
+		}
+		field.SetInt(int64(parsed))
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", env)
+		}
+		field.SetFloat(parsed)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", env)
+		}
+		field.SetBool(parsed)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// Returns ConfigErrors with every invalid setting.
+func (c Config) Validate() error {
+	errs := ConfigErrors{}
+	check := func(valid bool, field string, format string, args ...any) {
+		if !valid {
+			errs = append(errs, &ConfigError{Field: field, Err: fmt.Errorf(format, args...)})
+		}
+	}
+
+	check(c.Port >= 0 && c.Port <= 65535, "port", "out of range: %d", c.Port)
+	check(c.GracePeriod >= 0, "grace_period", "must not be negative")
+	check(c.RemoteCommandTimeout >= 0, "remote_command_timeout", "must not be negative")
+
+	if c.Log.Level != "" {
+		_, err := zapcore.ParseLevel(c.Log.Level)
+		check(err == nil, "log.level", "unknown level %q", c.Log.Level)
+	}
+	check(
+		c.Log.Encoding == "" || c.Log.Encoding == "console" || c.Log.Encoding == "json",
+		"log.encoding", `must be "console" or "json", got %q`, c.Log.Encoding,
+	)
+	check(
+		(c.TLS.CertFile == "") == (c.TLS.KeyFile == ""),
+		"tls", "both cert_file and key_file are required",
+	)
+
+	if c.KeyConflictPolicy != "" {
+		_, ok := parseConfigEnum(c.KeyConflictPolicy, KeyConflictReject, KeyConflictReplace, KeyConflictAllow)
+		check(ok, "key_conflict_policy", "unknown policy %q", c.KeyConflictPolicy)
+	}
+	check(c.MaxConnectionsPerKey >= 0, "max_connections_per_key", "must not be negative")
+
+	check(c.AdmissionLimit.MaxConnections >= 0, "admission_limit.max_connections", "must not be negative")
+	check(c.AdmissionLimit.MaxConnectionsPerIP >= 0, "admission_limit.max_connections_per_ip", "must not be negative")
+	check(c.AdmissionLimit.MaxConcurrentHandshakes >= 0, "admission_limit.max_concurrent_handshakes", "must not be negative")
+	check(c.AdmissionLimit.RetryAfter >= 0, "admission_limit.retry_after", "must not be negative")
+
+	check(c.RateLimit.MessagesPerSecond >= 0, "rate_limit.messages_per_second", "must not be negative")
+	check(c.RateLimit.MessageBurst >= 0, "rate_limit.message_burst", "must not be negative")
+	check(c.RateLimit.BytesPerSecond >= 0, "rate_limit.bytes_per_second", "must not be negative")
+	check(c.RateLimit.ByteBurst >= 0, "rate_limit.byte_burst", "must not be negative")
+	if c.RateLimit.Action != "" {
+		_, ok := parseConfigEnum(c.RateLimit.Action, RateLimitDrop, RateLimitDelay, RateLimitError, RateLimitClose)
+		check(ok, "rate_limit.action", "unknown action %q", c.RateLimit.Action)
+	}
+
+	check(c.OutboundLimit.MaxQueuedMessages >= 0, "outbound_limit.max_queued_messages", "must not be negative")
+	check(c.OutboundLimit.MaxQueuedBytes >= 0, "outbound_limit.max_queued_bytes", "must not be negative")
+	if c.OutboundLimit.Policy != "" {
+		_, ok := parseConfigEnum(
+			c.OutboundLimit.Policy,
+			SlowConsumerDropNewest, SlowConsumerDropOldest, SlowConsumerCoalesce, SlowConsumerDisconnect,
+		)
+		check(ok, "outbound_limit.policy", "unknown policy %q", c.OutboundLimit.Policy)
+	}
+
+	check(c.Heartbeat.Interval >= 0, "heartbeat.interval", "must not be negative")
+	check(c.Heartbeat.Timeout >= 0, "heartbeat.timeout", "must not be negative")
+	check(
+		c.Heartbeat.Timeout == 0 || c.Heartbeat.Interval > 0,
+		"heartbeat.timeout", "requires heartbeat.interval",
+	)
+
+	check(c.Upgrader.ReadBufferSize >= 0, "upgrader.read_buffer_size", "must not be negative")
+	check(c.Upgrader.WriteBufferSize >= 0, "upgrader.write_buffer_size", "must not be negative")
+	check(c.Upgrader.HandshakeTimeout >= 0, "upgrader.handshake_timeout", "must not be negative")
+
+	check(c.Publish.Address != _UNIX_SOCKET_PREFIX, "publish.address", "missing unix socket path")
+	check(
+		c.Publish.Address == "" || strings.HasPrefix(c.Publish.Address, _UNIX_SOCKET_PREFIX) || c.Publish.Token != "",
+		"publish.token", "required to serve the publish API over TCP",
+	)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Returns the value whose String() matches.
+func parseConfigEnum[T fmt.Stringer](value string, values ...T) (T, bool) {
+	for _, v := range values {
+		if v.String() == strings.ToLower(value) {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// Applies the settings of the config on top of opts.
+// Hooks and other settings that can only be set in code are taken from opts.
+func (c Config) Apply(opts MagicSocketOpts) (MagicSocketOpts, error) {
+	if err := c.Validate(); err != nil {
+		return MagicSocketOpts{}, err
+	}
+
+	if c.Port != 0 {
+		opts.Port = c.Port
+	}
+	if c.GracePeriod != 0 {
+		opts.GracePeriod = time.Duration(c.GracePeriod)
+	}
+	if c.Namespace != "" {
+		opts.Namespace = c.Namespace
+	}
+
+	if c.Log.Level != "" {
+		level, _ := zapcore.ParseLevel(c.Log.Level)
+		opts.LoggerOpts.LogLevel = &level
+	}
+	if c.Log.Encoding != "" {
+		opts.LoggerOpts.Encoding = c.Log.Encoding
+	}
+	if c.TLS.CertFile != "" {
+		opts.TLSCertFile = c.TLS.CertFile
+		opts.TLSKeyFile = c.TLS.KeyFile
+	}
+
+	if c.KeyConflictPolicy != "" {
+		opts.KeyConflictPolicy, _ = parseConfigEnum(c.KeyConflictPolicy, KeyConflictReject, KeyConflictReplace, KeyConflictAllow)
+	}
+	if c.MaxConnectionsPerKey != 0 {
+		opts.MaxConnectionsPerKey = c.MaxConnectionsPerKey
+	}
+	if c.RemoteCommandTimeout != 0 {
+		opts.RemoteCommandTimeout = time.Duration(c.RemoteCommandTimeout)
+	}
+
+	if c.AdmissionLimit.MaxConnections != 0 {
+		opts.AdmissionLimit.MaxConnections = c.AdmissionLimit.MaxConnections
+	}
+	if c.AdmissionLimit.MaxConnectionsPerIP != 0 {
+		opts.AdmissionLimit.MaxConnectionsPerIP = c.AdmissionLimit.MaxConnectionsPerIP
+	}
+	if c.AdmissionLimit.MaxConcurrentHandshakes != 0 {
+		opts.AdmissionLimit.MaxConcurrentHandshakes = c.AdmissionLimit.MaxConcurrentHandshakes
+	}
+	if c.AdmissionLimit.RetryAfter != 0 {
+		opts.AdmissionLimit.RetryAfter = time.Duration(c.AdmissionLimit.RetryAfter)
+	}
+
+	if c.RateLimit.MessagesPerSecond != 0 {
+		opts.RateLimit.MessagesPerSecond = c.RateLimit.MessagesPerSecond
+	}
+	if c.RateLimit.MessageBurst != 0 {
+		opts.RateLimit.MessageBurst = c.RateLimit.MessageBurst
+	}
+	if c.RateLimit.BytesPerSecond != 0 {
+		opts.RateLimit.BytesPerSecond = c.RateLimit.BytesPerSecond
+	}
+	if c.RateLimit.ByteBurst != 0 {
+		opts.RateLimit.ByteBurst = c.RateLimit.ByteBurst
+	}
+	if c.RateLimit.Action != "" {
+		opts.RateLimit.Action, _ = parseConfigEnum(c.RateLimit.Action, RateLimitDrop, RateLimitDelay, RateLimitError, RateLimitClose)
+	}
+	if c.RateLimit.ErrorMessage != "" {
+		opts.RateLimit.ErrorMessage = []byte(c.RateLimit.ErrorMessage)
+	}
+
+	if c.OutboundLimit.MaxQueuedMessages != 0 {
+		opts.OutboundLimit.MaxQueuedMessages = c.OutboundLimit.MaxQueuedMessages
+	}
+	if c.OutboundLimit.MaxQueuedBytes != 0 {
+		opts.OutboundLimit.MaxQueuedBytes = c.OutboundLimit.MaxQueuedBytes
+	}
+	if c.OutboundLimit.Policy != "" {
+		opts.OutboundLimit.Policy, _ = parseConfigEnum(
+			c.OutboundLimit.Policy,
+			SlowConsumerDropNewest, SlowConsumerDropOldest, SlowConsumerCoalesce, SlowConsumerDisconnect,
+		)
+	}
+
+	if c.Heartbeat.Interval != 0 {
+		opts.Heartbeat.Interval = time.Duration(c.Heartbeat.Interval)
+	}
+	if c.Heartbeat.Timeout != 0 {
+		opts.Heartbeat.Timeout = time.Duration(c.Heartbeat.Timeout)
+	}
+
+	if c.Upgrader.ReadBufferSize != 0 {
+		opts.Upgrader.ReadBufferSize = c.Upgrader.ReadBufferSize
+	}
+	if c.Upgrader.WriteBufferSize != 0 {
+		opts.Upgrader.WriteBufferSize = c.Upgrader.WriteBufferSize
+	}
+	if c.Upgrader.HandshakeTimeout != 0 {
+		opts.Upgrader.HandshakeTimeout = time.Duration(c.Upgrader.HandshakeTimeout)
+	}
+	if c.Upgrader.EnableCompression {
+		opts.Upgrader.EnableCompression = true
+	}
+	if c.Upgrader.Subprotocols != nil {
+		opts.Upgrader.Subprotocols = c.Upgrader.Subprotocols
+	}
+
+	if len(c.AllowedOrigins) > 0 {
+		opts.CheckOrigin = allowOrigins(c.AllowedOrigins)
+	}
+
+	return opts, nil
+}
+
+// Accepts requests without an Origin, as sent by non browser clients, and from the allowed origins.
+func allowOrigins(allowedOrigins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		for _, allowed := range allowedOrigins {
+			if allowed == "*" || strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Creates a MagicSocket from the config, on top of opts. See Config.Apply.
+func NewFromConfig(config Config, opts MagicSocketOpts) (MagicSocket, error) {
+	opts, err := config.Apply(opts)
+	if err != nil {
+		return nil, err
+	}
+	return New(opts), nil
+}
@@ -0,0 +1,132 @@
+package magicsockets_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Config", func() {
+	writeFile := func(name string, content string) string {
+		path := filepath.Join(GinkgoT().TempDir(), name)
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+		return path
+	}
+
+	setEnv := func(name string, value string) {
+		Expect(os.Setenv(name, value)).To(Succeed())
+		DeferCleanup(os.Unsetenv, name)
+	}
+
+	It("Loads YAML files", func() {
+		config, err := magicsockets.LoadConfig(writeFile("config.yaml", `
+port: 9000
+grace_period: 10s
+log:
+  level: debug
+  encoding: json
+key_conflict_policy: replace
+admission_limit:
+  max_connections: 1000
+  retry_after: 30s
+rate_limit:
+  messages_per_second: 20
+  action: close
+heartbeat:
+  interval: 30s
+upgrader:
+  subprotocols: [chat, v2.chat]
+allowed_origins: [https://example.com]
+auth_tokens: [secret]
+`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.Port).To(Equal(9000))
+		Expect(config.GracePeriod).To(Equal(magicsockets.Duration(10 * time.Second)))
+		Expect(config.Log.Encoding).To(Equal("json"))
+		Expect(config.Upgrader.Subprotocols).To(Equal([]string{"chat", "v2.chat"}))
+		Expect(config.AuthTokens).To(Equal([]string{"secret"}))
+
+		opts, err := config.Apply(magicsockets.MagicSocketOpts{Namespace: "chat"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(opts.Port).To(Equal(9000))
+		Expect(opts.Namespace).To(Equal("chat"))
+		Expect(opts.KeyConflictPolicy).To(Equal(magicsockets.KeyConflictReplace))
+		Expect(opts.AdmissionLimit.MaxConnections).To(Equal(1000))
+		Expect(opts.AdmissionLimit.RetryAfter).To(Equal(30 * time.Second))
+		Expect(opts.RateLimit.MessagesPerSecond).To(Equal(20.0))
+		Expect(opts.RateLimit.Action).To(Equal(magicsockets.RateLimitClose))
+		Expect(opts.Heartbeat.Interval).To(Equal(30 * time.Second))
+		Expect(opts.LoggerOpts.LogLevel.String()).To(Equal("debug"))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Origin", "https://example.com")
+		Expect(opts.CheckOrigin(r)).To(BeTrue())
+		r.Header.Set("Origin", "https://evil.com")
+		Expect(opts.CheckOrigin(r)).To(BeFalse())
+	})
+
+	It("Loads JSON files overridden by environment variables", func() {
+		setEnv("MAGICSOCKETS_PORT", "9001")
+		setEnv("MAGICSOCKETS_OUTBOUND_LIMIT_POLICY", "drop_oldest")
+		setEnv("MAGICSOCKETS_UPGRADER_ENABLE_COMPRESSION", "true")
+
+		config, err := magicsockets.LoadConfig(writeFile("config.json", `{
+			"port": 9000,
+			"outbound_limit": {"max_queued_messages": 100, "policy": "disconnect"}
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.Port).To(Equal(9001))
+		Expect(config.OutboundLimit.MaxQueuedMessages).To(Equal(100))
+		Expect(config.OutboundLimit.Policy).To(Equal("drop_oldest"))
+		Expect(config.Upgrader.EnableCompression).To(BeTrue())
+	})
+
+	It("Points at the invalid fields", func() {
+		_, err := magicsockets.LoadConfig(writeFile("config.yaml", `
+port: 70000
+rate_limit:
+  action: explode
+heartbeat:
+  timeout: 5s
+publish:
+  address: 127.0.0.1:9000
+`))
+		var configErrs magicsockets.ConfigErrors
+		Expect(errors.As(err, &configErrs)).To(BeTrue())
+
+		fields := []string{}
+		for _, configErr := range configErrs {
+			fields = append(fields, configErr.Field)
+		}
+		Expect(fields).To(Equal([]string{"port", "rate_limit.action", "heartbeat.timeout", "publish.token"}))
+
+		setEnv("MAGICSOCKETS_HEARTBEAT_INTERVAL", "soon")
+		_, err = magicsockets.LoadConfig("")
+		Expect(err).To(MatchError(ContainSubstring("MAGICSOCKETS_HEARTBEAT_INTERVAL")))
+	})
+
+	It("Rejects unknown fields", func() {
+		_, err := magicsockets.LoadConfig(writeFile("config.yaml", "prot: 8080\n"))
+		Expect(err).To(MatchError(ContainSubstring("prot")))
+
+		_, err = magicsockets.LoadConfig(writeFile("config.json", `{"port": "8080"}`))
+		Expect(err).To(MatchError(ContainSubstring("port")))
+	})
+
+	It("Creates a server from a config", func() {
+		ms, err := magicsockets.NewFromConfig(magicsockets.Config{Port: 9002}, magicsockets.MagicSocketOpts{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ms.GetPort()).To(Equal(9002))
+
+		_, err = magicsockets.NewFromConfig(magicsockets.Config{Log: magicsockets.LogConfig{Level: "loud"}}, magicsockets.MagicSocketOpts{})
+		Expect(err).To(MatchError(ContainSubstring("log.level")))
+	})
+})
@@ -0,0 +1,27 @@
+package magicsockets
+
+import (
+	"context"
+	"time"
+)
+
+// Carries the values of its parent, but is never cancelled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (dc detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (dc detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (dc detachedContext) Err() error {
+	return nil
+}
+
+func (dc detachedContext) Value(key any) any {
+	return dc.parent.Value(key)
+}
@@ -0,0 +1,182 @@
+package magicsockets_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+type contextKey struct{}
+
+var _ = Describe("Context", func() {
+	It("Stops running once the context is done", func() {
+		port := gofakeit.IntRange(10000, 30000)
+		ms := magicsockets.New(magicsockets.MagicSocketOpts{Port: port})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- ms.Run(ctx)
+		}()
+
+		var websocketClientConn *websocket.Conn
+		Eventually(func() error {
+			var err error
+			websocketClientConn, err = newWebsocketClientConn(fmt.Sprintf("127.0.0.1:%d", port))
+			return err
+		}).Should(Succeed())
+		defer websocketClientConn.Close()
+
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+
+		_, _, err := websocketClientConn.ReadMessage()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Stops emitting once the context is done", func() {
+		ms, address := startMagicSocket(magicsockets.MagicSocketOpts{})
+		websocketClientConn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+		defer websocketClientConn.Close()
+		Eventually(ms.GetClients).Should(HaveLen(1))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = ms.EmitContext(ctx, magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{}}}, []byte("cancelled"))
+		Expect(err).To(MatchError(context.Canceled))
+
+		Expect(ms.EmitContext(context.Background(), magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{}}}, []byte("sent"))).To(Succeed())
+		_, message, err := websocketClientConn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal("sent"))
+	})
+
+	It("Writes queued messages and publishes to the broker once the context is done", func() {
+		broker := magicsockets.NewMemoryBroker()
+		ms, address := startMagicSocket(magicsockets.MagicSocketOpts{
+			Broker:        broker,
+			OutboundLimit: magicsockets.OutboundLimit{MaxQueuedMessages: 8},
+		})
+		websocketClientConn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+		defer websocketClientConn.Close()
+		Eventually(ms.GetClients).Should(HaveLen(1))
+
+		other, otherAddress := startMagicSocket(magicsockets.MagicSocketOpts{Broker: broker})
+		defer other.Stop()
+		otherClientConn, err := newWebsocketClientConn(otherAddress)
+		Expect(err).ToNot(HaveOccurred())
+		defer otherClientConn.Close()
+		Eventually(other.GetClients).Should(HaveLen(1))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Expect(ms.EmitContext(ctx, magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{}}}, []byte("queued"))).To(Succeed())
+		cancel()
+
+		_, message, err := websocketClientConn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal("queued"))
+		_, message, err = otherClientConn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal("queued"))
+
+		// Reaches the other instances even though no local client was written to.
+		err = ms.EmitContext(ctx, magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{}}}, []byte("cancelled"))
+		Expect(err).To(MatchError(context.Canceled))
+		_, message, err = otherClientConn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal("cancelled"))
+
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	It("Passes the context of the client to its hooks", func() {
+		values := make(chan any, 1)
+		disconnected := make(chan error, 1)
+
+		ms := magicsockets.New(magicsockets.MagicSocketOpts{
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{
+					Key: gofakeit.UUID(),
+					OnIncomingContext: func(ctx context.Context, client magicsockets.ClientConn, messageType int, data []byte) error {
+						values <- ctx.Value(contextKey{})
+						return nil
+					},
+					OnDisconnectContext: func(ctx context.Context, client magicsockets.ClientConn) error {
+						// Not cancelled yet.
+						disconnected <- ctx.Err()
+						return nil
+					},
+				}, nil
+			},
+		})
+		handler, err := ms.Handler()
+		Expect(err).ToNot(HaveOccurred())
+
+		var client magicsockets.ClientConn
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, "request value")))
+		}))
+		defer server.Close()
+		defer ms.Stop()
+
+		websocketClientConn, err := newWebsocketClientConn(strings.TrimPrefix(server.URL, "http://"))
+		Expect(err).ToNot(HaveOccurred())
+		defer websocketClientConn.Close()
+
+		Eventually(ms.GetClients).Should(HaveLen(1))
+		for _, c := range ms.GetClients() {
+			client = c
+		}
+		// Outlives the handshake request.
+		Consistently(client.Context().Done(), time.Millisecond*50).ShouldNot(BeClosed())
+
+		Expect(websocketClientConn.WriteMessage(websocket.TextMessage, []byte("hello"))).To(Succeed())
+		Eventually(values).Should(Receive(Equal("request value")))
+
+		Expect(client.Close()).To(Succeed())
+		Eventually(disconnected).Should(Receive(BeNil()))
+		Expect(client.Context().Err()).To(MatchError(context.Canceled))
+	})
+
+	It("Calls the ping hook", func() {
+		pings := make(chan struct{}, 1)
+		_, address := startMagicSocket(magicsockets.MagicSocketOpts{
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{
+					Key: gofakeit.UUID(),
+					OnPing: func() error {
+						pings <- struct{}{}
+						return nil
+					},
+				}, nil
+			},
+		})
+		websocketClientConn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+		defer websocketClientConn.Close()
+
+		pongs := make(chan string, 1)
+		websocketClientConn.SetPongHandler(func(appData string) error {
+			pongs <- appData
+			return nil
+		})
+		go websocketClientConn.ReadMessage()
+
+		Expect(websocketClientConn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second))).To(Succeed())
+		Eventually(pings).Should(Receive())
+		Eventually(pongs).Should(Receive(Equal("ping")))
+	})
+})
@@ -1,7 +1,9 @@
 package magicsockets
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -9,17 +11,52 @@ import (
 )
 
 type EmitOpts struct {
-	Rules []EmitRule
+	Rules []EmitRule `json:"rules"`
 }
 
+// Nil fields match every client, while empty ones match none.
 type EmitRule struct {
-	OnlyKeys    []string
-	AnyOfTopics []string
+	OnlyKeys    []string `json:"only_keys"`
+	AnyOfTopics []string `json:"any_of_topics"`
 }
 
+// Sends the message to every client matching the rules.
+// If a Broker is configured, the message is also published to the other instances.
 func (ms *magicSocket) Emit(opts EmitOpts, message []byte) {
-	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
+	if err := ms.EmitContext(context.Background(), opts, message); err != nil {
+		ms.logger.Error("Failed to emit message", zap.Error(err))
+	}
+}
+
+// Like Emit, but stops writing to the remaining clients once ctx is done,
+// and bounds each write by the deadline of ctx.
+// Messages already queued by an outbound limit are still written once ctx is done.
+// The message is published to the broker even if ctx is done before every local client was reached:
+// the error of ctx is returned after publishing it.
+func (ms *magicSocket) EmitContext(ctx context.Context, opts EmitOpts, message []byte) error {
+	localErr := ms.emitLocal(ctx, opts, message)
+
+	if ms.broker != nil {
+		err := ms.broker.Publish(BrokerMessage{
+			Origin:  ms.id,
+			Opts:    opts,
+			Message: message,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to publish message to broker: %w", err)
+		}
+	}
+	return localErr
+}
+
+// Sends the message to the matching clients connected to this instance.
+// Returns the error of ctx if it's done before every client was written to.
+// Doesn't hold the server mutex, so concurrent emits may reach their common clients in different orders.
+func (ms *magicSocket) emitLocal(ctx context.Context, opts EmitOpts, message []byte) error {
+	start := time.Now()
+
+	ctx, span := ms.tracing.start(ctx, _SPAN_EMIT, _ATTRIBUTE_NAMESPACE.String(ms.namespace))
+	defer span.End()
 
 	ms.logger.Debug(
 		"Starting emit message processing",
@@ -28,10 +65,24 @@ func (ms *magicSocket) Emit(opts EmitOpts, message []byte) {
 	)
 
 	targets := make(map[string]*client)
+	// Topics of each target matched by the rules, nil if a rule matched it regardless of its topics.
+	targetTopics := make(map[string][]string)
+
+	// Read once, so every rule sees the same key and topics of each client.
+	clients := ms.clients.all()
+	keys := make([]string, len(clients))
+	clientTopics := make([][]string, len(clients))
+	for i, client := range clients {
+		client.stateMutex.RLock()
+		keys[i] = client.key
+		clientTopics[i] = client.topics
+		client.stateMutex.RUnlock()
+	}
 
 	for _, rule := range opts.Rules {
-		for clientID, client := range ms.clients {
-			matchesKeys := rule.OnlyKeys == nil || contains(rule.OnlyKeys, client.key)
+		for i, client := range clients {
+			clientID := client.id
+			matchesKeys := rule.OnlyKeys == nil || contains(rule.OnlyKeys, keys[i])
 
 			// Auto approve if it's nil.
 			matchesTopics := rule.AnyOfTopics == nil
@@ -39,7 +90,7 @@ func (ms *magicSocket) Emit(opts EmitOpts, message []byte) {
 			if !matchesTopics {
 				match := false
 				for _, query := range rule.AnyOfTopics {
-					match = contains(client.topics, query)
+					match = contains(clientTopics[i], query)
 					if match {
 						break
 					}
@@ -49,6 +100,17 @@ func (ms *magicSocket) Emit(opts EmitOpts, message []byte) {
 			}
 
 			if matchesKeys && matchesTopics {
+				topics, matched := targetTopics[clientID]
+				if rule.AnyOfTopics == nil {
+					targetTopics[clientID] = nil
+				} else if !matched || topics != nil {
+					for _, query := range rule.AnyOfTopics {
+						if contains(clientTopics[i], query) && !contains(topics, query) {
+							topics = append(topics, query)
+						}
+					}
+					targetTopics[clientID] = topics
+				}
 				targets[clientID] = client
 			}
 		}
@@ -59,27 +121,85 @@ func (ms *magicSocket) Emit(opts EmitOpts, message []byte) {
 		zap.String("Targets", fmt.Sprintf("%v", targets)),
 	)
 
+	span.SetAttributes(_ATTRIBUTE_FAN_OUT.Int(len(targets)))
+	payload := ms.tracing.wrap(ctx, message)
+	messageType := websocket.TextMessage
+
+	// Framed once, and once per compression setting, for every client the message is emitted to.
+	// Skipped when no target would write it, since clients of a protocol frame messages themselves.
+	var prepared *websocket.PreparedMessage
+	if needsPreparedMessage(targets) {
+		var prepareErr error
+		prepared, prepareErr = websocket.NewPreparedMessage(messageType, payload)
+		if prepareErr != nil {
+			ms.logger.Warn("Failed to prepare message, framing it for each client", zap.Error(prepareErr))
+			prepared = nil
+		}
+	}
+
+	var err error
+	slowConsumers := []*client{}
 	for _, client := range targets {
-		messageType := websocket.TextMessage
+		if err = ctx.Err(); err != nil {
+			ms.logger.Warn("Emit interrupted before writing to every client", zap.Error(err))
+			break
+		}
 
 		logger := client.logger.With(
-			zap.String("Client Key", client.key),
+			zap.String("Client Key", client.GetKey()),
 			zap.String("Message ID", uuid.New().String()),
 			zap.Int("Message Type", messageType),
 		)
 
 		logger.Info("Emitting message")
 
-		err := client.WriteMessage(messageType, message)
-		if err != nil {
-			logger.Error("Send message to client error", zap.Error(err))
-			return
+		exceeded := client.send(withEmittedTopics(ctx, targetTopics[client.id]), logger, messageType, payload, prepared)
+		if exceeded {
+			slowConsumers = append(slowConsumers, client)
 		}
-		if client.onOutgoing != nil {
-			if err := client.onOutgoing(messageType, message); err != nil {
-				logger.Error("onOutgoing error", zap.Error(err))
-				return
-			}
+	}
+
+	ms.metrics.emitted(ms.namespace, time.Since(start), len(targets))
+
+	if ms.onSlowConsumer != nil {
+		for _, client := range slowConsumers {
+			ms.onSlowConsumer(client, client.outbound.limit.Policy)
+		}
+	}
+	if ms.hooks.onEmit != nil {
+		targetConns := make([]ClientConn, 0, len(targets))
+		for _, client := range targets {
+			targetConns = append(targetConns, client)
 		}
+		ms.hooks.onEmit(opts, message, targetConns)
 	}
+
+	return err
+}
+
+// Whether any of the targets writes messages as they are, see client.writePrepared.
+func needsPreparedMessage(targets map[string]*client) bool {
+	for _, client := range targets {
+		if client.protocol == nil {
+			return true
+		}
+	}
+	return false
+}
+
+type emittedTopicsKey struct{}
+
+// Carries the topics through which a client was matched by an emit, see emittedTopics.
+func withEmittedTopics(ctx context.Context, topics []string) context.Context {
+	if topics == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, emittedTopicsKey{}, topics)
+}
+
+// Topics through which the client being written to was matched by the emit.
+// Nil when the message wasn't emitted to topics, e.g. written with WriteMessage.
+func emittedTopics(ctx context.Context) []string {
+	topics, _ := ctx.Value(emittedTopicsKey{}).([]string)
+	return topics
 }
@@ -0,0 +1,133 @@
+package magicsockets_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+const (
+	// Clients every message is emitted to.
+	_BENCHMARK_FAN_OUT = 1000
+)
+
+func BenchmarkEmit(b *testing.B) {
+	message := []byte(strings.Repeat("compressible ", 100))
+	everyone := magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{}}}
+
+	b.Run("Without compression", func(b *testing.B) {
+		ms, url := startBenchmarkServer(b, false)
+		dialBenchmarkClients(b, ms, url, websocket.Dialer{}, nil)
+		benchmarkEmit(b, ms, everyone, message)
+	})
+
+	b.Run("With compression", func(b *testing.B) {
+		ms, url := startBenchmarkServer(b, true)
+		dialBenchmarkClients(b, ms, url, websocket.Dialer{EnableCompression: true}, nil)
+		benchmarkEmit(b, ms, everyone, message)
+	})
+
+	b.Run("Without targets", func(b *testing.B) {
+		ms, url := startBenchmarkServer(b, false)
+		dialBenchmarkClients(b, ms, url, websocket.Dialer{}, nil)
+		benchmarkEmit(b, ms, magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{OnlyKeys: []string{}}}}, message)
+	})
+
+	b.Run("Only Socket.IO clients", func(b *testing.B) {
+		ms := magicsockets.New(magicsockets.MagicSocketOpts{
+			LoggerOpts: magicsockets.LoggerOpts{Logger: zap.NewNop()},
+		})
+		handler, err := ms.SocketIOHandler(magicsockets.SocketIOOpts{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		httpServer := httptest.NewServer(handler)
+		b.Cleanup(func() {
+			ms.Stop()
+			httpServer.Close()
+		})
+
+		url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/?EIO=4&transport=websocket"
+		dialBenchmarkClients(b, ms, url, websocket.Dialer{}, func(conn *websocket.Conn) error {
+			// Open packet, then the connection to the main namespace.
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return err
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, []byte("40")); err != nil {
+				return err
+			}
+			_, _, err := conn.ReadMessage()
+			return err
+		})
+		benchmarkEmit(b, ms, everyone, message)
+	})
+}
+
+func benchmarkEmit(b *testing.B, ms magicsockets.MagicSocket, opts magicsockets.EmitOpts, message []byte) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ms.Emit(opts, message)
+	}
+}
+
+func startBenchmarkServer(b *testing.B, compression bool) (magicsockets.MagicSocket, string) {
+	ms := magicsockets.New(magicsockets.MagicSocketOpts{
+		Upgrader:   magicsockets.UpgraderOpts{EnableCompression: compression},
+		LoggerOpts: magicsockets.LoggerOpts{Logger: zap.NewNop()},
+		OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{Key: r.URL.Query().Get("key")}, nil
+		},
+	})
+	handler, err := ms.Handler()
+	if err != nil {
+		b.Fatal(err)
+	}
+	httpServer := httptest.NewServer(handler)
+	b.Cleanup(func() {
+		ms.Stop()
+		httpServer.Close()
+	})
+	return ms, "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/?"
+}
+
+// Connects _BENCHMARK_FAN_OUT clients, each performing handshake if it's not nil,
+// then discards what they're sent until the benchmark ends.
+func dialBenchmarkClients(b *testing.B, ms magicsockets.MagicSocket, url string, dialer websocket.Dialer, handshake func(conn *websocket.Conn) error) {
+	for i := 0; i < _BENCHMARK_FAN_OUT; i++ {
+		conn, _, err := dialer.Dial(url+"&key="+strconv.Itoa(i), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { conn.Close() })
+
+		if handshake != nil {
+			if err := handshake(conn); err != nil {
+				b.Fatal(err)
+			}
+		}
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(ms.GetClients()) < _BENCHMARK_FAN_OUT {
+		if time.Now().After(deadline) {
+			b.Fatalf("only %d of %d clients connected", len(ms.GetClients()), _BENCHMARK_FAN_OUT)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,204 @@
+package magicsockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidEvent = errors.New("invalid event")
+)
+
+// Envelope of the messages routed by event name.
+type Event struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Encodes data into the envelope of an event, so it can be emitted to clients.
+func EncodeEvent(event string, data any) ([]byte, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode data of event %q: %w", event, err)
+	}
+	return json.Marshal(Event{Event: event, Data: raw})
+}
+
+func decodeEvent(message []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(message, &event); err != nil {
+		return Event{}, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+	}
+	if event.Event == "" {
+		return Event{}, fmt.Errorf("%w: missing event name", ErrInvalidEvent)
+	}
+	return event, nil
+}
+
+// Event received from a client, passed to the handlers of an EventRouter.
+type EventContext struct {
+	Client ClientConn
+	Event  string
+	Data   json.RawMessage
+
+	ctx    context.Context
+	server *magicSocket
+}
+
+// Context of the client, see ClientConn.Context.
+func (ec *EventContext) Context() context.Context {
+	return ec.ctx
+}
+
+// Decodes the data of the event into v.
+func (ec *EventContext) Bind(v any) error {
+	if err := json.Unmarshal(ec.Data, v); err != nil {
+		return fmt.Errorf("failed to decode data of event %q: %w", ec.Event, err)
+	}
+	return nil
+}
+
+// Sends an event back to the client that sent this one.
+func (ec *EventContext) Reply(event string, data any) error {
+	message, err := EncodeEvent(event, data)
+	if err != nil {
+		return err
+	}
+	return ec.Client.WriteMessage(websocket.TextMessage, message)
+}
+
+// Emits an event to every client matching the rules, see MagicSocket.EmitContext.
+// Keeps the values of the context, e.g. its span, but isn't cut short when the sender disconnects.
+func (ec *EventContext) Emit(opts EmitOpts, event string, data any) error {
+	message, err := EncodeEvent(event, data)
+	if err != nil {
+		return err
+	}
+	return ec.server.EmitContext(detachedContext{parent: ec.ctx}, opts, message)
+}
+
+type EventHandler func(ec *EventContext) error
+
+// Wraps a handler, e.g. to authorize or validate events before they're handled.
+type EventMiddleware func(next EventHandler) EventHandler
+
+// Routes incoming messages to handlers by the name of their event.
+// Set through MagicSocketOpts.Events to apply to every client, or RegisterClientOpts.Events for a single one.
+// Messages must be JSON encoded Events.
+type EventRouter struct {
+	mutex *sync.RWMutex
+
+	handlers   map[string]EventHandler
+	middleware []EventMiddleware
+	onUnknown  EventHandler
+}
+
+func NewEventRouter() *EventRouter {
+	return &EventRouter{
+		mutex:    &sync.RWMutex{},
+		handlers: make(map[string]EventHandler),
+	}
+}
+
+// Registers the handler of an event, wrapped by the given middleware, replacing any previous one.
+// The middleware registered with Use wraps the given one.
+func (er *EventRouter) On(event string, handler EventHandler, middleware ...EventMiddleware) {
+	er.mutex.Lock()
+	defer er.mutex.Unlock()
+
+	er.handlers[event] = chainEventMiddleware(handler, middleware)
+}
+
+// Registers middleware wrapping every handler of the router, including the one for unknown events.
+func (er *EventRouter) Use(middleware ...EventMiddleware) {
+	er.mutex.Lock()
+	defer er.mutex.Unlock()
+
+	er.middleware = append(er.middleware, middleware...)
+}
+
+// Registers the handler of events without a handler of their own.
+func (er *EventRouter) OnUnknown(handler EventHandler) {
+	er.mutex.Lock()
+	defer er.mutex.Unlock()
+
+	er.onUnknown = handler
+}
+
+// The handler of the event wrapped by the middleware of the router, or nil if there's none.
+func (er *EventRouter) handler(event string) EventHandler {
+	er.mutex.RLock()
+	defer er.mutex.RUnlock()
+
+	handler, ok := er.handlers[event]
+	if !ok {
+		return nil
+	}
+	return chainEventMiddleware(handler, er.middleware)
+}
+
+func (er *EventRouter) unknownHandler() EventHandler {
+	er.mutex.RLock()
+	defer er.mutex.RUnlock()
+
+	if er.onUnknown == nil {
+		return nil
+	}
+	return chainEventMiddleware(er.onUnknown, er.middleware)
+}
+
+// The first middleware is the outermost one.
+func chainEventMiddleware(handler EventHandler, middleware []EventMiddleware) EventHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Routes an incoming message to its handler, preferring those of the client router over those of the server one.
+// Unknown events go to the unknown handler of the client router, then to the one of the server router.
+func (ms *magicSocket) routeEvent(ctx context.Context, cc *client, message []byte) error {
+	event, err := decodeEvent(message)
+	if err != nil {
+		return err
+	}
+
+	routers := []*EventRouter{}
+	for _, router := range []*EventRouter{cc.events, ms.events} {
+		if router != nil {
+			routers = append(routers, router)
+		}
+	}
+
+	var handler EventHandler
+	for _, router := range routers {
+		if handler = router.handler(event.Event); handler != nil {
+			break
+		}
+	}
+	if handler == nil {
+		for _, router := range routers {
+			if handler = router.unknownHandler(); handler != nil {
+				break
+			}
+		}
+	}
+	if handler == nil {
+		cc.logger.Debug("No handler for event, ignoring", zap.String("Event", event.Event))
+		return nil
+	}
+
+	return handler(&EventContext{
+		Client: cc,
+		Event:  event.Event,
+		Data:   event.Data,
+		ctx:    ctx,
+		server: ms,
+	})
+}
@@ -0,0 +1,210 @@
+package magicsockets_test
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Events", func() {
+	var (
+		ms      magicsockets.MagicSocket
+		address string
+
+		serverEvents *magicsockets.EventRouter
+		clientEvents *magicsockets.EventRouter
+	)
+
+	type greeting struct {
+		Name string `json:"name"`
+	}
+
+	BeforeEach(func() {
+		serverEvents = magicsockets.NewEventRouter()
+		clientEvents = magicsockets.NewEventRouter()
+
+		ms, address = startMagicSocket(magicsockets.MagicSocketOpts{
+			Events: serverEvents,
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				opts := magicsockets.RegisterClientOpts{Key: r.URL.Query().Get("key")}
+				if opts.Key == "routed" {
+					opts.Events = clientEvents
+				}
+				return opts, nil
+			},
+		})
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	connect := func(key string) *websocket.Conn {
+		websocketClientConn, _, err := websocket.DefaultDialer.Dial("ws://"+address+"/?key="+key, nil)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(websocketClientConn.Close)
+		return websocketClientConn
+	}
+
+	send := func(websocketClientConn *websocket.Conn, event string, data any) {
+		message, err := magicsockets.EncodeEvent(event, data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(websocketClientConn.WriteMessage(websocket.TextMessage, message)).To(Succeed())
+	}
+
+	receive := func(websocketClientConn *websocket.Conn) magicsockets.Event {
+		var event magicsockets.Event
+		Expect(websocketClientConn.ReadJSON(&event)).To(Succeed())
+		return event
+	}
+
+	It("Routes events to their handler, which can reply", func() {
+		serverEvents.On("greet", func(ec *magicsockets.EventContext) error {
+			var data greeting
+			if err := ec.Bind(&data); err != nil {
+				return err
+			}
+			return ec.Reply("greeted", "Hello, "+data.Name)
+		})
+
+		websocketClientConn := connect("other")
+		send(websocketClientConn, "greet", greeting{Name: "world"})
+
+		event := receive(websocketClientConn)
+		Expect(event.Event).To(Equal("greeted"))
+		Expect(string(event.Data)).To(Equal(`"Hello, world"`))
+	})
+
+	It("Emits events from handlers", func() {
+		serverEvents.On("broadcast", func(ec *magicsockets.EventContext) error {
+			return ec.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{OnlyKeys: []string{"listener"}}}}, "broadcasted", ec.Client.GetKey())
+		})
+
+		listener := connect("listener")
+		Eventually(func() []magicsockets.ClientConn { return ms.GetClientsByKey("listener") }).Should(HaveLen(1))
+		send(connect("other"), "broadcast", nil)
+
+		event := receive(listener)
+		Expect(event.Event).To(Equal("broadcasted"))
+		Expect(string(event.Data)).To(Equal(`"other"`))
+	})
+
+	It("Emits events from handlers once the sender disconnected", func() {
+		// Handlers may keep emitting in the background, e.g. once a long task is done.
+		contexts := make(chan *magicsockets.EventContext, 1)
+		serverEvents.On("last words", func(ec *magicsockets.EventContext) error {
+			contexts <- ec
+			return nil
+		})
+
+		listener := connect("listener")
+		Eventually(func() []magicsockets.ClientConn { return ms.GetClientsByKey("listener") }).Should(HaveLen(1))
+		sender := connect("other")
+		send(sender, "last words", nil)
+
+		var ec *magicsockets.EventContext
+		Eventually(contexts).Should(Receive(&ec))
+		Expect(ec.Client.Close()).To(Succeed())
+		Expect(ec.Context().Done()).To(BeClosed())
+
+		Expect(ec.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{OnlyKeys: []string{"listener"}}}}, "farewell", nil)).To(Succeed())
+		Expect(receive(listener).Event).To(Equal("farewell"))
+	})
+
+	It("Prefers the handlers of the client, falling back to those of the server", func() {
+		serverEvents.On("shared", func(ec *magicsockets.EventContext) error {
+			return ec.Reply("server", nil)
+		})
+		serverEvents.On("server only", func(ec *magicsockets.EventContext) error {
+			return ec.Reply("server", nil)
+		})
+		clientEvents.On("shared", func(ec *magicsockets.EventContext) error {
+			return ec.Reply("client", nil)
+		})
+
+		websocketClientConn := connect("routed")
+		send(websocketClientConn, "shared", nil)
+		Expect(receive(websocketClientConn).Event).To(Equal("client"))
+		send(websocketClientConn, "server only", nil)
+		Expect(receive(websocketClientConn).Event).To(Equal("server"))
+
+		otherWebsocketClientConn := connect("other")
+		send(otherWebsocketClientConn, "shared", nil)
+		Expect(receive(otherWebsocketClientConn).Event).To(Equal("server"))
+	})
+
+	It("Passes events without handlers to the unknown handler", func() {
+		serverEvents.OnUnknown(func(ec *magicsockets.EventContext) error {
+			return ec.Reply("unknown", ec.Event)
+		})
+
+		websocketClientConn := connect("other")
+		send(websocketClientConn, "missing", nil)
+
+		event := receive(websocketClientConn)
+		Expect(event.Event).To(Equal("unknown"))
+		Expect(string(event.Data)).To(Equal(`"missing"`))
+	})
+
+	It("Wraps handlers with the middleware of the router, then the one of the event", func() {
+		trace := func(name string) magicsockets.EventMiddleware {
+			return func(next magicsockets.EventHandler) magicsockets.EventHandler {
+				return func(ec *magicsockets.EventContext) error {
+					if err := ec.Reply(name, nil); err != nil {
+						return err
+					}
+					return next(ec)
+				}
+			}
+		}
+		authorize := func(next magicsockets.EventHandler) magicsockets.EventHandler {
+			return func(ec *magicsockets.EventContext) error {
+				var data greeting
+				if err := ec.Bind(&data); err != nil {
+					return err
+				}
+				if data.Name != "admin" {
+					return errors.New("unauthorized")
+				}
+				return next(ec)
+			}
+		}
+
+		serverEvents.Use(trace("router"))
+		serverEvents.On("restricted", func(ec *magicsockets.EventContext) error {
+			return ec.Reply("handled", nil)
+		}, trace("event"), authorize)
+
+		websocketClientConn := connect("other")
+		send(websocketClientConn, "restricted", greeting{Name: "someone"})
+		send(websocketClientConn, "restricted", greeting{Name: "admin"})
+
+		received := []string{}
+		for i := 0; i < 5; i++ {
+			received = append(received, receive(websocketClientConn).Event)
+		}
+		Expect(received).To(Equal([]string{"router", "event", "router", "event", "handled"}))
+	})
+
+	It("Ignores messages that aren't events", func() {
+		serverEvents.OnUnknown(func(ec *magicsockets.EventContext) error {
+			return ec.Reply("unknown", nil)
+		})
+		serverEvents.On("ping", func(ec *magicsockets.EventContext) error {
+			return ec.Reply("pong", nil)
+		})
+
+		websocketClientConn := connect("other")
+		Expect(websocketClientConn.WriteMessage(websocket.TextMessage, []byte("not json"))).To(Succeed())
+		Expect(websocketClientConn.WriteMessage(websocket.TextMessage, []byte(`{"data": 1}`))).To(Succeed())
+		send(websocketClientConn, "ping", nil)
+
+		Expect(receive(websocketClientConn).Event).To(Equal("pong"))
+	})
+})
@@ -0,0 +1,536 @@
+package magicsockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	_GRAPHQL_SUBPROTOCOL = "graphql-transport-ws"
+
+	_DEFAULT_GRAPHQL_INIT_TIMEOUT = 3 * time.Second
+)
+
+// graphql-transport-ws message types.
+const (
+	_GRAPHQL_CONNECTION_INIT = "connection_init"
+	_GRAPHQL_CONNECTION_ACK  = "connection_ack"
+	_GRAPHQL_PING            = "ping"
+	_GRAPHQL_PONG            = "pong"
+	_GRAPHQL_SUBSCRIBE       = "subscribe"
+	_GRAPHQL_NEXT            = "next"
+	_GRAPHQL_ERROR           = "error"
+	_GRAPHQL_COMPLETE        = "complete"
+)
+
+// graphql-transport-ws close codes.
+const (
+	_GRAPHQL_BAD_REQUEST       = 4400
+	_GRAPHQL_UNAUTHORIZED      = 4401
+	_GRAPHQL_FORBIDDEN         = 4403
+	_GRAPHQL_INIT_TIMEOUT      = 4408
+	_GRAPHQL_SUBSCRIBER_EXISTS = 4409
+	_GRAPHQL_TOO_MANY_INITS    = 4429
+
+	_GRAPHQL_INVALID_MESSAGE = "Invalid message received"
+)
+
+// Longest reason a close frame can hold.
+const _MAX_CLOSE_REASON_SIZE = 123
+
+var (
+	ErrInvalidGraphQLMessage = errors.New("invalid graphql-transport-ws message")
+)
+
+// Serves GraphQL operations over the graphql-transport-ws protocol, negotiating its subprotocol.
+//
+// Clients are registered once they send their connection_init message, so its payload, e.g. holding an auth token,
+// can decide their key and topics. Each operation is fed the messages emitted to its topics, see GraphQLResolver.
+type GraphQLOpts struct {
+	// Registers clients from the payload of their connection_init message, nil if there's none,
+	// like the OnConnect of the server does from the handshake request. The OnConnect of the server is used when nil.
+	// Returning an error closes the connection with 4403 Forbidden.
+	OnInit func(r *http.Request, payload json.RawMessage) (RegisterClientOpts, error)
+	// Required.
+	Resolver GraphQLResolver
+
+	// How long clients have to send connection_init. Defaults to _DEFAULT_GRAPHQL_INIT_TIMEOUT.
+	InitTimeout time.Duration
+}
+
+// Resolves the operations of GraphQL clients.
+type GraphQLResolver interface {
+	// Called for each subscribe message, returning the topics feeding the operation, which are added to the topics of the client.
+	// Operations without topics, e.g. queries, can send their result with Next and Complete right away.
+	// Returning an error sends it to the client as an error message, ending the operation.
+	Subscribe(op *GraphQLOperation) (topics []string, err error)
+	// Called for each message emitted to one of the topics of the operation, returning the result to send as a next message,
+	// or nil to skip the message. topic is empty for messages not emitted to topics, e.g. written with WriteMessage,
+	// which are passed to every operation of the client.
+	// Returning an error sends it to the client as an error message, ending the operation.
+	// Called by the goroutine writing the message, e.g. the one calling Emit, without holding the server mutex,
+	// so it may call back into the server. Messages of concurrent emits may be resolved concurrently.
+	Resolve(op *GraphQLOperation, topic string, message []byte) (*GraphQLResult, error)
+}
+
+type GraphQLResult struct {
+	Data       json.RawMessage `json:"data,omitempty"`
+	Errors     []GraphQLError  `json:"errors,omitempty"`
+	Extensions map[string]any  `json:"extensions,omitempty"`
+}
+
+// Sent as is to the client when returned by the resolver, while other errors are sent as their message.
+type GraphQLError struct {
+	Message    string         `json:"message"`
+	Path       []any          `json:"path,omitempty"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// Operation subscribed to by a client.
+type GraphQLOperation struct {
+	// Chosen by the client, unique among its operations.
+	ID            string
+	OperationName string
+	Query         string
+	Variables     map[string]json.RawMessage
+	Extensions    map[string]json.RawMessage
+	Client        ClientConn
+	// Payload of the connection_init message of the client, nil if there's none.
+	InitPayload json.RawMessage
+
+	// Cancelled once the operation is over.
+	ctx    context.Context
+	cancel context.CancelFunc
+	topics []string
+	gql    *graphQLClient
+}
+
+// Protocol of a graphql-transport-ws client.
+type graphQLClient struct {
+	cc          *client
+	opts        GraphQLOpts
+	initPayload json.RawMessage
+
+	// Guards operations. Never held while calling out of the client.
+	mutex      *sync.Mutex
+	operations map[string]*GraphQLOperation
+	// Guards updating the topics of the client when operations start and end.
+	topicsMutex *sync.Mutex
+}
+
+type graphQLMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type graphQLSubscribePayload struct {
+	OperationName string                     `json:"operationName"`
+	Query         string                     `json:"query"`
+	Variables     map[string]json.RawMessage `json:"variables"`
+	Extensions    map[string]json.RawMessage `json:"extensions"`
+}
+
+func (e GraphQLError) Error() string {
+	return e.Message
+}
+
+// Cancelled once the operation is completed, by the client or the server, or the client is disconnected.
+func (op *GraphQLOperation) Context() context.Context {
+	return op.ctx
+}
+
+// Topics feeding the operation, as returned by GraphQLResolver.Subscribe.
+func (op *GraphQLOperation) Topics() []string {
+	return op.topics
+}
+
+// Sends a result of the operation to the client.
+func (op *GraphQLOperation) Next(result *GraphQLResult) error {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to encode result of operation %q: %w", op.ID, err)
+	}
+	return op.gql.cc.writeFrames(context.Background(), graphQLFrame(_GRAPHQL_NEXT, op.ID, payload))
+}
+
+// Ends the operation, telling the client no more results will be sent.
+// No-op if it's already over.
+func (op *GraphQLOperation) Complete() error {
+	if !op.gql.removeOperation(op) {
+		return nil
+	}
+	op.gql.releaseTopics(op)
+	return op.gql.cc.writeFrames(context.Background(), graphQLFrame(_GRAPHQL_COMPLETE, op.ID, nil))
+}
+
+// Returns an http.Handler serving graphql-transport-ws clients.
+// Clients must ask for the "graphql-transport-ws" subprotocol.
+func (ms *magicSocket) GraphQLHandler(opts GraphQLOpts) (http.Handler, error) {
+	if opts.Resolver == nil {
+		return nil, errors.New("GraphQLOpts.Resolver is required")
+	}
+	if err := ms.subscribeBroker(); err != nil {
+		return nil, err
+	}
+
+	if opts.InitTimeout == 0 {
+		opts.InitTimeout = _DEFAULT_GRAPHQL_INIT_TIMEOUT
+	}
+
+	upgrade := ms.subprotocolUpgrade(_GRAPHQL_SUBPROTOCOL)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !contains(websocket.Subprotocols(r), _GRAPHQL_SUBPROTOCOL) {
+			http.Error(w, fmt.Sprintf("the %s subprotocol is required", _GRAPHQL_SUBPROTOCOL), http.StatusBadRequest)
+			return
+		}
+
+		var (
+			upgrading   bool
+			conn        ControlConn
+			initPayload json.RawMessage
+			// Sent to the client if it isn't handed over.
+			closeCode = _GRAPHQL_FORBIDDEN
+			// Once the connection is handed over to registerClient, it's closed there if it's refused.
+			handedOver bool
+		)
+
+		// Clients are registered once they send connection_init, so the connection is upgraded first.
+		onInit := func(r *http.Request) (RegisterClientOpts, error) {
+			upgrading = true
+			upgraded, err := upgrade(w, r)
+			if err != nil {
+				return RegisterClientOpts{}, err
+			}
+			var ok bool
+			if conn, ok = upgraded.(ControlConn); !ok {
+				upgraded.Close()
+				return RegisterClientOpts{}, errors.New("GraphQL clients require a websocket connection")
+			}
+
+			initPayload, closeCode, err = readGraphQLInit(conn, opts.InitTimeout)
+			if err != nil {
+				return RegisterClientOpts{}, err
+			}
+
+			closeCode = _GRAPHQL_FORBIDDEN
+			if opts.OnInit != nil {
+				return opts.OnInit(r, initPayload)
+			}
+			if ms.onConnect != nil {
+				return ms.onConnect(r)
+			}
+			return RegisterClientOpts{Key: uuid.NewString()}, nil
+		}
+
+		// The response was already written by the upgrade, unless the handshake was refused before it.
+		recorded := newRecordedResponse()
+		ms.handshakeWith(recorded, withUpgraded(r), onInit, func(w http.ResponseWriter, r *http.Request) (Conn, error) {
+			handedOver = true
+			return conn, nil
+		}, func(cc *client) clientProtocol {
+			return &graphQLClient{
+				cc:          cc,
+				opts:        opts,
+				initPayload: initPayload,
+				mutex:       &sync.Mutex{},
+				operations:  make(map[string]*GraphQLOperation),
+				topicsMutex: &sync.Mutex{},
+			}
+		})
+
+		if !upgrading {
+			recorded.writeTo(w)
+		}
+		if conn != nil && !handedOver {
+			closeConn(conn, closeCode, strings.TrimSpace(recorded.body.String()))
+		}
+	}), nil
+}
+
+// Waits for the connection_init message of the client, returning its payload,
+// or the code to close the connection with.
+func readGraphQLInit(conn ControlConn, timeout time.Duration) (json.RawMessage, int, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		if isHeartbeatTimeout(err) {
+			return nil, _GRAPHQL_INIT_TIMEOUT, errors.New("Connection initialisation timeout")
+		}
+		return nil, websocket.CloseAbnormalClosure, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var message graphQLMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, _GRAPHQL_BAD_REQUEST, errors.New(_GRAPHQL_INVALID_MESSAGE)
+	}
+	switch message.Type {
+	case _GRAPHQL_CONNECTION_INIT:
+		return message.Payload, 0, nil
+	case _GRAPHQL_SUBSCRIBE:
+		return nil, _GRAPHQL_UNAUTHORIZED, errors.New("Unauthorized")
+	}
+	return nil, _GRAPHQL_BAD_REQUEST, errors.New(_GRAPHQL_INVALID_MESSAGE)
+}
+
+// Sends a close frame, before closing a connection that was never registered.
+func closeConn(conn ControlConn, code int, text string) {
+	if len(text) > _MAX_CLOSE_REASON_SIZE {
+		text = text[:_MAX_CLOSE_REASON_SIZE]
+	}
+	message := websocket.FormatCloseMessage(code, text)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	conn.Close()
+}
+
+// Acknowledges the connection_init message of the client.
+func (gql *graphQLClient) start(conn ControlConn) error {
+	return gql.cc.writeFrames(context.Background(), graphQLFrame(_GRAPHQL_CONNECTION_ACK, "", nil))
+}
+
+// Resolves the message for each operation it's for.
+func (gql *graphQLClient) encode(ctx context.Context, messageType int, data []byte) ([]frame, error) {
+	topics := emittedTopics(ctx)
+
+	gql.mutex.Lock()
+	operations := make([]*GraphQLOperation, 0, len(gql.operations))
+	for _, op := range gql.operations {
+		operations = append(operations, op)
+	}
+	gql.mutex.Unlock()
+
+	frames := []frame{}
+	for _, op := range operations {
+		topic := ""
+		if topics != nil {
+			for _, opTopic := range op.topics {
+				if contains(topics, opTopic) {
+					topic = opTopic
+					break
+				}
+			}
+			if topic == "" {
+				continue
+			}
+		}
+
+		result, err := gql.opts.Resolver.Resolve(op, topic, data)
+		if err != nil {
+			if gql.removeOperation(op) {
+				// The server mutex may be held, while releasing topics updates the client.
+				go gql.releaseTopics(op)
+				frames = append(frames, graphQLErrorFrame(op.ID, err))
+			}
+			continue
+		}
+		if result == nil {
+			continue
+		}
+
+		payload, err := json.Marshal(result)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode result of operation %q: %w", op.ID, err)
+		}
+		frames = append(frames, graphQLFrame(_GRAPHQL_NEXT, op.ID, payload))
+	}
+	return frames, nil
+}
+
+func (gql *graphQLClient) decode(messageType int, data []byte) (*frame, error) {
+	var message graphQLMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, gql.fail(_GRAPHQL_BAD_REQUEST, _GRAPHQL_INVALID_MESSAGE)
+	}
+
+	switch message.Type {
+	case _GRAPHQL_PING:
+		return nil, gql.cc.writeFrames(context.Background(), graphQLFrame(_GRAPHQL_PONG, "", message.Payload))
+	case _GRAPHQL_PONG:
+		return nil, nil
+	case _GRAPHQL_CONNECTION_INIT:
+		return nil, gql.fail(_GRAPHQL_TOO_MANY_INITS, "Too many initialisation requests")
+	case _GRAPHQL_SUBSCRIBE:
+		return nil, gql.subscribe(message)
+	case _GRAPHQL_COMPLETE:
+		gql.mutex.Lock()
+		op := gql.operations[message.ID]
+		gql.mutex.Unlock()
+		if op != nil && gql.removeOperation(op) {
+			gql.releaseTopics(op)
+		}
+		return nil, nil
+	}
+	return nil, gql.fail(_GRAPHQL_BAD_REQUEST, _GRAPHQL_INVALID_MESSAGE)
+}
+
+func (gql *graphQLClient) keepAlive(messageType int, data []byte) bool {
+	var message graphQLMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return false
+	}
+	return message.Type == _GRAPHQL_PING || message.Type == _GRAPHQL_PONG
+}
+
+// The deadline of connection_init is cleared before the client is registered, see readGraphQLInit.
+func (gql *graphQLClient) ownsLiveness() bool {
+	return false
+}
+
+func (gql *graphQLClient) subscribe(message graphQLMessage) error {
+	var payload graphQLSubscribePayload
+	if err := json.Unmarshal(message.Payload, &payload); err != nil || message.ID == "" || payload.Query == "" {
+		return gql.fail(_GRAPHQL_BAD_REQUEST, _GRAPHQL_INVALID_MESSAGE)
+	}
+
+	gql.mutex.Lock()
+	_, exists := gql.operations[message.ID]
+	gql.mutex.Unlock()
+	if exists {
+		return gql.fail(_GRAPHQL_SUBSCRIBER_EXISTS, fmt.Sprintf("Subscriber for %s already exists", message.ID))
+	}
+
+	ctx, cancel := context.WithCancel(gql.cc.ctx)
+	op := &GraphQLOperation{
+		ID:            message.ID,
+		OperationName: payload.OperationName,
+		Query:         payload.Query,
+		Variables:     payload.Variables,
+		Extensions:    payload.Extensions,
+		Client:        gql.cc,
+		InitPayload:   gql.initPayload,
+		ctx:           ctx,
+		cancel:        cancel,
+		gql:           gql,
+	}
+
+	gql.mutex.Lock()
+	gql.operations[op.ID] = op
+	gql.mutex.Unlock()
+
+	topics, err := gql.opts.Resolver.Subscribe(op)
+	if err != nil {
+		if !gql.removeOperation(op) {
+			return nil
+		}
+		return gql.cc.writeFrames(context.Background(), graphQLErrorFrame(op.ID, err))
+	}
+
+	gql.topicsMutex.Lock()
+	defer gql.topicsMutex.Unlock()
+
+	// Completed by the resolver, whose topics are released once they are set.
+	if ctx.Err() != nil || len(topics) == 0 {
+		return nil
+	}
+	gql.mutex.Lock()
+	op.topics = topics
+	gql.mutex.Unlock()
+
+	current := gql.cc.GetTopics()
+	updated := append([]string{}, current...)
+	for _, topic := range topics {
+		if !contains(updated, topic) {
+			updated = append(updated, topic)
+		}
+	}
+	if len(updated) != len(current) {
+		gql.cc.SetTopics(updated)
+	}
+	return nil
+}
+
+// Whether the operation was still running.
+func (gql *graphQLClient) removeOperation(op *GraphQLOperation) bool {
+	gql.mutex.Lock()
+	defer gql.mutex.Unlock()
+
+	if gql.operations[op.ID] != op {
+		return false
+	}
+	delete(gql.operations, op.ID)
+	op.cancel()
+	return true
+}
+
+// Removes the topics of the operation from the topics of the client, unless another operation is fed from them.
+func (gql *graphQLClient) releaseTopics(op *GraphQLOperation) {
+	gql.topicsMutex.Lock()
+	defer gql.topicsMutex.Unlock()
+
+	gql.mutex.Lock()
+	released := []string{}
+	for _, topic := range op.topics {
+		used := false
+		for _, other := range gql.operations {
+			used = used || contains(other.topics, topic)
+		}
+		if !used {
+			released = append(released, topic)
+		}
+	}
+	gql.mutex.Unlock()
+
+	if len(released) == 0 {
+		return
+	}
+	topics := []string{}
+	for _, topic := range gql.cc.GetTopics() {
+		if !contains(released, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	gql.cc.SetTopics(topics)
+}
+
+// Closes the connection with one of the close codes of the protocol.
+func (gql *graphQLClient) fail(code int, text string) error {
+	ms := gql.cc.getServer()
+	ms.mutex.Lock()
+	defer ms.unlock()
+
+	if err := gql.cc.closeWithCode(code, text, DisconnectClosed); err != nil {
+		gql.cc.logger.Debug("Failed to close GraphQL client", zap.Error(err))
+	}
+	return fmt.Errorf("%w: %d %s", ErrInvalidGraphQLMessage, code, text)
+}
+
+func (gql *graphQLClient) closed() {
+	gql.mutex.Lock()
+	defer gql.mutex.Unlock()
+
+	for _, op := range gql.operations {
+		op.cancel()
+	}
+	gql.operations = make(map[string]*GraphQLOperation)
+}
+
+func graphQLFrame(messageType string, id string, payload json.RawMessage) frame {
+	// Can't fail, as payload is valid JSON.
+	data, _ := json.Marshal(graphQLMessage{ID: id, Type: messageType, Payload: payload})
+	return frame{messageType: websocket.TextMessage, data: data}
+}
+
+func graphQLErrorFrame(id string, err error) frame {
+	var graphQLErr GraphQLError
+	if !errors.As(err, &graphQLErr) {
+		graphQLErr = GraphQLError{Message: err.Error()}
+	}
+	// Can't fail, unless extensions can't be encoded.
+	payload, encodeErr := json.Marshal([]GraphQLError{graphQLErr})
+	if encodeErr != nil {
+		payload, _ = json.Marshal([]GraphQLError{{Message: graphQLErr.Message}})
+	}
+	return graphQLFrame(_GRAPHQL_ERROR, id, payload)
+}
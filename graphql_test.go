@@ -0,0 +1,268 @@
+package magicsockets_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+// Feeds subscriptions from the topic in their variables, and answers queries right away.
+type testGraphQLResolver struct{}
+
+func (testGraphQLResolver) Subscribe(op *magicsockets.GraphQLOperation) ([]string, error) {
+	if strings.HasPrefix(op.Query, "query") {
+		if err := op.Next(&magicsockets.GraphQLResult{Data: json.RawMessage(`{"hello":"world"}`)}); err != nil {
+			return nil, err
+		}
+		return nil, op.Complete()
+	}
+
+	var topic string
+	if err := json.Unmarshal(op.Variables["topic"], &topic); err != nil {
+		return nil, errors.New("missing topic")
+	}
+	return []string{topic}, nil
+}
+
+func (testGraphQLResolver) Resolve(op *magicsockets.GraphQLOperation, topic string, message []byte) (*magicsockets.GraphQLResult, error) {
+	switch string(message) {
+	case "skip":
+		return nil, nil
+	case "fail":
+		return nil, magicsockets.GraphQLError{Message: "resolver failed", Path: []any{"news"}}
+	}
+
+	data, err := json.Marshal(map[string]string{"news": string(message), "topic": topic})
+	if err != nil {
+		return nil, err
+	}
+	return &magicsockets.GraphQLResult{Data: data}, nil
+}
+
+var _ = Describe("GraphQL", func() {
+	var (
+		ms         magicsockets.MagicSocket
+		httpServer *httptest.Server
+
+		opts   magicsockets.MagicSocketOpts
+		topics chan []string
+	)
+
+	BeforeEach(func() {
+		topics = make(chan []string, 10)
+		opts = magicsockets.MagicSocketOpts{
+			OnTopicsChanged: func(client magicsockets.ClientConn, oldTopics []string, newTopics []string) {
+				topics <- newTopics
+			},
+		}
+	})
+
+	JustBeforeEach(func() {
+		ms = magicsockets.New(opts)
+		handler, err := ms.GraphQLHandler(magicsockets.GraphQLOpts{
+			OnInit: func(r *http.Request, payload json.RawMessage) (magicsockets.RegisterClientOpts, error) {
+				var init struct {
+					Token string `json:"token"`
+				}
+				if err := json.Unmarshal(payload, &init); err != nil || init.Token == "" {
+					return magicsockets.RegisterClientOpts{}, errors.New("missing token")
+				}
+				return magicsockets.RegisterClientOpts{Key: init.Token}, nil
+			},
+			Resolver:    testGraphQLResolver{},
+			InitTimeout: 100 * time.Millisecond,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		httpServer = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+		httpServer.Close()
+	})
+
+	read := func(conn *websocket.Conn) string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, message, err := conn.ReadMessage()
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		return string(message)
+	}
+
+	write := func(conn *websocket.Conn, message string) {
+		ExpectWithOffset(1, conn.WriteMessage(websocket.TextMessage, []byte(message))).To(Succeed())
+	}
+
+	expectClosed := func(conn *websocket.Conn, code int) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		ExpectWithOffset(1, errors.As(err, &closeErr)).To(BeTrue(), "expected a close error, got %v", err)
+		ExpectWithOffset(1, closeErr.Code).To(Equal(code))
+	}
+
+	dial := func() *websocket.Conn {
+		dialer := websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}
+		conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.Header.Get("Sec-WebSocket-Protocol")).To(Equal("graphql-transport-ws"))
+		DeferCleanup(func() { conn.Close() })
+		return conn
+	}
+
+	connect := func() *websocket.Conn {
+		conn := dial()
+		write(conn, `{"type":"connection_init","payload":{"token":"user-1"}}`)
+		Expect(read(conn)).To(MatchJSON(`{"type":"connection_ack"}`))
+		return conn
+	}
+
+	emit := func(topic string, message string) {
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{topic}}}}, []byte(message))
+	}
+
+	It("Registers clients from the payload of connection_init", func() {
+		connect()
+		Expect(ms.GetClientsByKey("user-1")).To(HaveLen(1))
+	})
+
+	It("Refuses clients failing OnInit", func() {
+		conn := dial()
+		write(conn, `{"type":"connection_init","payload":{}}`)
+
+		expectClosed(conn, 4403)
+		Expect(ms.GetClients()).To(BeEmpty())
+	})
+
+	It("Closes connections not initialised in time", func() {
+		conn := dial()
+
+		expectClosed(conn, 4408)
+		Expect(ms.GetClients()).To(BeEmpty())
+	})
+
+	It("Refuses subscriptions before connection_init", func() {
+		conn := dial()
+		write(conn, `{"id":"1","type":"subscribe","payload":{"query":"subscription { news }"}}`)
+
+		expectClosed(conn, 4401)
+	})
+
+	It("Feeds subscriptions from the topics they were emitted to", func() {
+		conn := connect()
+		write(conn, `{"id":"1","type":"subscribe","payload":{"query":"subscription { news }","variables":{"topic":"news"}}}`)
+		Eventually(topics).Should(Receive(Equal([]string{"news"})))
+
+		emit("news", "skip")
+		emit("news", "hello")
+		Expect(read(conn)).To(MatchJSON(`{"id":"1","type":"next","payload":{"data":{"news":"hello","topic":"news"}}}`))
+
+		write(conn, `{"id":"1","type":"complete"}`)
+		Eventually(topics).Should(Receive(BeEmpty()))
+	})
+
+	It("Answers operations completed by the resolver", func() {
+		conn := connect()
+		write(conn, `{"id":"q","type":"subscribe","payload":{"query":"query { hello }"}}`)
+
+		Expect(read(conn)).To(MatchJSON(`{"id":"q","type":"next","payload":{"data":{"hello":"world"}}}`))
+		Expect(read(conn)).To(MatchJSON(`{"id":"q","type":"complete"}`))
+	})
+
+	It("Sends the errors of the resolver, ending the operation", func() {
+		conn := connect()
+		write(conn, `{"id":"1","type":"subscribe","payload":{"query":"subscription { news }"}}`)
+		Expect(read(conn)).To(MatchJSON(`{"id":"1","type":"error","payload":[{"message":"missing topic"}]}`))
+
+		write(conn, `{"id":"2","type":"subscribe","payload":{"query":"subscription { news }","variables":{"topic":"news"}}}`)
+		Eventually(topics).Should(Receive(Equal([]string{"news"})))
+		emit("news", "fail")
+		Expect(read(conn)).To(MatchJSON(`{"id":"2","type":"error","payload":[{"message":"resolver failed","path":["news"]}]}`))
+		Eventually(topics).Should(Receive(BeEmpty()))
+	})
+
+	It("Closes connections reusing the ID of a running operation", func() {
+		conn := connect()
+		write(conn, `{"id":"1","type":"subscribe","payload":{"query":"subscription { news }","variables":{"topic":"news"}}}`)
+		write(conn, `{"id":"1","type":"subscribe","payload":{"query":"subscription { news }","variables":{"topic":"news"}}}`)
+
+		expectClosed(conn, 4409)
+		Eventually(ms.GetClients).Should(BeEmpty())
+	})
+
+	It("Answers pings", func() {
+		conn := connect()
+		write(conn, `{"type":"ping","payload":{"at":1}}`)
+
+		Expect(read(conn)).To(MatchJSON(`{"type":"pong","payload":{"at":1}}`))
+	})
+
+	Context("Over the limits", func() {
+		var rejections chan magicsockets.AdmissionRejection
+
+		BeforeEach(func() {
+			rejections = make(chan magicsockets.AdmissionRejection, 10)
+			opts.OnAdmissionRejected = func(rejection magicsockets.AdmissionRejection) {
+				rejections <- rejection
+			}
+		})
+
+		// The key is only known after connection_init, once the connection is upgraded, so it can only be closed.
+		expectRejected := func(err error) {
+			conn := dial()
+			write(conn, `{"type":"connection_init","payload":{"token":"user-1"}}`)
+			expectClosed(conn, websocket.CloseTryAgainLater)
+
+			var rejection magicsockets.AdmissionRejection
+			Eventually(rejections).Should(Receive(&rejection))
+			Expect(rejection.Err).To(MatchError(err))
+			Expect(rejection.Status).To(BeZero())
+			Expect(rejection.Key).To(Equal("user-1"))
+			Expect(ms.GetClients()).To(HaveLen(1))
+		}
+
+		Context("Of admission", func() {
+			BeforeEach(func() {
+				opts.AdmissionLimit = magicsockets.AdmissionLimit{MaxConnections: 1}
+			})
+
+			// Checked before OnInit, so before the connection is upgraded.
+			It("Refuses handshakes with a status", func() {
+				connect()
+
+				dialer := websocket.Dialer{Subprotocols: []string{"graphql-transport-ws"}}
+				_, res, err := dialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+				Expect(err).To(MatchError(websocket.ErrBadHandshake))
+				Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+				Expect(res.Header.Get("Retry-After")).ToNot(BeEmpty())
+
+				var rejection magicsockets.AdmissionRejection
+				Eventually(rejections).Should(Receive(&rejection))
+				Expect(rejection.Err).To(MatchError(magicsockets.ErrTooManyConnections))
+				Expect(rejection.Status).To(Equal(http.StatusServiceUnavailable))
+			})
+		})
+
+		Context("Of connections per key", func() {
+			BeforeEach(func() {
+				opts.KeyConflictPolicy = magicsockets.KeyConflictAllow
+				opts.MaxConnectionsPerKey = 1
+			})
+
+			It("Closes clients with 1013 Try Again Later", func() {
+				connect()
+
+				expectRejected(magicsockets.ErrKeyLimitReached)
+			})
+		})
+	})
+})
@@ -0,0 +1,67 @@
+package magicsockets
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// Pings clients periodically, disconnecting those that don't answer in time.
+// Zero values disable the heartbeat.
+type Heartbeat struct {
+	// How often clients are pinged.
+	Interval time.Duration
+	// How long to wait for the pong answering a ping. Defaults to Interval.
+	Timeout time.Duration
+}
+
+func (h Heartbeat) enabled() bool {
+	return h.Interval > 0
+}
+
+func (h Heartbeat) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return h.Timeout
+	}
+	return h.Interval
+}
+
+// Sets the read deadline the heartbeat relies on, and starts pinging the client.
+// Must be called before the client starts reading messages.
+func (cc *client) startHeartbeat(conn ControlConn, heartbeat Heartbeat) {
+	extendDeadline := func() error {
+		return conn.SetReadDeadline(time.Now().Add(heartbeat.Interval + heartbeat.timeout()))
+	}
+
+	extendDeadline()
+	conn.SetPongHandler(func(string) error {
+		return extendDeadline()
+	})
+
+	go func() {
+		ticker := time.NewTicker(heartbeat.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-cc.ctx.Done():
+				return
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(heartbeat.timeout()))
+				if err != nil {
+					cc.logger.Debug("Failed to ping client", zap.Error(err))
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Whether reading failed because the heartbeat deadline passed.
+func isHeartbeatTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,101 @@
+package magicsockets_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Heartbeat", func() {
+	var (
+		ms      magicsockets.MagicSocket
+		address string
+
+		key          string
+		disconnected chan magicsockets.DisconnectReason
+	)
+
+	BeforeEach(func() {
+		key = gofakeit.UUID()
+		disconnected = make(chan magicsockets.DisconnectReason, 1)
+
+		ms, address = startMagicSocket(magicsockets.MagicSocketOpts{
+			Heartbeat: magicsockets.Heartbeat{
+				Interval: time.Millisecond * 50,
+				Timeout:  time.Millisecond * 50,
+			},
+			OnClientDisconnected: func(client magicsockets.ClientConn, reason magicsockets.DisconnectReason) {
+				disconnected <- reason
+			},
+		})
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key: key,
+			}, nil
+		})
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	It("Keeps clients answering pings connected", func() {
+		websocketClientConn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+		defer websocketClientConn.Close()
+
+		// Pings are only answered while reading.
+		go func() {
+			for {
+				if _, _, err := websocketClientConn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		Consistently(disconnected, time.Millisecond*300).ShouldNot(Receive())
+		Expect(ms.GetClientsByKey(key)).To(HaveLen(1))
+	})
+
+	It("Disconnects clients that don't answer pings", func() {
+		websocketClientConn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+		defer websocketClientConn.Close()
+
+		Eventually(disconnected).Should(Receive(Equal(magicsockets.DisconnectHeartbeatTimeout)))
+		Expect(ms.GetClientsByKey(key)).To(BeEmpty())
+	})
+
+	It("Leaves Socket.IO clients to the pings of Engine.IO", func() {
+		handler, err := ms.SocketIOHandler(magicsockets.SocketIOOpts{})
+		Expect(err).ToNot(HaveOccurred())
+		httpServer := httptest.NewServer(handler)
+		defer httpServer.Close()
+
+		websocketClientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/?EIO=4&transport=websocket", nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer websocketClientConn.Close()
+
+		// Keeps reading Engine.IO packets, without answering websocket pings.
+		websocketClientConn.SetPingHandler(func(string) error { return nil })
+		go func() {
+			for {
+				if _, _, err := websocketClientConn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		Consistently(disconnected, time.Millisecond*300).ShouldNot(Receive())
+		Expect(ms.GetClientsByKey(key)).To(HaveLen(1))
+	})
+})
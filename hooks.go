@@ -0,0 +1,93 @@
+package magicsockets
+
+import (
+	"context"
+	"net/http"
+)
+
+// Hooks observing the whole server, set through MagicSocketOpts.
+// They run without holding the server mutex, so they may call back into the server.
+type serverHooks struct {
+	onClientConnected    func(client ClientConn)
+	onClientDisconnected func(client ClientConn, reason DisconnectReason)
+	onKeyChanged         func(client ClientConn, oldKey string, newKey string)
+	onTopicsChanged      func(client ClientConn, oldTopics []string, newTopics []string)
+	onHandshakeRejected  func(r *http.Request, err error)
+	onAdmissionRejected  func(rejection AdmissionRejection)
+	onEmit               func(opts EmitOpts, message []byte, targets []ClientConn)
+}
+
+// Queues a hook to run once the server mutex is released.
+// Must be called while holding the server mutex.
+func (ms *magicSocket) runAfterUnlock(hook func()) {
+	ms.queuedHooks = append(ms.queuedHooks, hook)
+}
+
+// Releases the server mutex, then runs the hooks queued while holding it.
+func (ms *magicSocket) unlock() {
+	hooks := ms.queuedHooks
+	ms.queuedHooks = nil
+	ms.mutex.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// Client hooks receiving the context of the client, see ClientConn.Context, and the client they fire for.
+// Set through MagicSocketOpts.ClientHooks to apply to clients registered without the hook.
+//
+// They run without holding the server mutex, so they may call back into the server.
+// OnDisconnect runs once the client is removed from the server, before its context is cancelled.
+type ClientHooks struct {
+	OnIncoming   func(ctx context.Context, client ClientConn, messageType int, data []byte) error
+	OnOutgoing   func(ctx context.Context, client ClientConn, messageType int, data []byte) error
+	OnPing       func(ctx context.Context, client ClientConn) error
+	OnDisconnect func(ctx context.Context, client ClientConn) error
+}
+
+// The client hooks of RegisterClientOpts, preferring the variants receiving the context,
+// then the plain ones adapted to their signature, then the server-wide defaults.
+func (opts RegisterClientOpts) hooks(defaults ClientHooks) ClientHooks {
+	hooks := ClientHooks{
+		OnIncoming:   opts.OnIncomingContext,
+		OnOutgoing:   opts.OnOutgoingContext,
+		OnPing:       opts.OnPingContext,
+		OnDisconnect: opts.OnDisconnectContext,
+	}
+
+	if onIncoming := opts.OnIncoming; hooks.OnIncoming == nil && onIncoming != nil {
+		hooks.OnIncoming = func(_ context.Context, _ ClientConn, messageType int, data []byte) error {
+			return onIncoming(messageType, data)
+		}
+	}
+	if onOutgoing := opts.OnOutgoing; hooks.OnOutgoing == nil && onOutgoing != nil {
+		hooks.OnOutgoing = func(_ context.Context, _ ClientConn, messageType int, data []byte) error {
+			return onOutgoing(messageType, data)
+		}
+	}
+	if onPing := opts.OnPing; hooks.OnPing == nil && onPing != nil {
+		hooks.OnPing = func(_ context.Context, _ ClientConn) error {
+			return onPing()
+		}
+	}
+	if onDisconnect := opts.OnDisconnect; hooks.OnDisconnect == nil && onDisconnect != nil {
+		hooks.OnDisconnect = func(_ context.Context, _ ClientConn) error {
+			return onDisconnect()
+		}
+	}
+
+	if hooks.OnIncoming == nil {
+		hooks.OnIncoming = defaults.OnIncoming
+	}
+	if hooks.OnOutgoing == nil {
+		hooks.OnOutgoing = defaults.OnOutgoing
+	}
+	if hooks.OnPing == nil {
+		hooks.OnPing = defaults.OnPing
+	}
+	if hooks.OnDisconnect == nil {
+		hooks.OnDisconnect = defaults.OnDisconnect
+	}
+	return hooks
+}
@@ -0,0 +1,228 @@
+package magicsockets_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/brianvoe/gofakeit/v6"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Server hooks", func() {
+	var (
+		ms      magicsockets.MagicSocket
+		address string
+
+		key    string
+		reject bool
+		events chan string
+	)
+
+	BeforeEach(func() {
+		key = gofakeit.UUID()
+		reject = false
+		events = make(chan string, 10)
+
+		ms, address = startMagicSocket(magicsockets.MagicSocketOpts{
+			OnClientConnected: func(client magicsockets.ClientConn) {
+				// Hooks may call back into the server. Asserted by the specs, since hooks don't run in their goroutine.
+				events <- fmt.Sprintf("connected %s %d", client.GetKey(), len(ms.GetClientsByKey(client.GetKey())))
+			},
+			OnClientDisconnected: func(client magicsockets.ClientConn, reason magicsockets.DisconnectReason) {
+				events <- "disconnected " + string(reason)
+			},
+			OnKeyChanged: func(client magicsockets.ClientConn, oldKey string, newKey string) {
+				events <- "key " + oldKey + " " + newKey
+			},
+			OnTopicsChanged: func(client magicsockets.ClientConn, oldTopics []string, newTopics []string) {
+				events <- "topics " + newTopics[0]
+			},
+			OnHandshakeRejected: func(r *http.Request, err error) {
+				events <- "rejected " + err.Error()
+			},
+			OnEmit: func(opts magicsockets.EmitOpts, message []byte, targets []magicsockets.ClientConn) {
+				events <- "emit " + string(message) + " " + targets[0].GetKey()
+			},
+		})
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			if reject {
+				return magicsockets.RegisterClientOpts{}, errors.New("unauthorized")
+			}
+			return magicsockets.RegisterClientOpts{
+				Key: key,
+			}, nil
+		})
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	It("Calls the hooks through the lifecycle of a client", func() {
+		websocketClientConn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+		defer websocketClientConn.Close()
+		Eventually(events).Should(Receive(Equal("connected " + key + " 1")))
+
+		client := ms.GetClients()[key]
+		newKey := gofakeit.UUID()
+		Expect(client.UpdateKey(newKey)).To(Succeed())
+		Eventually(events).Should(Receive(Equal("key " + key + " " + newKey)))
+
+		client.SetTopics([]string{"news"})
+		Eventually(events).Should(Receive(Equal("topics news")))
+
+		ms.Emit(magicsockets.EmitOpts{
+			Rules: []magicsockets.EmitRule{
+				{
+					AnyOfTopics: []string{"news"},
+				},
+			},
+		}, []byte("hello"))
+		Eventually(events).Should(Receive(Equal("emit hello " + newKey)))
+
+		Expect(client.Close()).To(Succeed())
+		Eventually(events).Should(Receive(Equal("disconnected closed")))
+	})
+
+	It("Calls the hook for rejected handshakes", func() {
+		reject = true
+		_, err := newWebsocketClientConn(address)
+		Expect(err).To(HaveOccurred())
+		Eventually(events).Should(Receive(Equal("rejected unauthorized")))
+	})
+})
+
+var _ = Describe("Client hooks", func() {
+	It("Passes the client to the hooks receiving it", func() {
+		disconnected := make(chan string, 1)
+
+		ms, address := startMagicSocket(magicsockets.MagicSocketOpts{
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{
+					Key: "before",
+					OnIncomingContext: func(ctx context.Context, client magicsockets.ClientConn, messageType int, data []byte) error {
+						if err := client.UpdateKey(string(data)); err != nil {
+							return err
+						}
+						return client.WriteMessage(messageType, []byte("key "+client.GetKey()))
+					},
+					OnDisconnectContext: func(ctx context.Context, client magicsockets.ClientConn) error {
+						disconnected <- client.GetKey()
+						return nil
+					},
+				}, nil
+			},
+		})
+
+		websocketClientConn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(websocketClientConn.WriteMessage(websocket.TextMessage, []byte("after"))).To(Succeed())
+		_, message, err := websocketClientConn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal("key after"))
+
+		Expect(websocketClientConn.Close()).To(Succeed())
+		Eventually(disconnected).Should(Receive(Equal("after")))
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	It("Lets OnDisconnect emit to the remaining clients", func() {
+		ms, address := startMagicSocket(magicsockets.MagicSocketOpts{})
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key: r.URL.Query().Get("key"),
+				OnDisconnectContext: func(ctx context.Context, client magicsockets.ClientConn) error {
+					// Already removed from the server.
+					if err := client.Close(); err != nil {
+						return err
+					}
+					message := fmt.Sprintf("left %s, %d remaining", client.GetKey(), len(ms.GetClients()))
+					ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{}}}, []byte(message))
+					return nil
+				},
+			}, nil
+		})
+		defer ms.Stop()
+
+		leaving, _, err := websocket.DefaultDialer.Dial("ws://"+address+"/?key=leaving", nil)
+		Expect(err).ToNot(HaveOccurred())
+		staying, _, err := websocket.DefaultDialer.Dial("ws://"+address+"/?key=staying", nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer staying.Close()
+		Eventually(ms.GetClients).Should(HaveLen(2))
+
+		Expect(leaving.Close()).To(Succeed())
+		_, message, err := staying.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal("left leaving, 1 remaining"))
+	})
+
+	It("Uses the server-wide hooks for clients registered without them", func() {
+		incoming := make(chan string, 2)
+		outgoing := make(chan string, 2)
+		contexts := make(chan context.Context, 1)
+
+		ms, address := startMagicSocket(magicsockets.MagicSocketOpts{
+			ClientHooks: magicsockets.ClientHooks{
+				OnIncoming: func(ctx context.Context, client magicsockets.ClientConn, messageType int, data []byte) error {
+					incoming <- "default " + client.GetKey()
+					contexts <- ctx
+					return nil
+				},
+				OnOutgoing: func(ctx context.Context, client magicsockets.ClientConn, messageType int, data []byte) error {
+					outgoing <- "default " + client.GetKey()
+					return nil
+				},
+			},
+		})
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			key := r.URL.Query().Get("key")
+			opts := magicsockets.RegisterClientOpts{Key: key}
+			if key == "own" {
+				opts.OnIncoming = func(messageType int, data []byte) error {
+					incoming <- "own"
+					return nil
+				}
+			}
+			return opts, nil
+		})
+		defer ms.Stop()
+
+		conns := map[string]*websocket.Conn{}
+		for _, key := range []string{"own", "other"} {
+			websocketClientConn, _, err := websocket.DefaultDialer.Dial("ws://"+address+"/?key="+key, nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer websocketClientConn.Close()
+			conns[key] = websocketClientConn
+
+			Expect(websocketClientConn.WriteMessage(websocket.TextMessage, []byte("hello"))).To(Succeed())
+		}
+		received := []string{}
+		for range []string{"own", "other"} {
+			var event string
+			Eventually(incoming).Should(Receive(&event))
+			received = append(received, event)
+		}
+		Expect(received).To(ConsistOf("own", "default other"))
+
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{OnlyKeys: []string{"own"}}}}, []byte("hello"))
+		Eventually(outgoing).Should(Receive(Equal("default own")))
+
+		// The context of the client, cancelled once it's disconnected.
+		var ctx context.Context
+		Eventually(contexts).Should(Receive(&ctx))
+		Expect(ctx.Err()).ToNot(HaveOccurred())
+		conns["other"].Close()
+		Eventually(ctx.Done()).Should(BeClosed())
+	})
+})
@@ -0,0 +1,120 @@
+package magicsockets
+
+import (
+	"errors"
+	"time"
+)
+
+// Determines what happens when a key is already in use by another connection.
+type KeyConflictPolicy int
+
+const (
+	// Allows the connections to share the key, e.g. a user with multiple tabs or devices open.
+	// This is the default, since connections sharing a key were always accepted.
+	KeyConflictAllow KeyConflictPolicy = iota
+	// Rejects the new connection, or the key update.
+	KeyConflictReject
+	// Closes the connections currently using the key with CloseReplaced.
+	KeyConflictReplace
+)
+
+// Close code sent to connections evicted by KeyConflictReplace.
+// Codes 4000-4999 are reserved for applications by RFC 6455.
+const CloseReplaced = 4000
+
+var (
+	ErrKeyInUse        = errors.New("key already in use")
+	ErrKeyLimitReached = errors.New("maximum amount of connections for key reached")
+)
+
+type KeyConflict struct {
+	Key string
+	// The client updating its key.
+	// Nil when the conflict happened while registering a new connection.
+	Client ClientConn
+	// Clients that were using the key when the conflict happened.
+	Existing []ClientConn
+	// Policy that was applied.
+	Policy KeyConflictPolicy
+	// When the conflict happened.
+	Time time.Time
+}
+
+func (p KeyConflictPolicy) String() string {
+	switch p {
+	case KeyConflictAllow:
+		return "allow"
+	case KeyConflictReject:
+		return "reject"
+	case KeyConflictReplace:
+		return "replace"
+	default:
+		return "unknown"
+	}
+}
+
+// Applies the key conflict policy before a client starts using the key.
+// Returns the conflict, if there was one, and an error if the key can't be used.
+// Must be called while holding the server mutex.
+func (ms *magicSocket) claimKey(key string) (*KeyConflict, error) {
+	existing := ms.clients.byKey(key)
+	if len(existing) == 0 {
+		return nil, nil
+	}
+
+	conflict := &KeyConflict{
+		Key:    key,
+		Policy: ms.keyConflictPolicy,
+		Time:   time.Now(),
+	}
+	for _, client := range existing {
+		conflict.Existing = append(conflict.Existing, client)
+	}
+
+	switch ms.keyConflictPolicy {
+	case KeyConflictReplace:
+		for _, client := range existing {
+			client.logger.Debug("Replacing client due to key conflict")
+			client.closeWithCode(CloseReplaced, "replaced", DisconnectReplaced)
+		}
+		return conflict, nil
+	case KeyConflictReject:
+		return conflict, ErrKeyInUse
+	default:
+		if ms.keyLimitReached(key) {
+			return conflict, ErrKeyLimitReached
+		}
+		return conflict, nil
+	}
+}
+
+// Whether a new connection could use the key, without applying the key conflict policy.
+// Used to refuse handshakes before upgrading them, claimKey has the final say.
+func (ms *magicSocket) checkKey(key string) error {
+	if ms.clients.countKey(key) == 0 {
+		return nil
+	}
+
+	switch ms.keyConflictPolicy {
+	case KeyConflictReplace:
+		return nil
+	case KeyConflictReject:
+		return ErrKeyInUse
+	default:
+		if ms.keyLimitReached(key) {
+			return ErrKeyLimitReached
+		}
+		return nil
+	}
+}
+
+func (ms *magicSocket) keyLimitReached(key string) bool {
+	return ms.maxConnectionsPerKey > 0 && ms.clients.countKey(key) >= ms.maxConnectionsPerKey
+}
+
+func (opts MagicSocketOpts) keyConflictPolicy() KeyConflictPolicy {
+	if opts.AllowSharedKeys {
+		return KeyConflictAllow
+	}
+	return opts.KeyConflictPolicy
+}
@@ -0,0 +1,204 @@
+package magicsockets_test
+
+import (
+	"net/http"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Keys", func() {
+	var (
+		ms      magicsockets.MagicSocket
+		address string
+		opts    magicsockets.MagicSocketOpts
+
+		key string
+
+		websocketClientConns []*websocket.Conn
+	)
+
+	BeforeEach(func() {
+		opts = magicsockets.MagicSocketOpts{}
+		key = gofakeit.UUID()
+		websocketClientConns = nil
+	})
+
+	JustBeforeEach(func() {
+		ms, address = startMagicSocket(opts)
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key: key,
+			}, nil
+		})
+	})
+
+	AfterEach(func() {
+		for _, conn := range websocketClientConns {
+			conn.Close()
+		}
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	connect := func() (*websocket.Conn, error) {
+		conn, err := newWebsocketClientConn(address)
+		if conn != nil {
+			websocketClientConns = append(websocketClientConns, conn)
+		}
+		return conn, err
+	}
+
+	It("Lets connections share a key by default", func() {
+		for i := 0; i < 2; i++ {
+			_, err := connect()
+			Expect(err).ToNot(HaveOccurred())
+		}
+		Eventually(func() int { return len(ms.GetClientsByKey(key)) }).Should(Equal(2))
+	})
+
+	Context("With the deprecated AllowSharedKeys", func() {
+		BeforeEach(func() {
+			opts.KeyConflictPolicy = magicsockets.KeyConflictReject
+			opts.AllowSharedKeys = true
+		})
+
+		It("Lets connections share a key", func() {
+			for i := 0; i < 2; i++ {
+				_, err := connect()
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Eventually(func() int { return len(ms.GetClientsByKey(key)) }).Should(Equal(2))
+		})
+	})
+
+	Context("Rejecting key conflicts", func() {
+		BeforeEach(func() {
+			opts.KeyConflictPolicy = magicsockets.KeyConflictReject
+		})
+
+		It("Updates a client to the key it already has", func() {
+			_, err := connect()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(ms.GetClientsByKey(key)[0].UpdateKey(key)).To(Succeed())
+		})
+
+		It("Rejects a connection with a key already in use", func() {
+			_, err := connect()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = connect()
+			Expect(err).To(HaveOccurred())
+			Expect(ms.GetClientsByKey(key)).To(HaveLen(1))
+		})
+
+		It("Rejects updating to a key already in use", func() {
+			_, err := connect()
+			Expect(err).ToNot(HaveOccurred())
+
+			otherKey := key
+			key = gofakeit.UUID()
+			_, err = connect()
+			Expect(err).ToNot(HaveOccurred())
+
+			err = ms.GetClientsByKey(key)[0].UpdateKey(otherKey)
+			Expect(err).To(MatchError(magicsockets.ErrKeyInUse))
+		})
+	})
+
+	Context("Replacing on key conflicts", func() {
+		var conflicts chan magicsockets.KeyConflict
+
+		BeforeEach(func() {
+			conflicts = make(chan magicsockets.KeyConflict, 1)
+			opts.KeyConflictPolicy = magicsockets.KeyConflictReplace
+			opts.OnKeyConflict = func(conflict magicsockets.KeyConflict) {
+				conflicts <- conflict
+			}
+		})
+
+		It("Evicts the old connection with a replaced close reason", func() {
+			oldConn, err := connect()
+			Expect(err).ToNot(HaveOccurred())
+			oldID := ms.GetClientsByKey(key)[0].GetID()
+
+			_, err = connect()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, err = oldConn.ReadMessage()
+			Expect(websocket.IsCloseError(err, magicsockets.CloseReplaced)).To(BeTrue())
+
+			clients := ms.GetClientsByKey(key)
+			Expect(clients).To(HaveLen(1))
+			Expect(clients[0].GetID()).ToNot(Equal(oldID))
+
+			var conflict magicsockets.KeyConflict
+			Eventually(conflicts).Should(Receive(&conflict))
+			Expect(conflict.Key).To(Equal(key))
+			Expect(conflict.Client).To(BeNil())
+			Expect(conflict.Existing).To(HaveLen(1))
+			Expect(conflict.Policy).To(Equal(magicsockets.KeyConflictReplace))
+		})
+	})
+
+	Context("Allowing key conflicts", func() {
+		BeforeEach(func() {
+			opts.KeyConflictPolicy = magicsockets.KeyConflictAllow
+			opts.MaxConnectionsPerKey = 2
+		})
+
+		It("Emits to every connection sharing a key", func() {
+			for i := 0; i < 2; i++ {
+				_, err := connect()
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Eventually(func() int { return len(ms.GetClientsByKey(key)) }).Should(Equal(2))
+
+			testMessage := gofakeit.BuzzWord()
+			ms.Emit(magicsockets.EmitOpts{
+				Rules: []magicsockets.EmitRule{
+					{
+						OnlyKeys: []string{key},
+					},
+				},
+			}, []byte(testMessage))
+
+			for _, conn := range websocketClientConns {
+				_, message, err := conn.ReadMessage()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(message)).To(Equal(testMessage))
+			}
+		})
+
+		It("Rejects connections above the per-key limit", func() {
+			for i := 0; i < 2; i++ {
+				_, err := connect()
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			_, err := connect()
+			Expect(err).To(HaveOccurred())
+			Expect(ms.GetClientsByKey(key)).To(HaveLen(2))
+		})
+
+		It("Allows updating to a key already in use", func() {
+			_, err := connect()
+			Expect(err).ToNot(HaveOccurred())
+
+			otherKey := key
+			key = gofakeit.UUID()
+			_, err = connect()
+			Expect(err).ToNot(HaveOccurred())
+
+			client := ms.GetClientsByKey(key)[0]
+			Expect(client.UpdateKey(otherKey)).To(Succeed())
+			Expect(ms.GetClientsByKey(otherKey)).To(HaveLen(2))
+			Expect(ms.GetClientsByKey(key)).To(BeEmpty())
+		})
+	})
+})
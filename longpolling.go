@@ -0,0 +1,346 @@
+package magicsockets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	_DEFAULT_POLL_TIMEOUT             = 25 * time.Second
+	_DEFAULT_POLL_SESSION_TIMEOUT     = 60 * time.Second
+	_DEFAULT_POLL_MAX_QUEUED_MESSAGES = 1000
+	_MAX_POLLING_MESSAGE_SIZE         = 1 << 20
+	_LONG_POLLING_MESSAGE_TYPE_TEXT   = "text"
+	_LONG_POLLING_MESSAGE_TYPE_BINARY = "binary"
+	_LONG_POLLING_BINARY_CONTENT_TYPE = "application/octet-stream"
+)
+
+var (
+	ErrPollingQueueFull = errors.New("too many messages queued for polling")
+	ErrPollInProgress   = errors.New("another poll is in progress")
+)
+
+// Serves clients over HTTP long polling, for clients that can't use websockets.
+//
+//	GET    ?<handshake query>  Registers a client through OnConnect. Responds {"sid": "..."}.
+//	GET    ?sid=...            Waits for messages. Responds a JSON array of LongPollingMessage, empty on timeout.
+//	POST   ?sid=...            Sends the body as a message, binary if its Content-Type is application/octet-stream.
+//	DELETE ?sid=...            Disconnects the client.
+//
+// Requests for sessions that are closed or expired are answered with 404 Not Found.
+type LongPollingOpts struct {
+	// How long polls wait for messages. Defaults to _DEFAULT_POLL_TIMEOUT.
+	PollTimeout time.Duration
+	// Clients not polling for this long are disconnected. Defaults to _DEFAULT_POLL_SESSION_TIMEOUT.
+	SessionTimeout time.Duration
+	// Messages queued until polled, writes fail beyond it. Defaults to _DEFAULT_POLL_MAX_QUEUED_MESSAGES.
+	MaxQueuedMessages int
+}
+
+// Message returned by polls.
+type LongPollingMessage struct {
+	// "text" or "binary".
+	Type string `json:"type"`
+	// Base64 encoded for binary messages.
+	Data string `json:"data"`
+}
+
+type longPollingHandler struct {
+	opts      LongPollingOpts
+	getServer func() *magicSocket
+
+	mutex    *sync.Mutex
+	sessions map[string]*pollingConn
+}
+
+// Session of a client connected through long polling.
+type pollingConn struct {
+	sid            string
+	maxQueued      int
+	sessionTimeout time.Duration
+
+	mutex   *sync.Mutex
+	queue   []frame
+	polling bool
+	// Disconnects the client once it stops polling.
+	expiry *time.Timer
+
+	// Signalled when messages are queued.
+	queued chan struct{}
+	// Messages sent by the client, until read by the server.
+	incoming  chan frame
+	done      chan struct{}
+	closeOnce *sync.Once
+	onClose   func()
+}
+
+// Returns an http.Handler serving long polling sessions. See LongPollingOpts.
+func (ms *magicSocket) LongPollingHandler(opts LongPollingOpts) (http.Handler, error) {
+	if err := ms.subscribeBroker(); err != nil {
+		return nil, err
+	}
+
+	if opts.PollTimeout == 0 {
+		opts.PollTimeout = _DEFAULT_POLL_TIMEOUT
+	}
+	if opts.SessionTimeout == 0 {
+		opts.SessionTimeout = _DEFAULT_POLL_SESSION_TIMEOUT
+	}
+	if opts.MaxQueuedMessages == 0 {
+		opts.MaxQueuedMessages = _DEFAULT_POLL_MAX_QUEUED_MESSAGES
+	}
+
+	return &longPollingHandler{
+		opts: opts,
+		getServer: func() *magicSocket {
+			return ms
+		},
+		mutex:    &sync.Mutex{},
+		sessions: make(map[string]*pollingConn),
+	}, nil
+}
+
+func (lh *longPollingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sid := r.URL.Query().Get("sid")
+	if sid == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		lh.getServer().handshake(w, r, lh.openSession, nil)
+		return
+	}
+
+	conn := lh.session(sid)
+	if conn == nil {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		lh.poll(w, r, conn)
+	case http.MethodPost:
+		lh.send(w, r, conn)
+	case http.MethodDelete:
+		conn.Close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (lh *longPollingHandler) openSession(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	conn := newPollingConn(lh.opts, func(sid string) {
+		lh.mutex.Lock()
+		defer lh.mutex.Unlock()
+
+		delete(lh.sessions, sid)
+	})
+
+	lh.mutex.Lock()
+	lh.sessions[conn.sid] = conn
+	lh.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"sid": conn.sid}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (lh *longPollingHandler) session(sid string) *pollingConn {
+	lh.mutex.Lock()
+	defer lh.mutex.Unlock()
+
+	return lh.sessions[sid]
+}
+
+func (lh *longPollingHandler) poll(w http.ResponseWriter, r *http.Request, conn *pollingConn) {
+	frames, err := conn.poll(r.Context(), lh.opts.PollTimeout)
+	switch {
+	case errors.Is(err, ErrPollInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrTransportClosed):
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	case err != nil:
+		// The client went away.
+		return
+	}
+
+	messages := make([]LongPollingMessage, 0, len(frames))
+	for _, frame := range frames {
+		message := LongPollingMessage{
+			Type: _LONG_POLLING_MESSAGE_TYPE_TEXT,
+			Data: string(frame.data),
+		}
+		if frame.messageType == websocket.BinaryMessage {
+			message.Type = _LONG_POLLING_MESSAGE_TYPE_BINARY
+			message.Data = base64.StdEncoding.EncodeToString(frame.data)
+		}
+		messages = append(messages, message)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(messages)
+}
+
+func (lh *longPollingHandler) send(w http.ResponseWriter, r *http.Request, conn *pollingConn) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, _MAX_POLLING_MESSAGE_SIZE))
+	if err != nil {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	messageType := websocket.TextMessage
+	if r.Header.Get("Content-Type") == _LONG_POLLING_BINARY_CONTENT_TYPE {
+		messageType = websocket.BinaryMessage
+	}
+
+	err = conn.send(r.Context(), frame{messageType: messageType, data: data})
+	switch {
+	case errors.Is(err, ErrTransportClosed):
+		http.Error(w, "unknown session", http.StatusNotFound)
+	case err != nil:
+		// The client went away.
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newPollingConn(opts LongPollingOpts, onClose func(sid string)) *pollingConn {
+	conn := &pollingConn{
+		sid:            uuid.NewString(),
+		maxQueued:      opts.MaxQueuedMessages,
+		sessionTimeout: opts.SessionTimeout,
+		mutex:          &sync.Mutex{},
+		queued:         make(chan struct{}, 1),
+		incoming:       make(chan frame),
+		done:           make(chan struct{}),
+		closeOnce:      &sync.Once{},
+	}
+	conn.onClose = func() {
+		onClose(conn.sid)
+	}
+	conn.expiry = time.AfterFunc(opts.SessionTimeout, func() {
+		conn.Close()
+	})
+	return conn
+}
+
+// Waits until messages are queued, returning them, or until the timeout, returning none.
+// Messages queued before the session was closed are still returned to a poll in progress.
+func (c *pollingConn) poll(ctx context.Context, timeout time.Duration) ([]frame, error) {
+	c.mutex.Lock()
+	if c.polling {
+		c.mutex.Unlock()
+		return nil, ErrPollInProgress
+	}
+	c.polling = true
+	c.expiry.Stop()
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		c.polling = false
+		c.expiry.Reset(c.sessionTimeout)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		c.mutex.Lock()
+		frames := c.queue
+		c.queue = nil
+		c.mutex.Unlock()
+		if len(frames) > 0 {
+			return frames, nil
+		}
+
+		select {
+		case <-c.queued:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, ErrTransportClosed
+		}
+	}
+}
+
+// Blocks until the message is read by the server.
+func (c *pollingConn) send(ctx context.Context, message frame) error {
+	select {
+	case c.incoming <- message:
+		return nil
+	case <-c.done:
+		return ErrTransportClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *pollingConn) ReadMessage() (int, []byte, error) {
+	select {
+	case message := <-c.incoming:
+		return message.messageType, message.data, nil
+	case <-c.done:
+		return 0, nil, ErrTransportClosed
+	}
+}
+
+// Queues the message until the next poll.
+func (c *pollingConn) WriteMessage(messageType int, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrTransportClosed
+	default:
+	}
+
+	if len(c.queue) >= c.maxQueued {
+		return ErrPollingQueueFull
+	}
+	c.queue = append(c.queue, frame{messageType: messageType, data: data})
+
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Writes are queued, so they aren't bounded by deadlines.
+func (c *pollingConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *pollingConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.expiry.Stop()
+		c.onClose()
+	})
+	return nil
+}
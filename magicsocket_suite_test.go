@@ -9,6 +9,9 @@ import (
 	"github.com/gorilla/websocket"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+	"github.com/problem-company-toolkit/magicsockets/magicsocketstest"
 )
 
 const (
@@ -41,3 +44,9 @@ func newWebsocketClientConn(address string) (*websocket.Conn, error) {
 	}
 	return c, nil
 }
+
+// Starts a server and returns it along with its address. The server is listening by the time it returns.
+func startMagicSocket(opts magicsockets.MagicSocketOpts) (magicsockets.MagicSocket, string) {
+	server := magicsocketstest.NewServer(GinkgoT(), opts)
+	return server.MagicSocket, server.Address()
+}
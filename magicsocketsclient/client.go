@@ -0,0 +1,498 @@
+// Client for MagicSocket servers that reconnects automatically.
+//
+// The key and topics of the client are sent in the query string of every handshake,
+// so they are restored when reconnecting. The server reads them in its OnConnect, e.g.:
+//
+//	ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+//		return magicsockets.RegisterClientOpts{
+//			Key:    r.URL.Query().Get("key"),
+//			Topics: r.URL.Query()["topic"],
+//		}, nil
+//	})
+package magicsocketsclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+type Opts struct {
+	// ws:// or wss:// URL of the server.
+	URL string
+	// Sent with every handshake.
+	Header http.Header
+	// Sent as a bearer token in the Authorization header.
+	Token string
+
+	Key    string
+	Topics []string
+	// Query parameters the key and topics are sent in. Default to "key" and "topic".
+	KeyParam   string
+	TopicParam string
+
+	Backoff Backoff
+	// Zero means retrying forever.
+	MaxReconnectAttempts int
+
+	// Pings the server to detect dead connections. Disabled when zero.
+	PingInterval time.Duration
+	// How long to wait for the pong answering a ping. Defaults to PingInterval.
+	PongTimeout time.Duration
+
+	// Messages sent while disconnected are queued up to this amount. Defaults to _DEFAULT_MAX_QUEUED_MESSAGES.
+	MaxQueuedMessages int
+
+	// Called after every successful connection, including the first one.
+	// Useful to send messages restoring the state of the client on the server.
+	OnConnect func(c *Client)
+	// Called when the connection is lost, before reconnecting.
+	OnDisconnect func(err error)
+	// Called when reconnecting failed MaxReconnectAttempts times in a row. The client is closed.
+	OnGiveUp func(err error)
+
+	// Defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+
+	// Defaults to a no-op logger.
+	Logger *zap.Logger
+}
+
+// Exponential backoff between reconnection attempts.
+type Backoff struct {
+	// Defaults to _DEFAULT_BACKOFF_INITIAL.
+	Initial time.Duration
+	// Defaults to _DEFAULT_BACKOFF_MAX.
+	Max time.Duration
+	// Defaults to _DEFAULT_BACKOFF_MULTIPLIER.
+	Multiplier float64
+	// Fraction of each delay that is randomized, from 0 to 1. Defaults to _DEFAULT_BACKOFF_JITTER.
+	// Negative values disable the jitter.
+	Jitter float64
+}
+
+type Client struct {
+	opts   Opts
+	logger *zap.Logger
+
+	mutex *sync.Mutex
+	// Nil while disconnected.
+	conn   *websocket.Conn
+	topics []string
+	queue  []queuedMessage
+	closed bool
+
+	handlersMutex *sync.RWMutex
+	handlers      []func(messageType int, data []byte)
+
+	// Closed once the client is closed.
+	done chan struct{}
+}
+
+type queuedMessage struct {
+	messageType int
+	data        []byte
+}
+
+const (
+	_DEFAULT_KEY_PARAM           = "key"
+	_DEFAULT_TOPIC_PARAM         = "topic"
+	_DEFAULT_MAX_QUEUED_MESSAGES = 256
+
+	_DEFAULT_BACKOFF_INITIAL    = time.Millisecond * 500
+	_DEFAULT_BACKOFF_MAX        = time.Second * 30
+	_DEFAULT_BACKOFF_MULTIPLIER = 2
+	_DEFAULT_BACKOFF_JITTER     = 0.2
+)
+
+var (
+	ErrClosed     = errors.New("client closed")
+	ErrQueueFull  = errors.New("too many messages queued while disconnected")
+	ErrMissingURL = errors.New("missing server URL")
+)
+
+// Connects to the server. Fails if the first connection can't be established,
+// after which the client reconnects on its own until closed.
+func Dial(opts Opts) (*Client, error) {
+	if opts.URL == "" {
+		return nil, ErrMissingURL
+	}
+	if opts.KeyParam == "" {
+		opts.KeyParam = _DEFAULT_KEY_PARAM
+	}
+	if opts.TopicParam == "" {
+		opts.TopicParam = _DEFAULT_TOPIC_PARAM
+	}
+	if opts.MaxQueuedMessages == 0 {
+		opts.MaxQueuedMessages = _DEFAULT_MAX_QUEUED_MESSAGES
+	}
+	if opts.PongTimeout == 0 {
+		opts.PongTimeout = opts.PingInterval
+	}
+	if opts.Dialer == nil {
+		opts.Dialer = websocket.DefaultDialer
+	}
+	opts.Backoff = opts.Backoff.withDefaults()
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	c := &Client{
+		opts:          opts,
+		logger:        logger.With(zap.String("URL", opts.URL)),
+		mutex:         &sync.Mutex{},
+		topics:        opts.Topics,
+		handlersMutex: &sync.RWMutex{},
+		done:          make(chan struct{}),
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.connected(conn)
+
+	return c, nil
+}
+
+func (c *Client) dial() (*websocket.Conn, error) {
+	u, err := url.Parse(c.opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+
+	c.mutex.Lock()
+	query := u.Query()
+	if c.opts.Key != "" {
+		query.Set(c.opts.KeyParam, c.opts.Key)
+	}
+	query.Del(c.opts.TopicParam)
+	for _, topic := range c.topics {
+		query.Add(c.opts.TopicParam, topic)
+	}
+	c.mutex.Unlock()
+	u.RawQuery = query.Encode()
+
+	header := http.Header{}
+	for name, values := range c.opts.Header {
+		header[name] = values
+	}
+	if c.opts.Token != "" {
+		header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+
+	conn, _, err := c.opts.Dialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Starts using the connection: flushes the queue and starts reading.
+func (c *Client) connected(conn *websocket.Conn) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		conn.Close()
+		return
+	}
+
+	c.conn = conn
+	queue := c.queue
+	c.queue = nil
+	for i, message := range queue {
+		if err := conn.WriteMessage(message.messageType, message.data); err != nil {
+			c.logger.Debug("Failed to flush queued messages", zap.Error(err))
+			// Kept for the next connection, the reader will notice the connection failed.
+			c.queue = append(queue[i:], c.queue...)
+			break
+		}
+	}
+	c.mutex.Unlock()
+
+	c.logger.Debug("Connected")
+
+	connDone := make(chan struct{})
+	if c.opts.PingInterval > 0 {
+		c.startPinging(conn, connDone)
+	}
+	go c.read(conn, connDone)
+
+	if c.opts.OnConnect != nil {
+		c.opts.OnConnect(c)
+	}
+}
+
+func (c *Client) startPinging(conn *websocket.Conn, connDone chan struct{}) {
+	extendDeadline := func() error {
+		return conn.SetReadDeadline(time.Now().Add(c.opts.PingInterval + c.opts.PongTimeout))
+	}
+
+	extendDeadline()
+	conn.SetPongHandler(func(string) error {
+		return extendDeadline()
+	})
+
+	go func() {
+		ticker := time.NewTicker(c.opts.PingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-connDone:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.opts.PongTimeout)); err != nil {
+					c.logger.Debug("Failed to ping server", zap.Error(err))
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Reads messages until the connection fails, then reconnects.
+func (c *Client) read(conn *websocket.Conn, connDone chan struct{}) {
+	var err error
+	for {
+		var messageType int
+		var data []byte
+		messageType, data, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		c.handlersMutex.RLock()
+		handlers := c.handlers
+		c.handlersMutex.RUnlock()
+		for _, handler := range handlers {
+			handler(messageType, data)
+		}
+	}
+	close(connDone)
+
+	c.mutex.Lock()
+	closed := c.closed
+	c.conn = nil
+	c.mutex.Unlock()
+	conn.Close()
+
+	if closed {
+		return
+	}
+
+	c.logger.Debug("Connection lost", zap.Error(err))
+	if c.opts.OnDisconnect != nil {
+		c.opts.OnDisconnect(err)
+	}
+	c.reconnect()
+}
+
+func (c *Client) reconnect() {
+	for attempt := 0; c.opts.MaxReconnectAttempts == 0 || attempt < c.opts.MaxReconnectAttempts; attempt++ {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(c.opts.Backoff.delay(attempt)):
+		}
+
+		conn, err := c.dial()
+		if err == nil {
+			c.connected(conn)
+			return
+		}
+		c.logger.Debug("Failed to reconnect", zap.Int("Attempt", attempt+1), zap.Error(err))
+
+		if attempt+1 == c.opts.MaxReconnectAttempts {
+			c.Close()
+			if c.opts.OnGiveUp != nil {
+				c.opts.OnGiveUp(err)
+			}
+		}
+	}
+}
+
+// Registers a handler called with every message received, in the order they are received.
+func (c *Client) OnMessage(handler func(messageType int, data []byte)) {
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+
+	c.handlers = append(c.handlers, handler)
+}
+
+// Registers a handler called with the text messages decoded into T.
+// Messages that can't be decoded are passed to onError, if any.
+func HandleJSON[T any](c *Client, handler func(message T), onError func(data []byte, err error)) {
+	c.OnMessage(func(messageType int, data []byte) {
+		if messageType != websocket.TextMessage {
+			return
+		}
+
+		var message T
+		if err := json.Unmarshal(data, &message); err != nil {
+			if onError != nil {
+				onError(data, err)
+			}
+			return
+		}
+		handler(message)
+	})
+}
+
+// Writes the message, or queues it until reconnecting if disconnected.
+func (c *Client) Send(messageType int, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	if c.conn != nil {
+		err := c.conn.WriteMessage(messageType, data)
+		if err == nil {
+			return nil
+		}
+		c.logger.Debug("Failed to send message, queueing it", zap.Error(err))
+	}
+
+	if len(c.queue) >= c.opts.MaxQueuedMessages {
+		return ErrQueueFull
+	}
+	c.queue = append(c.queue, queuedMessage{messageType: messageType, data: data})
+	return nil
+}
+
+func (c *Client) SendText(text string) error {
+	return c.Send(websocket.TextMessage, []byte(text))
+}
+
+// Sends the value encoded as JSON in a text message.
+func (c *Client) SendJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(websocket.TextMessage, data)
+}
+
+// Adds the topics, which take effect the next time the client connects.
+// Use Reconnect to apply them right away.
+func (c *Client) Subscribe(topics ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, topic := range topics {
+		if !contains(c.topics, topic) {
+			c.topics = append(c.topics, topic)
+		}
+	}
+}
+
+// Removes the topics, which takes effect the next time the client connects.
+// Use Reconnect to apply it right away.
+func (c *Client) Unsubscribe(topics ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	remaining := []string{}
+	for _, topic := range c.topics {
+		if !contains(topics, topic) {
+			remaining = append(remaining, topic)
+		}
+	}
+	c.topics = remaining
+}
+
+func (c *Client) GetTopics() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string{}, c.topics...)
+}
+
+func (c *Client) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.conn != nil
+}
+
+// Drops the current connection, so the client reconnects with its current topics.
+func (c *Client) Reconnect() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// Closes the connection and stops reconnecting. Queued messages are discarded.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.queue = nil
+	close(c.done)
+
+	if c.conn == nil {
+		return nil
+	}
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	return c.conn.Close()
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial == 0 {
+		b.Initial = _DEFAULT_BACKOFF_INITIAL
+	}
+	if b.Max == 0 {
+		b.Max = _DEFAULT_BACKOFF_MAX
+	}
+	if b.Multiplier == 0 {
+		b.Multiplier = _DEFAULT_BACKOFF_MULTIPLIER
+	}
+	if b.Jitter == 0 {
+		b.Jitter = _DEFAULT_BACKOFF_JITTER
+	}
+	return b
+}
+
+// Delay before the given reconnection attempt, starting from 0.
+func (b Backoff) delay(attempt int) time.Duration {
+	delay := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempt))
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		jitter := math.Min(b.Jitter, 1)
+		delay -= delay * jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+func contains(slice []string, item string) bool {
+	for _, s := range slice {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package magicsocketsclient_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+	"github.com/problem-company-toolkit/magicsockets/magicsocketsclient"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		ms         magicsockets.MagicSocket
+		httpServer *http.Server
+		// Kept when the server is restarted, so clients reconnect to it.
+		address string
+
+		key      string
+		incoming chan string
+	)
+
+	startServer := func() {
+		ms = magicsockets.New(magicsockets.MagicSocketOpts{
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				if r.Header.Get("Authorization") != "Bearer secret" {
+					return magicsockets.RegisterClientOpts{}, errors.New("unauthorized")
+				}
+				return magicsockets.RegisterClientOpts{
+					Key:    r.URL.Query().Get("key"),
+					Topics: r.URL.Query()["topic"],
+					OnIncoming: func(messageType int, data []byte) error {
+						incoming <- string(data)
+						return nil
+					},
+				}, nil
+			},
+		})
+		handler, err := ms.Handler()
+		Expect(err).ToNot(HaveOccurred())
+
+		// Accepts connections as soon as it returns.
+		listener, err := net.Listen("tcp", address)
+		Expect(err).ToNot(HaveOccurred())
+		address = listener.Addr().String()
+
+		httpServer = &http.Server{Handler: handler}
+		go httpServer.Serve(listener)
+	}
+
+	stopServer := func() {
+		Expect(ms.Stop()).To(Succeed())
+		Expect(httpServer.Close()).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		address = "127.0.0.1:0"
+		key = gofakeit.UUID()
+		incoming = make(chan string, 10)
+		startServer()
+	})
+
+	AfterEach(func() {
+		stopServer()
+	})
+
+	dial := func(opts magicsocketsclient.Opts) *magicsocketsclient.Client {
+		opts.URL = fmt.Sprintf("ws://%s/", address)
+		opts.Token = "secret"
+		opts.Key = key
+		opts.Backoff = magicsocketsclient.Backoff{Initial: time.Millisecond * 20, Max: time.Millisecond * 100}
+
+		c, err := magicsocketsclient.Dial(opts)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(c.Close)
+		return c
+	}
+
+	It("Fails to dial without the token", func() {
+		_, err := magicsocketsclient.Dial(magicsocketsclient.Opts{URL: fmt.Sprintf("ws://%s/", address)})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Sends and receives messages", func() {
+		received := make(chan string, 1)
+		c := dial(magicsocketsclient.Opts{Topics: []string{"news"}})
+		c.OnMessage(func(messageType int, data []byte) {
+			received <- string(data)
+		})
+
+		Expect(c.SendText("hello")).To(Succeed())
+		Eventually(incoming).Should(Receive(Equal("hello")))
+
+		Eventually(func() []string {
+			clients := ms.GetClientsByKey(key)
+			if len(clients) == 0 {
+				return nil
+			}
+			return clients[0].GetTopics()
+		}).Should(Equal([]string{"news"}))
+
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{"news"}}}}, []byte("breaking"))
+		Eventually(received).Should(Receive(Equal("breaking")))
+	})
+
+	It("Decodes JSON messages", func() {
+		type notification struct {
+			Title string `json:"title"`
+		}
+
+		notifications := make(chan notification, 1)
+		invalid := make(chan string, 1)
+		c := dial(magicsocketsclient.Opts{})
+		magicsocketsclient.HandleJSON(c, func(n notification) {
+			notifications <- n
+		}, func(data []byte, err error) {
+			invalid <- string(data)
+		})
+
+		Eventually(func() []magicsockets.ClientConn { return ms.GetClientsByKey(key) }).Should(HaveLen(1))
+		client := ms.GetClientsByKey(key)[0]
+
+		Expect(client.WriteMessage(websocket.TextMessage, []byte(`{"title": "hello"}`))).To(Succeed())
+		Eventually(notifications).Should(Receive(Equal(notification{Title: "hello"})))
+
+		Expect(client.WriteMessage(websocket.TextMessage, []byte(`not json`))).To(Succeed())
+		Eventually(invalid).Should(Receive(Equal("not json")))
+	})
+
+	It("Reconnects with its topics and flushes messages sent while disconnected", func() {
+		connections := make(chan struct{}, 10)
+		disconnected := make(chan error, 1)
+		c := dial(magicsocketsclient.Opts{
+			Topics: []string{"news"},
+			OnConnect: func(c *magicsocketsclient.Client) {
+				connections <- struct{}{}
+			},
+			OnDisconnect: func(err error) {
+				disconnected <- err
+			},
+		})
+		Eventually(connections).Should(Receive())
+		c.Subscribe("sports")
+
+		stopServer()
+		Eventually(disconnected).Should(Receive())
+		Expect(c.IsConnected()).To(BeFalse())
+		Expect(c.SendText("while disconnected")).To(Succeed())
+
+		startServer()
+		Eventually(connections).Should(Receive())
+		Eventually(incoming).Should(Receive(Equal("while disconnected")))
+
+		Eventually(func() []string {
+			clients := ms.GetClientsByKey(key)
+			if len(clients) == 0 {
+				return nil
+			}
+			return clients[0].GetTopics()
+		}).Should(Equal([]string{"news", "sports"}))
+	})
+
+	It("Limits the messages queued while disconnected", func() {
+		disconnected := make(chan error, 1)
+		c := dial(magicsocketsclient.Opts{
+			MaxQueuedMessages: 1,
+			OnDisconnect: func(err error) {
+				disconnected <- err
+			},
+		})
+
+		stopServer()
+		Eventually(disconnected).Should(Receive())
+
+		Expect(c.SendText("first")).To(Succeed())
+		Expect(c.SendText("second")).To(MatchError(magicsocketsclient.ErrQueueFull))
+
+		Expect(c.Close()).To(Succeed())
+		Expect(c.SendText("third")).To(MatchError(magicsocketsclient.ErrClosed))
+	})
+})
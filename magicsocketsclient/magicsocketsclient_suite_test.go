@@ -0,0 +1,15 @@
+package magicsocketsclient_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestMagicsocketsClient(t *testing.T) {
+	RegisterFailHandler(Fail)
+	SetDefaultEventuallyTimeout(3 * time.Second)
+	RunSpecs(t, "Magicsockets Client Suite")
+}
@@ -0,0 +1,135 @@
+// OpenTelemetry instrumentation of MagicSockets, kept out of the core package so only its users depend on OpenTelemetry.
+//
+//	ms := magicsockets.New(magicsockets.MagicSocketOpts{
+//		Tracing: magicsockets.TracingOpts{Tracer: magicsocketsotel.NewTracer(magicsocketsotel.TracerOpts{})},
+//	})
+package magicsocketsotel
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+const (
+	_TRACER_NAME = "github.com/problem-company-toolkit/magicsockets"
+)
+
+type TracerOpts struct {
+	// Defaults to the global TracerProvider, see otel.GetTracerProvider.
+	TracerProvider trace.TracerProvider
+	// Used to read the trace context of handshakes and messages, and to write it into messages.
+	// Defaults to W3C Trace Context.
+	Propagator propagation.TextMapPropagator
+}
+
+// Implements magicsockets.Tracer with OpenTelemetry.
+// Spans are stored in contexts the OpenTelemetry way, so hooks can use trace.SpanFromContext.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func NewTracer(opts TracerOpts) *Tracer {
+	provider := opts.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+
+	propagator := opts.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+
+	return &Tracer{
+		tracer:     provider.Tracer(_TRACER_NAME),
+		propagator: propagator,
+	}
+}
+
+// Wraps an OpenTelemetry span.
+type Span struct {
+	trace.Span
+}
+
+func (t *Tracer) Start(ctx context.Context, name string, opts magicsockets.SpanOpts) (context.Context, magicsockets.Span) {
+	startOpts := []trace.SpanStartOption{trace.WithAttributes(attributes(opts.Attributes)...)}
+	if opts.NewRoot {
+		startOpts = append(startOpts, trace.WithNewRoot())
+	}
+	for _, link := range opts.Links {
+		if span, ok := link.(Span); ok {
+			startOpts = append(startOpts, trace.WithLinks(trace.Link{SpanContext: span.SpanContext()}))
+		}
+	}
+
+	ctx, span := t.tracer.Start(ctx, name, startOpts...)
+	return ctx, Span{Span: span}
+}
+
+// Nil unless ctx carries a valid span context, local or extracted from a carrier.
+func (t *Tracer) SpanFromContext(ctx context.Context) magicsockets.Span {
+	span := trace.SpanFromContext(ctx)
+	if !span.SpanContext().IsValid() {
+		return nil
+	}
+	return Span{Span: span}
+}
+
+func (t *Tracer) ContextWithSpan(ctx context.Context, span magicsockets.Span) context.Context {
+	otelSpan, ok := span.(Span)
+	if !ok {
+		return ctx
+	}
+	return trace.ContextWithSpan(ctx, otelSpan.Span)
+}
+
+func (t *Tracer) Inject(ctx context.Context, carrier magicsockets.TraceCarrier) {
+	t.propagator.Inject(ctx, carrier)
+}
+
+func (t *Tracer) Extract(ctx context.Context, carrier magicsockets.TraceCarrier) context.Context {
+	return t.propagator.Extract(ctx, carrier)
+}
+
+func (s Span) SetAttributes(attrs ...magicsockets.TraceAttribute) {
+	s.Span.SetAttributes(attributes(attrs)...)
+}
+
+func (s Span) AddEvent(name string, attrs ...magicsockets.TraceAttribute) {
+	s.Span.AddEvent(name, trace.WithAttributes(attributes(attrs)...))
+}
+
+func (s Span) RecordError(err error) {
+	s.Span.RecordError(err)
+	s.Span.SetStatus(codes.Error, err.Error())
+}
+
+func (s Span) End() {
+	s.Span.End()
+}
+
+func attributes(attrs []magicsockets.TraceAttribute) []attribute.KeyValue {
+	keyValues := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		key := attribute.Key(attr.Key)
+		switch value := attr.Value.(type) {
+		case string:
+			keyValues = append(keyValues, key.String(value))
+		case int:
+			keyValues = append(keyValues, key.Int(value))
+		case bool:
+			keyValues = append(keyValues, key.Bool(value))
+		default:
+			keyValues = append(keyValues, key.String(fmt.Sprint(value)))
+		}
+	}
+	return keyValues
+}
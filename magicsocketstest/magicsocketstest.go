@@ -0,0 +1,291 @@
+// Utilities to test code using MagicSockets, without listening on a fixed port or sleeping until the server is ready.
+//
+//	server := magicsocketstest.NewServer(t, magicsockets.MagicSocketOpts{})
+//	client := server.Connect(magicsocketstest.ConnectOpts{})
+//	server.WaitForClients(1, time.Second)
+//
+//	server.MagicSocket.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{}}}, []byte("hello"))
+//	magicsocketstest.ExpectReceived(client, "hello", time.Second)
+package magicsocketstest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+// Subset of testing.TB, so that *testing.T and GinkgoT() can be used.
+type TB interface {
+	Helper()
+	Fatalf(format string, args ...any)
+	Cleanup(func())
+}
+
+// MagicSocket served by an httptest.Server, which is listening by the time NewServer returns.
+type Server struct {
+	MagicSocket magicsockets.MagicSocket
+	// ws:// URL of the server.
+	URL string
+
+	t          TB
+	httpServer *httptest.Server
+
+	mutex   *sync.Mutex
+	clients int
+	// Closed and replaced whenever the amount of clients changes.
+	changed chan struct{}
+}
+
+// Received message.
+type Frame struct {
+	MessageType int
+	Data        []byte
+}
+
+// Websocket connection recording the messages it receives.
+type Client struct {
+	Conn *websocket.Conn
+
+	t TB
+
+	mutex  *sync.Mutex
+	frames []Frame
+	// Closed and replaced whenever a message is received.
+	received chan struct{}
+	// Error that stopped reading, once the connection is closed.
+	err error
+}
+
+type ConnectOpts struct {
+	// Path and query of the handshake, e.g. "/?key=user-1".
+	Path   string
+	Header http.Header
+}
+
+// Starts the server, which is stopped when the test ends.
+func NewServer(t TB, opts magicsockets.MagicSocketOpts) *Server {
+	t.Helper()
+
+	s := &Server{
+		t:       t,
+		mutex:   &sync.Mutex{},
+		changed: make(chan struct{}),
+	}
+
+	onClientConnected := opts.OnClientConnected
+	opts.OnClientConnected = func(client magicsockets.ClientConn) {
+		s.updateClients(1)
+		if onClientConnected != nil {
+			onClientConnected(client)
+		}
+	}
+	onClientDisconnected := opts.OnClientDisconnected
+	opts.OnClientDisconnected = func(client magicsockets.ClientConn, reason magicsockets.DisconnectReason) {
+		s.updateClients(-1)
+		if onClientDisconnected != nil {
+			onClientDisconnected(client, reason)
+		}
+	}
+
+	s.MagicSocket = magicsockets.New(opts)
+	handler, err := s.MagicSocket.Handler()
+	if err != nil {
+		t.Fatalf("failed to create MagicSocket handler: %s", err)
+	}
+
+	s.httpServer = httptest.NewServer(handler)
+	s.URL = "ws" + strings.TrimPrefix(s.httpServer.URL, "http")
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *Server) updateClients(delta int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.clients += delta
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Address of the server, as host:port.
+func (s *Server) Address() string {
+	return s.httpServer.Listener.Addr().String()
+}
+
+// Stops the MagicSocket and the httptest.Server. Called when the test ends.
+func (s *Server) Close() {
+	s.MagicSocket.Stop()
+	s.httpServer.Close()
+}
+
+// Connects a client, failing the test if the handshake fails.
+func (s *Server) Connect(opts ConnectOpts) *Client {
+	s.t.Helper()
+
+	client, err := s.Dial(opts)
+	if err != nil {
+		s.t.Fatalf("failed to connect to MagicSocket: %s", err)
+	}
+	return client
+}
+
+// Connects a client. The client is closed when the test ends.
+func (s *Server) Dial(opts ConnectOpts) (*Client, error) {
+	path := opts.Path
+	if path == "" {
+		path = "/"
+	}
+
+	conn, res, err := websocket.DefaultDialer.Dial(s.URL+path, opts.Header)
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("%w: %s", err, res.Status)
+		}
+		return nil, err
+	}
+
+	c := &Client{
+		Conn:     conn,
+		t:        s.t,
+		mutex:    &sync.Mutex{},
+		received: make(chan struct{}),
+	}
+	go c.read()
+	s.t.Cleanup(func() {
+		c.Close()
+	})
+
+	return c, nil
+}
+
+// Waits until exactly n clients are connected, failing the test after the timeout.
+func (s *Server) WaitForClients(n int, timeout time.Duration) {
+	s.t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		s.mutex.Lock()
+		clients, changed := s.clients, s.changed
+		s.mutex.Unlock()
+
+		if clients == n {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			s.t.Fatalf("expected %d connected clients, got %d after %s", n, clients, timeout)
+			return
+		}
+	}
+}
+
+func (c *Client) read() {
+	for {
+		messageType, data, err := c.Conn.ReadMessage()
+
+		c.mutex.Lock()
+		if err != nil {
+			c.err = err
+		} else {
+			c.frames = append(c.frames, Frame{MessageType: messageType, Data: data})
+		}
+		close(c.received)
+		c.received = make(chan struct{})
+		c.mutex.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Messages received so far.
+func (c *Client) Frames() []Frame {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]Frame{}, c.frames...)
+}
+
+func (c *Client) SendText(text string) error {
+	return c.Conn.WriteMessage(websocket.TextMessage, []byte(text))
+}
+
+func (c *Client) Close() error {
+	return c.Conn.Close()
+}
+
+// Waits until the client has received the message, returning an error after the timeout.
+func (c *Client) WaitForMessage(message string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		c.mutex.Lock()
+		frames, received, err := c.frames, c.received, c.err
+		c.mutex.Unlock()
+
+		for _, frame := range frames {
+			if string(frame.Data) == message {
+				return nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("connection closed before receiving %q: %w", message, err)
+		}
+
+		select {
+		case <-received:
+		case <-deadline:
+			return fmt.Errorf("didn't receive %q after %s, received %d other messages", message, timeout, len(frames))
+		}
+	}
+}
+
+// Waits until the connection is closed, returning the close error, or an error after the timeout.
+func (c *Client) WaitForClose(timeout time.Duration) (*websocket.CloseError, error) {
+	deadline := time.After(timeout)
+	for {
+		c.mutex.Lock()
+		received, err := c.received, c.err
+		c.mutex.Unlock()
+
+		if err != nil {
+			closeErr, _ := err.(*websocket.CloseError)
+			return closeErr, nil
+		}
+
+		select {
+		case <-received:
+		case <-deadline:
+			return nil, fmt.Errorf("connection still open after %s", timeout)
+		}
+	}
+}
+
+// Fails the test if the client doesn't receive the message before the timeout.
+func ExpectReceived(client *Client, message string, timeout time.Duration) {
+	client.t.Helper()
+
+	if err := client.WaitForMessage(message, timeout); err != nil {
+		client.t.Fatalf("%s", err)
+	}
+}
+
+// Fails the test if the client receives the message before the timeout.
+func ExpectNotReceived(client *Client, message string, timeout time.Duration) {
+	client.t.Helper()
+
+	if err := client.WaitForMessage(message, timeout); err == nil {
+		client.t.Fatalf("unexpectedly received %q", message)
+	}
+}
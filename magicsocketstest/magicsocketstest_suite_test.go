@@ -0,0 +1,13 @@
+package magicsocketstest_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestMagicsocketstest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Magicsocketstest Suite")
+}
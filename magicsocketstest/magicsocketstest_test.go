@@ -0,0 +1,66 @@
+package magicsocketstest_test
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+	"github.com/problem-company-toolkit/magicsockets/magicsocketstest"
+)
+
+var _ = Describe("Server", func() {
+	var (
+		server *magicsocketstest.Server
+	)
+
+	BeforeEach(func() {
+		server = magicsocketstest.NewServer(GinkgoT(), magicsockets.MagicSocketOpts{
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				if r.URL.Query().Get("key") == "" {
+					return magicsockets.RegisterClientOpts{}, errors.New("missing key")
+				}
+				return magicsockets.RegisterClientOpts{
+					Key:    r.URL.Query().Get("key"),
+					Topics: r.URL.Query()["topic"],
+				}, nil
+			},
+		})
+	})
+
+	It("Waits for clients and records the messages they receive", func() {
+		news := server.Connect(magicsocketstest.ConnectOpts{Path: "/?key=first&topic=news"})
+		sports := server.Connect(magicsocketstest.ConnectOpts{Path: "/?key=second&topic=sports"})
+		server.WaitForClients(2, time.Second)
+
+		server.MagicSocket.Emit(magicsockets.EmitOpts{
+			Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{"news"}}},
+		}, []byte("breaking"))
+
+		magicsocketstest.ExpectReceived(news, "breaking", time.Second)
+		magicsocketstest.ExpectNotReceived(sports, "breaking", time.Millisecond*50)
+		Expect(news.Frames()).To(HaveLen(1))
+
+		Expect(news.Close()).To(Succeed())
+		server.WaitForClients(1, time.Second)
+	})
+
+	It("Reports failed handshakes", func() {
+		_, err := server.Dial(magicsocketstest.ConnectOpts{})
+		Expect(err).To(MatchError(ContainSubstring("400")))
+	})
+
+	It("Reports closed connections", func() {
+		client := server.Connect(magicsocketstest.ConnectOpts{Path: "/?key=first"})
+		server.WaitForClients(1, time.Second)
+
+		Expect(server.MagicSocket.GetClientsByKey("first")[0].Close()).To(Succeed())
+		_, err := client.WaitForClose(time.Second)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(client.WaitForMessage("never sent", time.Second)).To(MatchError(ContainSubstring("connection closed")))
+	})
+})
@@ -1,11 +1,13 @@
 package magicsockets
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,31 +22,72 @@ type (
 
 type MagicSocket interface {
 	Emit(opts EmitOpts, message []byte)
+	// Like Emit, but stops writing once ctx is done, and bounds each write by its deadline.
+	// Returns the error of ctx if not every client was written to, or the error of the Broker.
+	EmitContext(ctx context.Context, opts EmitOpts, message []byte) error
 
+	// Returns the clients indexed by their key.
+	// When keys are shared, only one of the connections of each key is included.
 	GetClients() map[string]ClientConn
 
+	// Returns every client connected with the given key.
+	GetClientsByKey(key string) []ClientConn
+
+	// Looks up a client connected to any instance of the cluster.
+	// Clients connected to other instances are proxies that forward operations through the Broker.
+	// Without a Registry, only clients connected to this instance are found.
+	LookupClient(clientID string) (ClientConn, error)
+
+	// Returns every client connected with the given key to any instance of the cluster.
+	// Without a Registry, only clients connected to this instance are found.
+	LookupClientsByKey(key string) ([]ClientConn, error)
+
 	SetOnConnect(onConnectFunc)
 
+	// Returns an http.Handler to inspect and manage clients. See AdminOpts.
+	AdminHandler(opts AdminOpts) http.Handler
+
+	// Serves the websocket handshakes, to serve the MagicSocket from your own http.Server instead of calling Start.
+	// Subscribes to the Broker, if any.
+	Handler() (http.Handler, error)
+	// Serves Socket.IO clients. See SocketIOOpts.
+	SocketIOHandler(opts SocketIOOpts) (http.Handler, error)
+	// Serves STOMP clients. See STOMPOpts.
+	STOMPHandler(opts STOMPOpts) (http.Handler, error)
+	// Serves GraphQL operations over graphql-transport-ws. See GraphQLOpts.
+	GraphQLHandler(opts GraphQLOpts) (http.Handler, error)
+	// Serve clients that can't use websockets, registering them like the others. See SSEOpts and LongPollingOpts.
+	SSEHandler(opts SSEOpts) (http.Handler, error)
+	LongPollingHandler(opts LongPollingOpts) (http.Handler, error)
+
+	// Blocks as long as the server is listening.
 	Start() error
+	// Like Start, but stops the server once ctx is done.
+	Run(ctx context.Context) error
 
-	// No-op if hasn't been started yet.
+	// Disconnects every client, and closes the server if it was started.
 	Stop() error
 
 	GetPort() int
 }
 
 type magicSocket struct {
+	id     string
 	logger *zap.Logger
 	mutex  *sync.Mutex
 
 	isRunning bool
 
-	connections map[string]*websocket.Conn
-	clients     map[string]*client
+	// Read without holding the server mutex, changed while holding it.
+	clients *clientRegistry
+
+	keyConflictPolicy    KeyConflictPolicy
+	onKeyConflict        func(KeyConflict)
+	maxConnectionsPerKey int
 
-	// Key is the Client Key, which is mutable.
-	// Value is Client ID, which should be immutable ever since it is created.
-	clientKeys map[string]string
+	admission AdmissionLimit
+	// Handshakes in progress, only counted with AdmissionLimit.MaxConcurrentHandshakes.
+	handshakes *atomic.Int64
 
 	onConnect onConnectFunc
 
@@ -52,6 +95,39 @@ type magicSocket struct {
 
 	server *http.Server
 	port   int
+
+	tlsCertFile string
+	tlsKeyFile  string
+	transport   Transport
+
+	heartbeat Heartbeat
+
+	broker            Broker
+	unsubscribeBroker func()
+
+	registry             Registry
+	remoteCommandTimeout time.Duration
+	pendingCommandsMutex *sync.Mutex
+	// Key is the Command ID.
+	pendingCommands map[string]chan ClientCommandReply
+
+	rateLimit RateLimit
+
+	outboundLimit  OutboundLimit
+	onSlowConsumer func(client ClientConn, policy SlowConsumerPolicy)
+
+	namespace string
+	// No-op when nil.
+	metrics *Metrics
+
+	tracing *tracing
+
+	hooks       serverHooks
+	clientHooks ClientHooks
+	// Nil when events aren't routed for every client.
+	events *EventRouter
+	// Run once the server mutex is released.
+	queuedHooks []func()
 }
 
 type MagicSocketOpts struct {
@@ -61,6 +137,97 @@ type MagicSocketOpts struct {
 	LoggerOpts LoggerOpts
 
 	GracePeriod time.Duration
+
+	// Serves over TLS when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Decides whether to accept a handshake from the Origin in its headers.
+	// Defaults to accepting any origin.
+	CheckOrigin func(r *http.Request) bool
+
+	// Settings of the websocket handshake and connections.
+	Upgrader UpgraderOpts
+	// Establishes the connections of clients.
+	// Defaults to a WebsocketTransport configured by Upgrader and CheckOrigin, which are ignored otherwise.
+	Transport Transport
+
+	// Pings clients to detect dead connections. Disabled by default.
+	Heartbeat Heartbeat
+
+	// What to do when a connection registers, or a client updates to, a key already in use.
+	// Defaults to KeyConflictAllow.
+	KeyConflictPolicy KeyConflictPolicy
+	// Lets connections share a key, overriding KeyConflictPolicy with KeyConflictAllow.
+	//
+	// Deprecated: sharing keys is the default, use KeyConflictPolicy to change it.
+	AllowSharedKeys bool
+	// Called after a key conflict has been resolved according to KeyConflictPolicy.
+	OnKeyConflict func(KeyConflict)
+	// Maximum amount of connections sharing the same key when using KeyConflictAllow.
+	// Zero means no limit.
+	MaxConnectionsPerKey int
+	// Limits the connections, and the handshakes in progress, the server accepts.
+	AdmissionLimit AdmissionLimit
+
+	// Distributes emitted messages to other MagicSocket instances.
+	// When nil, Emit only reaches clients connected to this instance.
+	Broker Broker
+
+	// Keeps track of the clients connected to every instance.
+	Registry Registry
+	// How long to wait for another instance to apply an operation on one of its clients.
+	RemoteCommandTimeout time.Duration
+
+	// Limits the messages each client can send.
+	// Can be overridden per client with RegisterClientOpts.RateLimit.
+	RateLimit RateLimit
+
+	// Limits the emitted messages waiting to be written to each client.
+	// Can be overridden per client with RegisterClientOpts.OutboundLimit.
+	OutboundLimit OutboundLimit
+	// Called whenever a client exceeds its outbound limits.
+	OnSlowConsumer func(client ClientConn, policy SlowConsumerPolicy)
+
+	// Identifies this server in metrics. Defaults to "default".
+	Namespace string
+	// Collects metrics of the server. Can be shared between servers with different namespaces.
+	Metrics *Metrics
+
+	// OpenTelemetry instrumentation of handshakes, emits and hooks.
+	Tracing TracingOpts
+
+	// Server-wide hooks, called for every client.
+	// They run after the server has been updated, and may call back into it.
+	OnClientConnected    func(client ClientConn)
+	OnClientDisconnected func(client ClientConn, reason DisconnectReason)
+	OnKeyChanged         func(client ClientConn, oldKey string, newKey string)
+	OnTopicsChanged      func(client ClientConn, oldTopics []string, newTopics []string)
+	// Called when OnConnect returns an error, or the connection can't be registered.
+	OnHandshakeRejected func(r *http.Request, err error)
+	// Called when a handshake exceeds AdmissionLimit or MaxConnectionsPerKey, before OnHandshakeRejected.
+	OnAdmissionRejected func(rejection AdmissionRejection)
+	// Called after a message was emitted, with the clients matching the rules of this instance.
+	OnEmit func(opts EmitOpts, message []byte, targets []ClientConn)
+
+	// Default client hooks, used for clients registered without the corresponding hook.
+	ClientHooks ClientHooks
+
+	// Routes the incoming messages of every client by event name, after the OnIncoming hook.
+	Events *EventRouter
+}
+
+type UpgraderOpts struct {
+	// Default to _DEFAULT_BUFFER_SIZE.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// No timeout when zero.
+	HandshakeTimeout time.Duration
+	// Negotiates per message compression with clients supporting it.
+	EnableCompression bool
+	// Subprotocols supported by the server, in order of preference.
+	Subprotocols []string
 }
 
 type LoggerOpts struct {
@@ -76,6 +243,8 @@ const (
 
 const (
 	_DEFAULT_GRACE_PERIOD = time.Second * 4
+	_DEFAULT_NAMESPACE    = "default"
+	_DEFAULT_BUFFER_SIZE  = 1024
 )
 
 func New(opts MagicSocketOpts) MagicSocket {
@@ -153,8 +322,9 @@ func New(opts MagicSocketOpts) MagicSocket {
 			panic(fmt.Errorf("failed to build logger configurations for magicsockets: %s", err.Error()))
 		}
 	}
+	id := uuid.NewString()
 	logger = logger.With(
-		zap.String("MagicSocket ID", uuid.NewString()),
+		zap.String("MagicSocket ID", id),
 	)
 
 	gracePeriod := opts.GracePeriod
@@ -162,18 +332,98 @@ func New(opts MagicSocketOpts) MagicSocket {
 		gracePeriod = _DEFAULT_GRACE_PERIOD
 	}
 
+	namespace := opts.Namespace
+	if namespace == "" {
+		namespace = _DEFAULT_NAMESPACE
+	}
+
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = func(r *http.Request) bool {
+			return true // Allow any origin
+		}
+	}
+
+	readBufferSize := opts.Upgrader.ReadBufferSize
+	if readBufferSize == 0 {
+		readBufferSize = _DEFAULT_BUFFER_SIZE
+	}
+	writeBufferSize := opts.Upgrader.WriteBufferSize
+	if writeBufferSize == 0 {
+		writeBufferSize = _DEFAULT_BUFFER_SIZE
+	}
+
+	transport := opts.Transport
+	if transport == nil {
+		transport = &WebsocketTransport{
+			Upgrader: websocket.Upgrader{
+				ReadBufferSize:    readBufferSize,
+				WriteBufferSize:   writeBufferSize,
+				HandshakeTimeout:  opts.Upgrader.HandshakeTimeout,
+				EnableCompression: opts.Upgrader.EnableCompression,
+				Subprotocols:      opts.Upgrader.Subprotocols,
+				CheckOrigin:       checkOrigin,
+			},
+		}
+	}
+
+	remoteCommandTimeout := opts.RemoteCommandTimeout
+	if remoteCommandTimeout == 0 {
+		remoteCommandTimeout = _DEFAULT_REMOTE_COMMAND_TIMEOUT
+	}
+
 	return &magicSocket{
+		id:      id,
 		mutex:   &sync.Mutex{},
 		logger:  logger,
-		clients: make(map[string]*client),
+		clients: newClientRegistry(),
+
+		keyConflictPolicy:    opts.keyConflictPolicy(),
+		onKeyConflict:        opts.OnKeyConflict,
+		maxConnectionsPerKey: opts.MaxConnectionsPerKey,
 
-		clientKeys: make(map[string]string),
+		admission:  opts.AdmissionLimit,
+		handshakes: &atomic.Int64{},
 
 		gracePeriod: gracePeriod,
 
-		connections: make(map[string]*websocket.Conn),
-		onConnect:   opts.OnConnect,
-		port:        opts.Port,
+		onConnect: opts.OnConnect,
+		port:      opts.Port,
+
+		tlsCertFile: opts.TLSCertFile,
+		tlsKeyFile:  opts.TLSKeyFile,
+		transport:   transport,
+
+		heartbeat: opts.Heartbeat,
+
+		broker: opts.Broker,
+
+		registry:             opts.Registry,
+		remoteCommandTimeout: remoteCommandTimeout,
+		pendingCommandsMutex: &sync.Mutex{},
+		pendingCommands:      make(map[string]chan ClientCommandReply),
+
+		rateLimit: opts.RateLimit,
+
+		outboundLimit:  opts.OutboundLimit,
+		onSlowConsumer: opts.OnSlowConsumer,
+
+		namespace: namespace,
+		metrics:   opts.Metrics,
+
+		tracing: newTracing(opts.Tracing),
+
+		clientHooks: opts.ClientHooks,
+		events:      opts.Events,
+		hooks: serverHooks{
+			onClientConnected:    opts.OnClientConnected,
+			onClientDisconnected: opts.OnClientDisconnected,
+			onKeyChanged:         opts.OnKeyChanged,
+			onTopicsChanged:      opts.OnTopicsChanged,
+			onHandshakeRejected:  opts.OnHandshakeRejected,
+			onAdmissionRejected:  opts.OnAdmissionRejected,
+			onEmit:               opts.OnEmit,
+		},
 	}
 }
 
@@ -186,30 +436,31 @@ func (ms *magicSocket) GetPort() int {
 }
 
 func (ms *magicSocket) GetClients() map[string]ClientConn {
-	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
-
 	clients := make(map[string]ClientConn)
-	for _, v := range ms.clients {
-		clients[v.key] = v
+	for _, v := range ms.clients.all() {
+		clients[v.GetKey()] = v
+	}
+	return clients
+}
+
+func (ms *magicSocket) GetClientsByKey(key string) []ClientConn {
+	clients := []ClientConn{}
+	for _, client := range ms.clients.byKey(key) {
+		clients = append(clients, client)
 	}
 	return clients
 }
 
 func (ms *magicSocket) startIncomingMessagesChannel(clientID string, opts RegisterClientOpts) {
-	// Make sure the client won't be updated while we're getting its reference.
-	client := func() *client {
-		ms.mutex.Lock()
-		defer ms.mutex.Unlock()
-		return ms.clients[clientID]
-	}()
+	client, _ := ms.clients.get(clientID)
 
 	logger := ms.logger.With(zap.String("Client ID", clientID))
 
+	reason := DisconnectConnectionLost
 	defer func() {
 		recover()
 		if client != nil {
-			client.Close()
+			client.closeFor(reason)
 		}
 	}()
 
@@ -219,50 +470,234 @@ func (ms *magicSocket) startIncomingMessagesChannel(clientID string, opts Regist
 		logger.Debug("Received incoming message", zap.String("Message", string(message)))
 		if err != nil {
 			logger.Error("Error receiving message", zap.Error(err))
+			// Protocols may have heartbeats of their own.
+			if (ms.heartbeat.enabled() || client.protocol != nil) && isHeartbeatTimeout(err) {
+				reason = DisconnectHeartbeatTimeout
+			}
+
+			break
+		}
+		ms.metrics.messageReceived(ms.namespace, len(message))
 
+		process, stop := client.applyRateLimit(messageType, message)
+		if stop {
 			break
 		}
+		if !process {
+			continue
+		}
+
+		if client.protocol != nil {
+			incoming, err := client.protocol.decode(messageType, message)
+			if err != nil {
+				logger.Error("Failed to decode incoming message", zap.Error(err))
+				continue
+			}
+			if incoming == nil {
+				continue
+			}
+			messageType, message = incoming.messageType, incoming.data
+		}
+
+		if client.onIncoming != nil || client.events != nil || ms.events != nil {
+			message, linked := ms.tracing.unwrap(message)
+			spanOpts := SpanOpts{
+				Attributes: []TraceAttribute{
+					_ATTRIBUTE_NAMESPACE.String(ms.namespace),
+					_ATTRIBUTE_CLIENT_ID.String(clientID),
+					_ATTRIBUTE_MESSAGE_TYPE.Int(messageType),
+					_ATTRIBUTE_MESSAGE_SIZE.Int(len(message)),
+				},
+			}
+			// Links the reply of a client to the emit that caused it.
+			if linked != nil {
+				spanOpts.Links = []Span{linked}
+			}
+			_, span := ms.tracing.tracer.Start(context.Background(), _SPAN_ON_INCOMING, spanOpts)
 
-		if client.onIncoming != nil {
-			if err := client.onIncoming(messageType, message); err != nil {
-				logger.Error("client onIncoming error", zap.Error(err))
+			ctx := ms.tracing.tracer.ContextWithSpan(client.ctx, span)
+
+			var err error
+			if client.onIncoming != nil {
+				err = client.onIncoming(ctx, client, messageType, message)
+				if err != nil {
+					logger.Error("client onIncoming error", zap.Error(err))
+					ms.metrics.hookFailed(ms.namespace, "on_incoming")
+				}
+			}
+			if err == nil && (client.events != nil || ms.events != nil) {
+				err = ms.routeEvent(ctx, client, message)
+				if err != nil {
+					logger.Error("Failed to handle event", zap.Error(err))
+					ms.metrics.hookFailed(ms.namespace, "on_event")
+				}
 			}
+			endSpan(span, err)
 		}
 	}
 
 	logger.Debug("Terminating listening")
 }
 
+func (ms *magicSocket) Handler() (http.Handler, error) {
+	if err := ms.subscribeBroker(); err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(ms.handleHandshake), nil
+}
+
+// No-op if already subscribed.
+func (ms *magicSocket) subscribeBroker() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.broker == nil || ms.unsubscribeBroker != nil {
+		return nil
+	}
+
+	unsubscribe, err := ms.broker.Subscribe(ms.handleBrokerMessage)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to broker: %w", err)
+	}
+	ms.unsubscribeBroker = unsubscribe
+	return nil
+}
+
+func (ms *magicSocket) handleHandshake(w http.ResponseWriter, r *http.Request) {
+	ms.handshake(w, r, ms.transport.Upgrade, nil)
+}
+
+// newProtocol is nil for clients exchanging messages as they are.
+func (ms *magicSocket) handshake(w http.ResponseWriter, r *http.Request, upgrade upgradeFunc, newProtocol newClientProtocol) {
+	ms.handshakeWith(w, r, ms.onConnect, upgrade, newProtocol)
+}
+
+// Like handshake, but registers the client through onConnect instead of the OnConnect of the server.
+func (ms *magicSocket) handshakeWith(
+	w http.ResponseWriter,
+	r *http.Request,
+	onConnect onConnectFunc,
+	upgrade upgradeFunc,
+	newProtocol newClientProtocol,
+) {
+	if !ms.startHandshake() {
+		ms.refuseHandshake(w, r, "", ms.admission.remoteIP(r), ErrTooManyHandshakes)
+		ms.metrics.handshakeRejected(ms.namespace)
+		if ms.hooks.onHandshakeRejected != nil {
+			ms.hooks.onHandshakeRejected(r, ErrTooManyHandshakes)
+		}
+		return
+	}
+	defer ms.endHandshake()
+
+	// Refused before OnConnect, which may be expensive, e.g. authenticating the client.
+	remoteIP := ms.admission.remoteIP(r)
+	if err := ms.checkAdmission(remoteIP); err != nil {
+		ms.refuseHandshake(w, r, "", remoteIP, err)
+		ms.metrics.handshakeRejected(ms.namespace)
+		if ms.hooks.onHandshakeRejected != nil {
+			ms.hooks.onHandshakeRejected(r, err)
+		}
+		return
+	}
+
+	ctx := ms.tracing.extractRequest(r)
+	ctx, span := ms.tracing.start(ctx, _SPAN_HANDSHAKE, _ATTRIBUTE_NAMESPACE.String(ms.namespace))
+	r = r.WithContext(ctx)
+
+	opts := RegisterClientOpts{
+		Key: uuid.NewString(),
+	}
+	if onConnect != nil {
+		_, onConnectSpan := ms.tracing.start(ctx, _SPAN_ON_CONNECT)
+		var err error
+		opts, err = onConnect(r)
+		endSpan(onConnectSpan, err)
+		if err != nil {
+			ms.metrics.handshakeRejected(ms.namespace)
+			if ms.hooks.onHandshakeRejected != nil {
+				ms.hooks.onHandshakeRejected(r, err)
+			}
+			endSpan(span, err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	span.SetAttributes(_ATTRIBUTE_CLIENT_KEY.String(opts.Key))
+	err := ms.registerClient(w, r, opts, upgrade, newProtocol)
+	if err != nil {
+		ms.metrics.handshakeRejected(ms.namespace)
+		ms.logger.Error("Failed to register client", zap.Error(err))
+		if ms.hooks.onHandshakeRejected != nil {
+			ms.hooks.onHandshakeRejected(r, err)
+		}
+	}
+	endSpan(span, err)
+}
+
 // Blocks as long as the server is listening.
 func (ms *magicSocket) Start() error {
-	ms.server = &http.Server{Addr: fmt.Sprintf(":%d", ms.GetPort())}
+	server, err := ms.prepareServer()
+	if err != nil {
+		return err
+	}
+	return ms.serve(server)
+}
 
-	mux := http.NewServeMux() // Create a new ServeMux for each
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if ms.onConnect != nil {
-			opts, err := ms.onConnect(r)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(err.Error()))
-				return
-			}
-			if err := ms.registerClient(w, r, opts); err != nil {
-				ms.logger.Panic(err.Error())
-			}
-		} else {
-			if err := ms.registerClient(w, r, RegisterClientOpts{
-				Key: uuid.NewString(),
-			}); err != nil {
-				ms.logger.Panic(err.Error())
-			}
+// Starts the server, and stops it once ctx is done.
+// Blocks until the server is stopped, returning nil if it was stopped by ctx.
+func (ms *magicSocket) Run(ctx context.Context) error {
+	server, err := ms.prepareServer()
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ms.serve(server)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		if err := ms.Stop(); err != nil {
+			return err
 		}
-	})
-	ms.server.Handler = mux
+		return <-errs
+	}
+}
+
+func (ms *magicSocket) prepareServer() (*http.Server, error) {
+	mux := http.NewServeMux() // Create a new ServeMux for each
+	mux.HandleFunc("/", ms.handleHandshake)
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", ms.GetPort()),
+		Handler: mux,
+	}
 
+	if err := ms.subscribeBroker(); err != nil {
+		return nil, err
+	}
+
+	ms.mutex.Lock()
+	ms.server = server
 	ms.isRunning = true
+	ms.mutex.Unlock()
 
+	return server, nil
+}
+
+func (ms *magicSocket) serve(server *http.Server) error {
 	ms.logger.Info("Starting MagicSocket websockets server", zap.Int("Port", ms.GetPort()))
-	err := ms.server.ListenAndServe()
+	var err error
+	if ms.tlsCertFile != "" && ms.tlsKeyFile != "" {
+		err = server.ListenAndServeTLS(ms.tlsCertFile, ms.tlsKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
 	// We consider this to be a successful exit.
 	if err == http.ErrServerClosed {
 		return nil
@@ -271,7 +706,7 @@ func (ms *magicSocket) Start() error {
 }
 
 func (ms *magicSocket) Stop() error {
-	if ms == nil || ms.server == nil {
+	if ms == nil {
 		return nil
 	}
 	ms.logger.Debug("Closing MagicSockets server and stopping all connections")
@@ -283,14 +718,20 @@ func (ms *magicSocket) Stop() error {
 
 	ms.isRunning = false
 
-	clientsToClose := []*client{}
-	for i := range ms.clients {
-		clientsToClose = append(clientsToClose, ms.clients[i])
+	if ms.unsubscribeBroker != nil {
+		ms.unsubscribeBroker()
+		ms.unsubscribeBroker = nil
 	}
+
+	clientsToClose := ms.clients.all()
+	server := ms.server
 	ms.mutex.Unlock()
 	for i := range clientsToClose {
-		clientsToClose[i].Close()
+		clientsToClose[i].closeFor(DisconnectServerStopped)
 	}
 
-	return ms.server.Close()
+	if server == nil {
+		return nil
+	}
+	return server.Close()
 }
@@ -1,9 +1,7 @@
 package magicsockets_test
 
 import (
-	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
 	"github.com/gorilla/websocket"
@@ -28,18 +26,10 @@ var _ = Describe("Main", func() {
 	)
 
 	BeforeEach(func() {
-		// Very unlikely to be allocated or to conflict in parallel tests.
-		randomPort := gofakeit.IntRange(10000, 30000)
-		address = fmt.Sprintf("0.0.0.0:%d", randomPort)
-		ms = magicsockets.New(magicsockets.MagicSocketOpts{
-			Port: randomPort,
-		})
+		ms, address = startMagicSocket(magicsockets.MagicSocketOpts{})
 
 		key = gofakeit.UUID()
 		topics = []string{gofakeit.BuzzWord(), gofakeit.Adjective(), gofakeit.PetName()}
-
-		go ms.Start()
-		time.Sleep(time.Millisecond * 100)
 	})
 
 	AfterEach(func() {
@@ -263,8 +253,9 @@ var _ = Describe("Main", func() {
 		err = client.UpdateKey(newKey)
 		Expect(err).ShouldNot(HaveOccurred())
 
+		// Not a conflict with itself.
 		err = client.UpdateKey(newKey)
-		Expect(err).Should(HaveOccurred())
+		Expect(err).ShouldNot(HaveOccurred())
 
 		err = client.Close()
 		Expect(err).ShouldNot(HaveOccurred())
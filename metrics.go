@@ -0,0 +1,329 @@
+package magicsockets
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collects metrics of one or more MagicSocket instances,
+// and serves them in the Prometheus text exposition format.
+//
+// Implemented without depending on the Prometheus client library:
+// mount it on any route, e.g. http.Handle("/metrics", metrics).
+type Metrics struct {
+	mutex *sync.Mutex
+
+	activeConnections *metricFamily
+	handshakes        *metricFamily
+	admissions        *metricFamily
+	messagesReceived  *metricFamily
+	messagesSent      *metricFamily
+	bytesReceived     *metricFamily
+	bytesSent         *metricFamily
+	writeErrors       *metricFamily
+	hookErrors        *metricFamily
+	disconnects       *metricFamily
+	emitDuration      *metricFamily
+	emitFanOut        *metricFamily
+}
+
+type metricType string
+
+const (
+	metricCounter   metricType = "counter"
+	metricGauge     metricType = "gauge"
+	metricHistogram metricType = "histogram"
+)
+
+type metricFamily struct {
+	name       string
+	help       string
+	metricType metricType
+	labels     []string
+
+	// Only for histograms.
+	buckets []float64
+
+	// Key is the label values joined by _METRIC_LABEL_SEPARATOR.
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+
+	value float64
+
+	// Only for histograms. Not cumulative, they are summed when written.
+	bucketCounts []uint64
+	count        uint64
+}
+
+const (
+	_METRIC_LABEL_SEPARATOR = "\xff"
+)
+
+var (
+	metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	DefaultEmitDurationBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+	DefaultEmitFanOutBuckets   = []float64{0, 1, 5, 10, 50, 100, 500, 1000, 5000, 10000, 50000}
+)
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		mutex: &sync.Mutex{},
+
+		activeConnections: newMetricFamily("magicsockets_active_connections", "Connected clients.", metricGauge, "namespace"),
+		handshakes:        newMetricFamily("magicsockets_handshakes_total", "Websocket handshakes, by whether they were accepted or rejected.", metricCounter, "namespace", "result"),
+		admissions:        newMetricFamily("magicsockets_admission_rejections_total", "Handshakes rejected by the admission limits, by limit.", metricCounter, "namespace", "limit"),
+		messagesReceived:  newMetricFamily("magicsockets_messages_received_total", "Messages received from clients.", metricCounter, "namespace"),
+		messagesSent:      newMetricFamily("magicsockets_messages_sent_total", "Messages written to clients.", metricCounter, "namespace"),
+		bytesReceived:     newMetricFamily("magicsockets_received_bytes_total", "Bytes received from clients.", metricCounter, "namespace"),
+		bytesSent:         newMetricFamily("magicsockets_sent_bytes_total", "Bytes written to clients.", metricCounter, "namespace"),
+		writeErrors:       newMetricFamily("magicsockets_write_errors_total", "Failed writes to clients.", metricCounter, "namespace"),
+		hookErrors:        newMetricFamily("magicsockets_hook_errors_total", "Errors returned by hooks.", metricCounter, "namespace", "hook"),
+		disconnects:       newMetricFamily("magicsockets_disconnects_total", "Disconnected clients, by reason.", metricCounter, "namespace", "reason"),
+		emitDuration: newHistogramFamily(
+			"magicsockets_emit_duration_seconds", "Time taken to emit a message to the matching clients.",
+			DefaultEmitDurationBuckets, "namespace",
+		),
+		emitFanOut: newHistogramFamily(
+			"magicsockets_emit_fan_out", "Amount of clients matching the rules of an emitted message.",
+			DefaultEmitFanOutBuckets, "namespace",
+		),
+	}
+}
+
+func newMetricFamily(name string, help string, metricType metricType, labels ...string) *metricFamily {
+	return &metricFamily{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		series:     make(map[string]*metricSeries),
+	}
+}
+
+func newHistogramFamily(name string, help string, buckets []float64, labels ...string) *metricFamily {
+	family := newMetricFamily(name, help, metricHistogram, labels...)
+	family.buckets = buckets
+	return family
+}
+
+// Must be called while holding the metrics mutex.
+func (mf *metricFamily) get(labelValues ...string) *metricSeries {
+	key := strings.Join(labelValues, _METRIC_LABEL_SEPARATOR)
+	series, ok := mf.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: labelValues}
+		if mf.metricType == metricHistogram {
+			series.bucketCounts = make([]uint64, len(mf.buckets))
+		}
+		mf.series[key] = series
+	}
+	return series
+}
+
+func (m *Metrics) add(family *metricFamily, value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	family.get(labelValues...).value += value
+}
+
+func (m *Metrics) observe(family *metricFamily, value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	series := family.get(labelValues...)
+	series.value += value
+	series.count++
+	for i, bound := range family.buckets {
+		if value <= bound {
+			series.bucketCounts[i]++
+			break
+		}
+	}
+}
+
+// The methods below are no-ops on a nil *Metrics, so instrumentation doesn't need to check whether it's enabled.
+
+func (m *Metrics) connected(namespace string) {
+	if m == nil {
+		return
+	}
+
+	m.add(m.activeConnections, 1, namespace)
+	m.add(m.handshakes, 1, namespace, "accepted")
+}
+
+func (m *Metrics) handshakeRejected(namespace string) {
+	if m == nil {
+		return
+	}
+
+	m.add(m.handshakes, 1, namespace, "rejected")
+}
+
+// err is one of the errors of AdmissionRejection.
+func (m *Metrics) admissionRejected(namespace string, err error) {
+	if m == nil {
+		return
+	}
+
+	limit := "max_connections_per_key"
+	switch {
+	case errors.Is(err, ErrTooManyConnections):
+		limit = "max_connections"
+	case errors.Is(err, ErrTooManyConnectionsPerIP):
+		limit = "max_connections_per_ip"
+	case errors.Is(err, ErrTooManyHandshakes):
+		limit = "max_concurrent_handshakes"
+	}
+	m.add(m.admissions, 1, namespace, limit)
+}
+
+func (m *Metrics) disconnected(namespace string, reason DisconnectReason) {
+	if m == nil {
+		return
+	}
+
+	m.add(m.activeConnections, -1, namespace)
+	m.add(m.disconnects, 1, namespace, string(reason))
+}
+
+func (m *Metrics) messageReceived(namespace string, size int) {
+	if m == nil {
+		return
+	}
+
+	m.add(m.messagesReceived, 1, namespace)
+	m.add(m.bytesReceived, float64(size), namespace)
+}
+
+func (m *Metrics) messageSent(namespace string, size int) {
+	if m == nil {
+		return
+	}
+
+	m.add(m.messagesSent, 1, namespace)
+	m.add(m.bytesSent, float64(size), namespace)
+}
+
+func (m *Metrics) writeFailed(namespace string) {
+	if m == nil {
+		return
+	}
+
+	m.add(m.writeErrors, 1, namespace)
+}
+
+func (m *Metrics) hookFailed(namespace string, hook string) {
+	if m == nil {
+		return
+	}
+
+	m.add(m.hookErrors, 1, namespace, hook)
+}
+
+func (m *Metrics) emitted(namespace string, duration time.Duration, fanOut int) {
+	if m == nil {
+		return
+	}
+
+	m.observe(m.emitDuration, duration.Seconds(), namespace)
+	m.observe(m.emitFanOut, float64(fanOut), namespace)
+}
+
+// Serves the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(m.String()))
+}
+
+// Metrics in the Prometheus text exposition format.
+func (m *Metrics) String() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	builder := &strings.Builder{}
+	families := []*metricFamily{
+		m.activeConnections,
+		m.handshakes,
+		m.admissions,
+		m.messagesReceived,
+		m.messagesSent,
+		m.bytesReceived,
+		m.bytesSent,
+		m.writeErrors,
+		m.hookErrors,
+		m.disconnects,
+		m.emitDuration,
+		m.emitFanOut,
+	}
+	for _, family := range families {
+		family.write(builder)
+	}
+	return builder.String()
+}
+
+// Must be called while holding the metrics mutex.
+func (mf *metricFamily) write(builder *strings.Builder) {
+	fmt.Fprintf(builder, "# HELP %s %s\n", mf.name, mf.help)
+	fmt.Fprintf(builder, "# TYPE %s %s\n", mf.name, mf.metricType)
+
+	keys := make([]string, 0, len(mf.series))
+	for key := range mf.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := mf.series[key]
+		labels := formatMetricLabels(mf.labels, series.labelValues)
+
+		if mf.metricType != metricHistogram {
+			fmt.Fprintf(builder, "%s%s %s\n", mf.name, labels, formatMetricValue(series.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range mf.buckets {
+			cumulative += series.bucketCounts[i]
+			bucketLabels := formatMetricLabels(
+				append(append([]string{}, mf.labels...), "le"),
+				append(append([]string{}, series.labelValues...), formatMetricValue(bound)),
+			)
+			fmt.Fprintf(builder, "%s_bucket%s %d\n", mf.name, bucketLabels, cumulative)
+		}
+		infLabels := formatMetricLabels(
+			append(append([]string{}, mf.labels...), "le"),
+			append(append([]string{}, series.labelValues...), "+Inf"),
+		)
+		fmt.Fprintf(builder, "%s_bucket%s %d\n", mf.name, infLabels, series.count)
+		fmt.Fprintf(builder, "%s_sum%s %s\n", mf.name, labels, formatMetricValue(series.value))
+		fmt.Fprintf(builder, "%s_count%s %d\n", mf.name, labels, series.count)
+	}
+}
+
+func formatMetricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, metricLabelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,96 @@
+package magicsockets_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Metrics", func() {
+	var (
+		ms      magicsockets.MagicSocket
+		address string
+		metrics *magicsockets.Metrics
+
+		key string
+	)
+
+	BeforeEach(func() {
+		key = gofakeit.UUID()
+		metrics = magicsockets.NewMetrics()
+		ms, address = startMagicSocket(magicsockets.MagicSocketOpts{
+			Namespace: "chat",
+			Metrics:   metrics,
+		})
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		return recorder.Body.String()
+	}
+
+	It("Counts connections, messages and disconnects", func() {
+		incoming := make(chan struct{}, 1)
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key: key,
+				OnIncoming: func(messageType int, data []byte) error {
+					incoming <- struct{}{}
+					return errors.New("failed to process message")
+				},
+			}, nil
+		})
+
+		websocketClientConn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(scrape()).To(ContainSubstring(`magicsockets_active_connections{namespace="chat"} 1`))
+		Expect(scrape()).To(ContainSubstring(`magicsockets_handshakes_total{namespace="chat",result="accepted"} 1`))
+
+		Expect(websocketClientConn.WriteMessage(websocket.TextMessage, []byte("hello"))).To(Succeed())
+		Eventually(incoming).Should(Receive())
+		Eventually(scrape).Should(ContainSubstring(`magicsockets_hook_errors_total{namespace="chat",hook="on_incoming"} 1`))
+		Expect(scrape()).To(ContainSubstring(`magicsockets_messages_received_total{namespace="chat"} 1`))
+		Expect(scrape()).To(ContainSubstring(`magicsockets_received_bytes_total{namespace="chat"} 5`))
+
+		ms.Emit(magicsockets.EmitOpts{
+			Rules: []magicsockets.EmitRule{
+				{
+					OnlyKeys: []string{key},
+				},
+			},
+		}, []byte("hi"))
+		metricsText := scrape()
+		Expect(metricsText).To(ContainSubstring(`magicsockets_messages_sent_total{namespace="chat"} 1`))
+		Expect(metricsText).To(ContainSubstring(`magicsockets_sent_bytes_total{namespace="chat"} 2`))
+		Expect(metricsText).To(ContainSubstring(`magicsockets_emit_fan_out_bucket{namespace="chat",le="1"} 1`))
+		Expect(metricsText).To(ContainSubstring(`magicsockets_emit_duration_seconds_count{namespace="chat"} 1`))
+
+		Expect(websocketClientConn.Close()).To(Succeed())
+		Eventually(scrape).Should(ContainSubstring(`magicsockets_disconnects_total{namespace="chat",reason="connection_lost"} 1`))
+		Expect(scrape()).To(ContainSubstring(`magicsockets_active_connections{namespace="chat"} 0`))
+	})
+
+	It("Counts rejected handshakes", func() {
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{}, errors.New("unauthorized")
+		})
+
+		_, err := newWebsocketClientConn(address)
+		Expect(err).To(HaveOccurred())
+		Expect(scrape()).To(ContainSubstring(`magicsockets_handshakes_total{namespace="chat",result="rejected"} 1`))
+	})
+})
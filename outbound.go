@@ -0,0 +1,322 @@
+package magicsockets
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// Limits the messages waiting to be written to a client that can't keep up.
+// When enabled, Emit queues messages instead of blocking until they are written.
+// Zero values disable the corresponding limit.
+type OutboundLimit struct {
+	MaxQueuedMessages int
+	MaxQueuedBytes    int
+
+	// What to do when the limits are exceeded. Defaults to SlowConsumerDropNewest.
+	Policy SlowConsumerPolicy
+
+	// Used by SlowConsumerCoalesce. Queued messages with the same coalesce key are replaced by newer ones.
+	// When nil, the newer message replaces the whole queue.
+	CoalesceKey func(messageType int, data []byte) string
+}
+
+type SlowConsumerPolicy int
+
+const (
+	// Discards the message being emitted.
+	SlowConsumerDropNewest SlowConsumerPolicy = iota
+	// Discards the oldest queued messages until the new one fits.
+	SlowConsumerDropOldest
+	// Replaces queued messages with the same OutboundLimit.CoalesceKey by the new one.
+	SlowConsumerCoalesce
+	// Closes the connection with CloseSlowConsumer.
+	SlowConsumerDisconnect
+)
+
+// Close code sent to connections closed by SlowConsumerDisconnect.
+const CloseSlowConsumer = 4001
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case SlowConsumerDropNewest:
+		return "drop_newest"
+	case SlowConsumerDropOldest:
+		return "drop_oldest"
+	case SlowConsumerCoalesce:
+		return "coalesce"
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+func (ol OutboundLimit) enabled() bool {
+	return ol.MaxQueuedMessages > 0 || ol.MaxQueuedBytes > 0
+}
+
+type outboundMessage struct {
+	// Values of the emit the message belongs to, never cancelled: only queuing it is bounded by the emit.
+	ctx context.Context
+
+	messageType int
+	data        []byte
+	// Shared by the clients the message is emitted to. Nil if not prepared.
+	prepared *websocket.PreparedMessage
+	logger   *zap.Logger
+}
+
+// Messages waiting to be written to a client by its writer goroutine.
+type outboundQueue struct {
+	mutex *sync.Mutex
+	cond  *sync.Cond
+
+	limit OutboundLimit
+
+	messages []outboundMessage
+	bytes    int
+
+	closed bool
+}
+
+// Returns nil if the limit is disabled.
+func newOutboundQueue(limit OutboundLimit) *outboundQueue {
+	if !limit.enabled() {
+		return nil
+	}
+
+	mutex := &sync.Mutex{}
+	return &outboundQueue{
+		mutex: mutex,
+		cond:  sync.NewCond(mutex),
+		limit: limit,
+	}
+}
+
+// Must be called while holding the queue mutex.
+func (q *outboundQueue) fits(size int) bool {
+	if q.limit.MaxQueuedMessages > 0 && len(q.messages)+1 > q.limit.MaxQueuedMessages {
+		return false
+	}
+	if q.limit.MaxQueuedBytes > 0 && q.bytes+size > q.limit.MaxQueuedBytes {
+		return false
+	}
+	return true
+}
+
+// Must be called while holding the queue mutex.
+func (q *outboundQueue) dropOldest() {
+	q.bytes -= len(q.messages[0].data)
+	q.messages = q.messages[1:]
+}
+
+// Queues the message, applying the policy if the limits are exceeded.
+// Returns the amount of messages dropped, and whether the limits were exceeded.
+// With SlowConsumerDisconnect nothing is dropped, it's up to the caller to disconnect the client.
+func (q *outboundQueue) push(message outboundMessage) (dropped int, exceeded bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return 1, false
+	}
+
+	size := len(message.data)
+	if q.fits(size) {
+		q.messages = append(q.messages, message)
+		q.bytes += size
+		q.cond.Signal()
+		return 0, false
+	}
+
+	switch q.limit.Policy {
+	case SlowConsumerDisconnect:
+		return 0, true
+	case SlowConsumerCoalesce:
+		if q.limit.CoalesceKey == nil {
+			dropped = len(q.messages)
+			q.messages = nil
+			q.bytes = 0
+			break
+		}
+
+		key := q.limit.CoalesceKey(message.messageType, message.data)
+		for i := range q.messages {
+			queued := q.messages[i]
+			if q.limit.CoalesceKey(queued.messageType, queued.data) == key {
+				q.messages = append(q.messages[:i], q.messages[i+1:]...)
+				q.bytes -= len(queued.data)
+				dropped++
+				break
+			}
+		}
+		for len(q.messages) > 0 && !q.fits(size) {
+			q.dropOldest()
+			dropped++
+		}
+	case SlowConsumerDropOldest:
+		for len(q.messages) > 0 && !q.fits(size) {
+			q.dropOldest()
+			dropped++
+		}
+	default:
+		return 1, true
+	}
+
+	// Larger than the limit on its own.
+	if !q.fits(size) {
+		return dropped + 1, true
+	}
+
+	q.messages = append(q.messages, message)
+	q.bytes += size
+	q.cond.Signal()
+	return dropped, true
+}
+
+// Blocks until there is a message to write.
+// Returns false once the queue is closed.
+func (q *outboundQueue) pop() (outboundMessage, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.messages) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return outboundMessage{}, false
+	}
+
+	message := q.messages[0]
+	q.dropOldest()
+	return message, true
+}
+
+func (q *outboundQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.messages = nil
+	q.bytes = 0
+	q.cond.Broadcast()
+}
+
+// Writes the queued messages until the client is closed.
+func (cc *client) writeOutbound() {
+	for {
+		message, ok := cc.outbound.pop()
+		if !ok {
+			return
+		}
+		cc.deliverQueued(message)
+	}
+}
+
+// Delivers a queued message in its own span, linked to the emit span: the emit span is ended by the time
+// queued messages are written.
+func (cc *client) deliverQueued(message outboundMessage) {
+	ms := cc.getServer()
+
+	ctx := message.ctx
+	if emit := ms.tracing.tracer.SpanFromContext(ctx); emit != nil {
+		var span Span
+		ctx, span = ms.tracing.tracer.Start(ctx, _SPAN_DELIVER, SpanOpts{
+			Attributes: []TraceAttribute{
+				_ATTRIBUTE_NAMESPACE.String(ms.namespace),
+				_ATTRIBUTE_CLIENT_ID.String(cc.id),
+				_ATTRIBUTE_MESSAGE_TYPE.Int(message.messageType),
+				_ATTRIBUTE_MESSAGE_SIZE.Int(len(message.data)),
+			},
+			NewRoot: true,
+			Links:   []Span{emit},
+		})
+		defer span.End()
+	}
+
+	cc.deliver(ctx, message.logger, message.messageType, message.data, message.prepared)
+}
+
+// Queues, or writes right away if the client has no outbound queue, a message being emitted.
+// prepared is the same message, shared by the clients it's emitted to.
+// Returns whether the client exceeded its outbound limits.
+func (cc *client) send(ctx context.Context, logger *zap.Logger, messageType int, data []byte, prepared *websocket.PreparedMessage) bool {
+	if cc.outbound == nil {
+		cc.deliver(ctx, logger, messageType, data, prepared)
+		return false
+	}
+
+	dropped, exceeded := cc.outbound.push(outboundMessage{
+		ctx:         detachedContext{parent: ctx},
+		messageType: messageType,
+		data:        data,
+		prepared:    prepared,
+		logger:      logger,
+	})
+	if dropped > 0 {
+		cc.droppedMessages.Add(uint64(dropped))
+	}
+	span := cc.getServer().tracing.span(ctx)
+	if !exceeded {
+		span.AddEvent("queued", _ATTRIBUTE_CLIENT_ID.String(cc.id))
+		return false
+	}
+	span.AddEvent(
+		"outbound limit exceeded",
+		_ATTRIBUTE_CLIENT_ID.String(cc.id),
+		_ATTRIBUTE_POLICY.String(cc.outbound.limit.Policy.String()),
+	)
+
+	logger.Warn(
+		"Slow consumer exceeded outbound limits",
+		zap.Stringer("Policy", cc.outbound.limit.Policy),
+		zap.Int("Dropped Messages", dropped),
+	)
+	if cc.outbound.limit.Policy == SlowConsumerDisconnect {
+		ms := cc.getServer()
+		ms.mutex.Lock()
+		defer ms.unlock()
+
+		if err := cc.closeWithCode(CloseSlowConsumer, "slow consumer", DisconnectSlowConsumer); err != nil {
+			logger.Error("Failed to close slow consumer", zap.Error(err))
+		}
+	}
+	return true
+}
+
+func (cc *client) deliver(ctx context.Context, logger *zap.Logger, messageType int, data []byte, prepared *websocket.PreparedMessage) {
+	ms := cc.getServer()
+	span := ms.tracing.span(ctx)
+
+	if err := cc.writePrepared(ctx, messageType, data, prepared); err != nil {
+		logger.Error("Send message to client error", zap.Error(err))
+		ms.metrics.writeFailed(ms.namespace)
+		span.AddEvent(
+			"write failed",
+			_ATTRIBUTE_CLIENT_ID.String(cc.id),
+			_ATTRIBUTE_ERROR.String(err.Error()),
+		)
+		return
+	}
+	ms.metrics.messageSent(ms.namespace, len(data))
+	span.AddEvent("delivered", _ATTRIBUTE_CLIENT_ID.String(cc.id))
+
+	if cc.onOutgoing != nil {
+		_, onOutgoingSpan := ms.tracing.start(
+			ctx,
+			_SPAN_ON_OUTGOING,
+			_ATTRIBUTE_CLIENT_ID.String(cc.id),
+			_ATTRIBUTE_MESSAGE_TYPE.Int(messageType),
+			_ATTRIBUTE_MESSAGE_SIZE.Int(len(data)),
+		)
+		err := cc.onOutgoing(ms.tracing.tracer.ContextWithSpan(cc.ctx, onOutgoingSpan), cc, messageType, data)
+		if err != nil {
+			logger.Error("onOutgoing error", zap.Error(err))
+			ms.metrics.hookFailed(ms.namespace, "on_outgoing")
+		}
+		endSpan(onOutgoingSpan, err)
+	}
+}
@@ -0,0 +1,144 @@
+package magicsockets_test
+
+import (
+	"net/http"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Slow consumers", func() {
+	var (
+		ms      magicsockets.MagicSocket
+		address string
+
+		key           string
+		outboundLimit magicsockets.OutboundLimit
+
+		// Blocks the writes to the client after the first message, simulating a slow consumer.
+		outgoing      chan string
+		releaseWrites chan struct{}
+		slowConsumers chan magicsockets.SlowConsumerPolicy
+
+		websocketClientConn *websocket.Conn
+	)
+
+	BeforeEach(func() {
+		key = gofakeit.UUID()
+		outboundLimit = magicsockets.OutboundLimit{MaxQueuedMessages: 1}
+		outgoing = make(chan string, 10)
+		releaseWrites = make(chan struct{})
+		slowConsumers = make(chan magicsockets.SlowConsumerPolicy, 10)
+
+		ms, address = startMagicSocket(magicsockets.MagicSocketOpts{
+			OnSlowConsumer: func(client magicsockets.ClientConn, policy magicsockets.SlowConsumerPolicy) {
+				slowConsumers <- policy
+			},
+		})
+		// Writers of previous specs may still be running once the variables are reassigned.
+		outgoing, releaseWrites := outgoing, releaseWrites
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key:           key,
+				OutboundLimit: &outboundLimit,
+				OnOutgoing: func(messageType int, data []byte) error {
+					outgoing <- string(data)
+					<-releaseWrites
+					return nil
+				},
+			}, nil
+		})
+	})
+
+	AfterEach(func() {
+		close(releaseWrites)
+		websocketClientConn.Close()
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	emit := func(message string) {
+		ms.Emit(magicsockets.EmitOpts{
+			Rules: []magicsockets.EmitRule{
+				{
+					OnlyKeys: []string{key},
+				},
+			},
+		}, []byte(message))
+	}
+
+	// Emits three messages while the first one is still being written.
+	connectAndEmit := func() {
+		var err error
+		websocketClientConn, err = newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+
+		emit("first")
+		Eventually(outgoing).Should(Receive(Equal("first")))
+		emit("second")
+		emit("third")
+	}
+
+	expectReceived := func(messages ...string) {
+		for _, expected := range messages {
+			_, message, err := websocketClientConn.ReadMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(message)).To(Equal(expected))
+		}
+	}
+
+	It("Drops the newest messages by default", func() {
+		connectAndEmit()
+
+		Expect(ms.GetClients()[key].GetDroppedMessages()).To(BeEquivalentTo(1))
+		Eventually(slowConsumers).Should(Receive(Equal(magicsockets.SlowConsumerDropNewest)))
+
+		releaseWrites <- struct{}{}
+		expectReceived("first", "second")
+	})
+
+	It("Drops the oldest messages", func() {
+		outboundLimit.Policy = magicsockets.SlowConsumerDropOldest
+		connectAndEmit()
+
+		Expect(ms.GetClients()[key].GetDroppedMessages()).To(BeEquivalentTo(1))
+
+		releaseWrites <- struct{}{}
+		expectReceived("first", "third")
+	})
+
+	It("Coalesces messages with the same coalesce key", func() {
+		outboundLimit.MaxQueuedMessages = 2
+		outboundLimit.Policy = magicsockets.SlowConsumerCoalesce
+		outboundLimit.CoalesceKey = func(messageType int, data []byte) string {
+			return string(data[:1])
+		}
+		connectAndEmit()
+		emit("tenth")
+
+		Expect(ms.GetClients()[key].GetDroppedMessages()).To(BeEquivalentTo(1))
+
+		releaseWrites <- struct{}{}
+		releaseWrites <- struct{}{}
+		expectReceived("first", "second", "tenth")
+	})
+
+	It("Disconnects slow consumers", func() {
+		outboundLimit.Policy = magicsockets.SlowConsumerDisconnect
+		connectAndEmit()
+
+		Eventually(slowConsumers).Should(Receive(Equal(magicsockets.SlowConsumerDisconnect)))
+		Expect(ms.GetClients()).To(BeEmpty())
+
+		releaseWrites <- struct{}{}
+		_, _, err := websocketClientConn.ReadMessage()
+		for err == nil {
+			_, _, err = websocketClientConn.ReadMessage()
+		}
+		Expect(websocket.IsCloseError(err, magicsockets.CloseSlowConsumer)).To(BeTrue())
+	})
+})
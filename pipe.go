@@ -0,0 +1,190 @@
+package magicsockets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Messages written to a PipeConn before writes block until its peer reads.
+	_PIPE_BUFFER_SIZE = 256
+)
+
+var (
+	ErrHandshakeFailed = errors.New("handshake failed")
+)
+
+// In-memory Transport, connecting clients without the network, e.g. in tests.
+//
+//	transport := magicsockets.NewPipeTransport()
+//	ms := magicsockets.New(magicsockets.MagicSocketOpts{Transport: transport})
+//	handler, _ := ms.Handler()
+//	conn, err := transport.Dial(handler, "/?key=user-1", nil)
+type PipeTransport struct{}
+
+// End of an in-memory connection, whose messages are read by its peer.
+type PipeConn struct {
+	in  <-chan frame
+	out chan<- frame
+
+	// Closed once this end is closed.
+	done chan struct{}
+	// Closed once the peer is closed.
+	peerDone  chan struct{}
+	closeOnce *sync.Once
+
+	mutex         *sync.Mutex
+	writeDeadline time.Time
+}
+
+type pipeContextKey struct{}
+
+// Handshake performed by PipeTransport.Dial.
+type pipeHandshake struct {
+	server   *PipeConn
+	upgraded bool
+}
+
+func NewPipeTransport() *PipeTransport {
+	return &PipeTransport{}
+}
+
+// Connects the requests of Dial, rejecting any other.
+func (pt *PipeTransport) Upgrade(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	handshake, ok := r.Context().Value(pipeContextKey{}).(*pipeHandshake)
+	if !ok {
+		http.Error(w, "not a pipe handshake", http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: not a pipe handshake", ErrHandshakeFailed)
+	}
+
+	handshake.upgraded = true
+	return handshake.server, nil
+}
+
+// Performs a handshake against the handler of a MagicSocket using this transport, see MagicSocket.Handler.
+// target is the path and query of the handshake, e.g. "/?key=user-1".
+// Returns the end of the client.
+func (pt *PipeTransport) Dial(handler http.Handler, target string, header http.Header) (*PipeConn, error) {
+	server, client := NewPipe()
+	handshake := &pipeHandshake{server: server}
+
+	ctx := context.WithValue(context.Background(), pipeContextKey{}, handshake)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://pipe"+target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		r.Header = header.Clone()
+	}
+	r.RemoteAddr = "pipe"
+
+	w := newRecordedResponse()
+	handler.ServeHTTP(w, r)
+
+	if !handshake.upgraded {
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("%w: %d %s", ErrHandshakeFailed, w.status, bytes.TrimSpace(w.body.Bytes()))
+	}
+	return client, nil
+}
+
+// Returns both ends of an in-memory connection.
+func NewPipe() (*PipeConn, *PipeConn) {
+	aToB := make(chan frame, _PIPE_BUFFER_SIZE)
+	bToA := make(chan frame, _PIPE_BUFFER_SIZE)
+	aDone := make(chan struct{})
+	bDone := make(chan struct{})
+
+	a := &PipeConn{
+		in:        bToA,
+		out:       aToB,
+		done:      aDone,
+		peerDone:  bDone,
+		closeOnce: &sync.Once{},
+		mutex:     &sync.Mutex{},
+	}
+	b := &PipeConn{
+		in:        aToB,
+		out:       bToA,
+		done:      bDone,
+		peerDone:  aDone,
+		closeOnce: &sync.Once{},
+		mutex:     &sync.Mutex{},
+	}
+	return a, b
+}
+
+// Blocks until the peer writes a message.
+// Messages written before the peer was closed can still be read.
+func (c *PipeConn) ReadMessage() (int, []byte, error) {
+	select {
+	case message := <-c.in:
+		return message.messageType, message.data, nil
+	case <-c.done:
+		return 0, nil, ErrTransportClosed
+	case <-c.peerDone:
+		select {
+		case message := <-c.in:
+			return message.messageType, message.data, nil
+		default:
+			return 0, nil, ErrTransportClosed
+		}
+	}
+}
+
+// Blocks while _PIPE_BUFFER_SIZE messages are waiting to be read by the peer, until the write deadline.
+func (c *PipeConn) WriteMessage(messageType int, data []byte) error {
+	c.mutex.Lock()
+	deadline := c.writeDeadline
+	c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrTransportClosed
+	case <-c.peerDone:
+		return ErrTransportClosed
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	message := frame{messageType: messageType, data: append([]byte{}, data...)}
+	select {
+	case c.out <- message:
+		return nil
+	case <-c.done:
+		return ErrTransportClosed
+	case <-c.peerDone:
+		return ErrTransportClosed
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *PipeConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeDeadline = t
+	return nil
+}
+
+// Closes both ends of the connection.
+func (c *PipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
@@ -0,0 +1,119 @@
+package magicsockets_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+// Pipe transport whose connections record the prepared messages written to them.
+type preparedTransport struct {
+	*magicsockets.PipeTransport
+	prepared chan *websocket.PreparedMessage
+}
+
+func (pt *preparedTransport) Upgrade(w http.ResponseWriter, r *http.Request) (magicsockets.Conn, error) {
+	conn, err := pt.PipeTransport.Upgrade(w, r)
+	if err != nil {
+		return nil, err
+	}
+	return &preparedConn{Conn: conn, prepared: pt.prepared}, nil
+}
+
+type preparedConn struct {
+	magicsockets.Conn
+	prepared chan *websocket.PreparedMessage
+}
+
+func (pc *preparedConn) WritePreparedMessage(pm *websocket.PreparedMessage) error {
+	pc.prepared <- pm
+	return pc.Conn.WriteMessage(websocket.TextMessage, []byte("prepared"))
+}
+
+var _ = Describe("Prepared messages", func() {
+	var ms magicsockets.MagicSocket
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	It("Writes the same prepared message to every client", func() {
+		transport := &preparedTransport{
+			PipeTransport: magicsockets.NewPipeTransport(),
+			prepared:      make(chan *websocket.PreparedMessage, 10),
+		}
+		ms = magicsockets.New(magicsockets.MagicSocketOpts{
+			Transport: transport,
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{Key: r.URL.Query().Get("key")}, nil
+			},
+		})
+		handler, err := ms.Handler()
+		Expect(err).ToNot(HaveOccurred())
+
+		var conns []*magicsockets.PipeConn
+		for _, key := range []string{"a", "b", "c"} {
+			conn, err := transport.Dial(handler, "/?key="+key, nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{}}}, []byte("broadcast"))
+
+		var first *websocket.PreparedMessage
+		Eventually(transport.prepared).Should(Receive(&first))
+		Expect(first).ToNot(BeNil())
+		for range conns[1:] {
+			Eventually(transport.prepared).Should(Receive(BeIdenticalTo(first)))
+		}
+		for _, conn := range conns {
+			_, message, err := conn.ReadMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(message)).To(Equal("prepared"))
+		}
+	})
+
+	It("Delivers broadcasts to clients with and without compression", func() {
+		ms = magicsockets.New(magicsockets.MagicSocketOpts{
+			Upgrader: magicsockets.UpgraderOpts{EnableCompression: true},
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{Key: r.URL.Query().Get("key")}, nil
+			},
+		})
+		handler, err := ms.Handler()
+		Expect(err).ToNot(HaveOccurred())
+		httpServer := httptest.NewServer(handler)
+		defer httpServer.Close()
+
+		url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+		var conns []*websocket.Conn
+		for i, compression := range []bool{true, false, true} {
+			dialer := websocket.Dialer{EnableCompression: compression}
+			conn, _, err := dialer.Dial(url+"?key="+strconv.Itoa(i), nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+		Eventually(ms.GetClients).Should(HaveLen(3))
+
+		message := strings.Repeat("compressible ", 100)
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{}}}, []byte(message))
+
+		for _, conn := range conns {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, received, err := conn.ReadMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(received)).To(Equal(message))
+		}
+	})
+})
@@ -0,0 +1,40 @@
+package magicsockets
+
+import (
+	"context"
+
+	"github.com/gorilla/websocket"
+)
+
+// Websocket message, as written to or read from the connection.
+type frame struct {
+	messageType int
+	data        []byte
+	// The same message, framed once for every PreparedConn it's written to. Nil if not prepared.
+	prepared *websocket.PreparedMessage
+}
+
+// Protocol layered over the websocket connection of a client, e.g. Socket.IO.
+// Nil for clients exchanging messages as they are.
+type clientProtocol interface {
+	// Called once the client is registered, before any message is written to it.
+	// Must be called while holding the server mutex.
+	start(conn ControlConn) error
+	// Frames to write for a message sent to the client through WriteMessage or Emit.
+	// ctx is the context of the write, see emittedTopics.
+	encode(ctx context.Context, messageType int, data []byte) ([]frame, error)
+	// Handles a frame read from the client.
+	// Returns the message to pass on to the OnIncoming hook and the event routers, if any.
+	decode(messageType int, data []byte) (*frame, error)
+	// Whether a frame read from the client only keeps the connection alive, e.g. a heart-beat,
+	// so it isn't charged to the rate limit of the client.
+	keepAlive(messageType int, data []byte) bool
+	// Whether the protocol checks that the client is alive itself, through the read deadlines of its connection.
+	// The Heartbeat of the server, relying on the same deadlines, isn't started for its clients.
+	ownsLiveness() bool
+	// Called once the client is disconnected, without holding the server mutex.
+	closed()
+}
+
+// Creates the protocol of a client once its connection is upgraded.
+type newClientProtocol func(cc *client) clientProtocol
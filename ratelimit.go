@@ -0,0 +1,231 @@
+package magicsockets
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// Limits the messages a client can send, using token buckets.
+// Zero values disable the corresponding limit.
+type RateLimit struct {
+	MessagesPerSecond float64
+	// Amount of messages allowed at once. Defaults to MessagesPerSecond, or 1 if it is lower.
+	MessageBurst int
+
+	BytesPerSecond float64
+	// Amount of bytes allowed at once. Defaults to BytesPerSecond.
+	ByteBurst int
+
+	// What to do with messages exceeding the limit. Defaults to RateLimitDrop.
+	Action RateLimitAction
+	// Sent to the client with RateLimitError. Defaults to _DEFAULT_RATE_LIMIT_ERROR_MESSAGE.
+	ErrorMessage []byte
+}
+
+type RateLimitAction int
+
+const (
+	// Discards the message without calling OnIncoming.
+	RateLimitDrop RateLimitAction = iota
+	// Waits until the message is within the limit before processing it,
+	// which stops reading from the connection in the meantime.
+	RateLimitDelay
+	// Discards the message and sends ErrorMessage to the client.
+	RateLimitError
+	// Closes the connection with 1008 Policy Violation.
+	RateLimitClose
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitDelay:
+		return "delay"
+	case RateLimitError:
+		return "error"
+	case RateLimitClose:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	_DEFAULT_RATE_LIMIT_ERROR_MESSAGE = "rate limit exceeded"
+)
+
+func (rl RateLimit) enabled() bool {
+	return rl.MessagesPerSecond > 0 || rl.BytesPerSecond > 0
+}
+
+type rateLimiter struct {
+	opts RateLimit
+
+	// Nil when not limited.
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// Returns nil if the limit is disabled.
+func newRateLimiter(opts RateLimit) *rateLimiter {
+	if !opts.enabled() {
+		return nil
+	}
+
+	rl := &rateLimiter{opts: opts}
+	now := time.Now()
+	if opts.MessagesPerSecond > 0 {
+		burst := float64(opts.MessageBurst)
+		if burst <= 0 {
+			burst = opts.MessagesPerSecond
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		rl.messages = newTokenBucket(opts.MessagesPerSecond, burst, now)
+	}
+	if opts.BytesPerSecond > 0 {
+		burst := float64(opts.ByteBurst)
+		if burst <= 0 {
+			burst = opts.BytesPerSecond
+		}
+		rl.bytes = newTokenBucket(opts.BytesPerSecond, burst, now)
+	}
+	return rl
+}
+
+// Consumes the tokens for a message if it is within the limit.
+func (rl *rateLimiter) allow(size int, now time.Time) bool {
+	if rl.messages != nil && !rl.messages.has(1, now) {
+		return false
+	}
+	if rl.bytes != nil && !rl.bytes.has(float64(size), now) {
+		return false
+	}
+
+	if rl.messages != nil {
+		rl.messages.take(1, now)
+	}
+	if rl.bytes != nil {
+		rl.bytes.take(float64(size), now)
+	}
+	return true
+}
+
+// Consumes the tokens for a message, returning how long to wait until they are available.
+func (rl *rateLimiter) reserve(size int, now time.Time) time.Duration {
+	var wait time.Duration
+	if rl.messages != nil {
+		if w := rl.messages.take(1, now); w > wait {
+			wait = w
+		}
+	}
+	if rl.bytes != nil {
+		if w := rl.bytes.take(float64(size), now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	tb.last = now
+	tb.tokens += elapsed * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+// Amounts larger than the burst are allowed once the bucket is full,
+// otherwise they would never be.
+func (tb *tokenBucket) has(amount float64, now time.Time) bool {
+	tb.refill(now)
+	if amount > tb.burst {
+		amount = tb.burst
+	}
+	return tb.tokens >= amount
+}
+
+// Tokens may go negative, in which case the returned duration is how long until they are paid back.
+func (tb *tokenBucket) take(amount float64, now time.Time) time.Duration {
+	tb.refill(now)
+	if amount > tb.burst {
+		amount = tb.burst
+	}
+	tb.tokens -= amount
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// Applies the client's rate limit to an incoming message.
+// Frames keeping the connection of a protocol alive aren't limited, so they can't be dropped.
+// Returns whether the message should be processed, and whether the client should stop being read from.
+func (cc *client) applyRateLimit(messageType int, message []byte) (process bool, stop bool) {
+	limiter := cc.inboundLimiter
+	if limiter == nil || (cc.protocol != nil && cc.protocol.keepAlive(messageType, message)) {
+		return true, false
+	}
+
+	now := time.Now()
+	if limiter.opts.Action == RateLimitDelay {
+		if wait := limiter.reserve(len(message), now); wait > 0 {
+			cc.logger.Debug("Rate limit exceeded. Delaying message", zap.Duration("Wait", wait))
+			time.Sleep(wait)
+		}
+		return true, false
+	}
+
+	if limiter.allow(len(message), now) {
+		return true, false
+	}
+
+	cc.logger.Warn("Rate limit exceeded", zap.Stringer("Action", limiter.opts.Action))
+	switch limiter.opts.Action {
+	case RateLimitError:
+		errorMessage := limiter.opts.ErrorMessage
+		if errorMessage == nil {
+			errorMessage = []byte(_DEFAULT_RATE_LIMIT_ERROR_MESSAGE)
+		}
+		if err := cc.WriteMessage(websocket.TextMessage, errorMessage); err != nil {
+			cc.logger.Error("Failed to send rate limit error", zap.Error(err))
+		}
+		return false, false
+	case RateLimitClose:
+		ms := cc.getServer()
+		ms.mutex.Lock()
+		defer ms.unlock()
+
+		if err := cc.closeWithCode(websocket.ClosePolicyViolation, _DEFAULT_RATE_LIMIT_ERROR_MESSAGE, DisconnectRateLimited); err != nil {
+			cc.logger.Error("Failed to close rate limited client", zap.Error(err))
+		}
+		return false, true
+	default:
+		return false, false
+	}
+}
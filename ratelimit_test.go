@@ -0,0 +1,123 @@
+package magicsockets_test
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Rate limiting", func() {
+	var (
+		ms      magicsockets.MagicSocket
+		address string
+
+		rateLimit magicsockets.RateLimit
+		incoming  chan []byte
+
+		websocketClientConn *websocket.Conn
+	)
+
+	BeforeEach(func() {
+		incoming = make(chan []byte, 10)
+		rateLimit = magicsockets.RateLimit{
+			MessagesPerSecond: 1,
+		}
+		websocketClientConn = nil
+
+		ms, address = startMagicSocket(magicsockets.MagicSocketOpts{})
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key:       gofakeit.UUID(),
+				RateLimit: &rateLimit,
+				OnIncoming: func(messageType int, data []byte) error {
+					incoming <- data
+					return nil
+				},
+			}, nil
+		})
+	})
+
+	AfterEach(func() {
+		if websocketClientConn != nil {
+			websocketClientConn.Close()
+		}
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	// Connects after the rate limit of the test was configured.
+	connect := func() {
+		var err error
+		websocketClientConn, err = newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	sendMessages := func(amount int) {
+		for i := 0; i < amount; i++ {
+			err := websocketClientConn.WriteMessage(websocket.TextMessage, []byte(gofakeit.BuzzWord()))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+
+	It("Drops messages exceeding the limit", func() {
+		connect()
+		sendMessages(3)
+
+		Eventually(incoming).Should(Receive())
+		Consistently(incoming, time.Millisecond*300).ShouldNot(Receive())
+	})
+
+	It("Drops messages exceeding the byte limit", func() {
+		rateLimit = magicsockets.RateLimit{
+			BytesPerSecond: 10,
+		}
+		connect()
+		Expect(websocketClientConn.WriteMessage(websocket.TextMessage, []byte("0123456789"))).To(Succeed())
+		Expect(websocketClientConn.WriteMessage(websocket.TextMessage, []byte("0123456789"))).To(Succeed())
+
+		Eventually(incoming).Should(Receive())
+		Consistently(incoming, time.Millisecond*300).ShouldNot(Receive())
+	})
+
+	It("Delays messages exceeding the limit", func() {
+		rateLimit.MessagesPerSecond = 10
+		rateLimit.MessageBurst = 1
+		rateLimit.Action = magicsockets.RateLimitDelay
+		connect()
+		sendMessages(3)
+
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			Eventually(incoming).Should(Receive())
+		}
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Millisecond*150))
+	})
+
+	It("Sends an error frame when exceeding the limit", func() {
+		rateLimit.Action = magicsockets.RateLimitError
+		rateLimit.ErrorMessage = []byte("slow down")
+		connect()
+		sendMessages(2)
+
+		_, message, err := websocketClientConn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(Equal("slow down"))
+		Eventually(incoming).Should(Receive())
+	})
+
+	It("Closes the connection with policy violation when exceeding the limit", func() {
+		rateLimit.Action = magicsockets.RateLimitClose
+		connect()
+		sendMessages(2)
+
+		_, _, err := websocketClientConn.ReadMessage()
+		Expect(websocket.IsCloseError(err, websocket.ClosePolicyViolation)).To(BeTrue())
+		Eventually(ms.GetClients).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,90 @@
+package magicsockets
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Keeps track of which MagicSocket instance each client is connected to,
+// so that clients can be found and managed from any instance of a cluster.
+type Registry interface {
+	// Adds the entry, or replaces the existing entry with the same client ID.
+	Put(entry RegistryEntry) error
+	// No-op if the client isn't registered.
+	Delete(clientID string) error
+
+	// Returns ErrClientNotFound if the client isn't registered.
+	GetByID(clientID string) (RegistryEntry, error)
+	GetByKey(key string) ([]RegistryEntry, error)
+}
+
+type RegistryEntry struct {
+	ClientID string
+	Key      string
+	Topics   []string
+
+	ConnectedAt time.Time
+	RemoteAddr  string
+
+	// ID of the MagicSocket instance the client is connected to.
+	NodeID string
+}
+
+var (
+	ErrClientNotFound = errors.New("client not found")
+)
+
+// In-process Registry, useful for tests or for several MagicSocket instances in the same binary.
+// Share the same MemoryRegistry between the instances.
+type MemoryRegistry struct {
+	mutex   *sync.RWMutex
+	entries map[string]RegistryEntry
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		mutex:   &sync.RWMutex{},
+		entries: make(map[string]RegistryEntry),
+	}
+}
+
+func (mr *MemoryRegistry) Put(entry RegistryEntry) error {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	mr.entries[entry.ClientID] = entry
+	return nil
+}
+
+func (mr *MemoryRegistry) Delete(clientID string) error {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	delete(mr.entries, clientID)
+	return nil
+}
+
+func (mr *MemoryRegistry) GetByID(clientID string) (RegistryEntry, error) {
+	mr.mutex.RLock()
+	defer mr.mutex.RUnlock()
+
+	entry, ok := mr.entries[clientID]
+	if !ok {
+		return RegistryEntry{}, ErrClientNotFound
+	}
+	return entry, nil
+}
+
+func (mr *MemoryRegistry) GetByKey(key string) ([]RegistryEntry, error) {
+	mr.mutex.RLock()
+	defer mr.mutex.RUnlock()
+
+	entries := []RegistryEntry{}
+	for _, entry := range mr.entries {
+		if entry.Key == key {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,681 @@
+package magicsockets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	_DEFAULT_SOCKETIO_PING_INTERVAL = 25 * time.Second
+	_DEFAULT_SOCKETIO_PING_TIMEOUT  = 20 * time.Second
+	_DEFAULT_SOCKETIO_MAX_PAYLOAD   = 1000000
+
+	_SOCKETIO_MAIN_NAMESPACE = "/"
+	// Socket.IO event of messages written to clients without an Event envelope.
+	_SOCKETIO_MESSAGE_EVENT = "message"
+)
+
+// Engine.IO v4 packet types.
+const (
+	_ENGINEIO_OPEN    = '0'
+	_ENGINEIO_CLOSE   = '1'
+	_ENGINEIO_PING    = '2'
+	_ENGINEIO_PONG    = '3'
+	_ENGINEIO_MESSAGE = '4'
+	_ENGINEIO_NOOP    = '6'
+)
+
+// Socket.IO v5 packet types.
+const (
+	_SOCKETIO_CONNECT       = '0'
+	_SOCKETIO_DISCONNECT    = '1'
+	_SOCKETIO_EVENT         = '2'
+	_SOCKETIO_ACK           = '3'
+	_SOCKETIO_CONNECT_ERROR = '4'
+	_SOCKETIO_BINARY_EVENT  = '5'
+	_SOCKETIO_BINARY_ACK    = '6'
+)
+
+// Engine.IO handshake error codes.
+const (
+	_ENGINEIO_TRANSPORT_UNKNOWN    = 0
+	_ENGINEIO_SESSION_ID_UNKNOWN   = 1
+	_ENGINEIO_UNSUPPORTED_PROTOCOL = 5
+)
+
+var (
+	ErrSocketIOBinaryUnsupported = errors.New("binary Socket.IO packets are not supported")
+	ErrInvalidSocketIOPacket     = errors.New("invalid Socket.IO packet")
+)
+
+// Serves Socket.IO clients, using the Engine.IO v4 websocket transport and the Socket.IO v5 protocol.
+//
+// Rooms are the topics of the client, so emit rules match them, and are shared by the namespaces of a connection.
+// Messages written to the client are sent to each of its namespaces, as the event of an Event envelope,
+// or as a "message" event otherwise.
+type SocketIOOpts struct {
+	// Namespaces clients may connect to, by name, e.g. "/" or "/chat".
+	// When nil, clients may only connect to the main namespace "/", which has no handlers.
+	Namespaces map[string]*SocketIONamespace
+
+	// Default to _DEFAULT_SOCKETIO_PING_INTERVAL and _DEFAULT_SOCKETIO_PING_TIMEOUT.
+	// Clients not answering a ping in time are disconnected.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	// Maximum size of the messages read from clients. Defaults to _DEFAULT_SOCKETIO_MAX_PAYLOAD.
+	MaxPayload int
+}
+
+// Acknowledges an event with the given arguments.
+// Nil when the client didn't ask for an acknowledgement.
+type SocketIOAck func(args ...any) error
+
+type SocketIOHandler func(socket *SocketIOSocket, args []json.RawMessage, ack SocketIOAck) error
+
+// Handlers of the sockets connected to a namespace.
+type SocketIONamespace struct {
+	mutex *sync.RWMutex
+
+	onConnect    func(socket *SocketIOSocket) error
+	onDisconnect func(socket *SocketIOSocket)
+	handlers     map[string]SocketIOHandler
+}
+
+// Connection of a client to a namespace.
+type SocketIOSocket struct {
+	ID        string
+	Namespace string
+	Client    ClientConn
+	// Payload of the CONNECT packet, nil if there's none.
+	Auth json.RawMessage
+
+	sio *socketIOClient
+}
+
+// Protocol of a Socket.IO client.
+type socketIOClient struct {
+	cc   *client
+	opts SocketIOOpts
+	conn ControlConn
+
+	// Guards sockets. Never held while calling out of the client.
+	mutex   *sync.Mutex
+	sockets map[string]*SocketIOSocket
+	// Guards updating the topics of the client on Join and Leave.
+	roomsMutex *sync.Mutex
+}
+
+type socketIOPacket struct {
+	kind      byte
+	namespace string
+	// Nil when no acknowledgement is asked for.
+	ackID   *uint64
+	payload []byte
+}
+
+func NewSocketIONamespace() *SocketIONamespace {
+	return &SocketIONamespace{
+		mutex:    &sync.RWMutex{},
+		handlers: make(map[string]SocketIOHandler),
+	}
+}
+
+// Called when a client connects to the namespace.
+// Returning an error refuses the connection, sending the error to the client.
+func (n *SocketIONamespace) OnConnect(handler func(socket *SocketIOSocket) error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.onConnect = handler
+}
+
+// Called when a client disconnects from the namespace, or its connection is lost.
+func (n *SocketIONamespace) OnDisconnect(handler func(socket *SocketIOSocket)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.onDisconnect = handler
+}
+
+// Registers the handler of an event, replacing any previous one.
+// Events without a handler are passed on to the OnIncoming hook and the event routers as an Event envelope,
+// whose data is the only argument of the event, or the array of its arguments if there are several.
+func (n *SocketIONamespace) On(event string, handler SocketIOHandler) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.handlers[event] = handler
+}
+
+func (n *SocketIONamespace) handler(event string) SocketIOHandler {
+	if n == nil {
+		return nil
+	}
+
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.handlers[event]
+}
+
+func (n *SocketIONamespace) connectHandler() func(socket *SocketIOSocket) error {
+	if n == nil {
+		return nil
+	}
+
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.onConnect
+}
+
+func (n *SocketIONamespace) disconnectHandler() func(socket *SocketIOSocket) {
+	if n == nil {
+		return nil
+	}
+
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	return n.onDisconnect
+}
+
+// Sends an event to the client in the namespace of the socket.
+func (s *SocketIOSocket) Emit(event string, args ...any) error {
+	packet, err := encodeSocketIOEvent(s.Namespace, event, args)
+	if err != nil {
+		return err
+	}
+	return s.sio.cc.writeFrames(context.Background(), packet)
+}
+
+// Adds the rooms to the topics of the client.
+func (s *SocketIOSocket) Join(rooms ...string) {
+	s.sio.roomsMutex.Lock()
+	defer s.sio.roomsMutex.Unlock()
+
+	topics := append([]string{}, s.Client.GetTopics()...)
+	for _, room := range rooms {
+		if !contains(topics, room) {
+			topics = append(topics, room)
+		}
+	}
+	s.Client.SetTopics(topics)
+}
+
+// Removes the rooms from the topics of the client.
+func (s *SocketIOSocket) Leave(rooms ...string) {
+	s.sio.roomsMutex.Lock()
+	defer s.sio.roomsMutex.Unlock()
+
+	topics := []string{}
+	for _, topic := range s.Client.GetTopics() {
+		if !contains(rooms, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	s.Client.SetTopics(topics)
+}
+
+// Rooms of the client, i.e. its topics.
+func (s *SocketIOSocket) Rooms() []string {
+	return s.Client.GetTopics()
+}
+
+// Disconnects the client from the namespace of the socket, keeping its connection open.
+func (s *SocketIOSocket) Disconnect() error {
+	if !s.sio.removeSocket(s) {
+		return nil
+	}
+
+	err := s.sio.cc.writeFrames(context.Background(), encodeSocketIOPacket(socketIOPacket{
+		kind:      _SOCKETIO_DISCONNECT,
+		namespace: s.Namespace,
+	}))
+	s.sio.disconnected(s)
+	return err
+}
+
+// Returns an http.Handler serving the Socket.IO handshakes, usually mounted at "/socket.io/".
+// Clients are registered through the OnConnect of the server, like those connecting through Handler.
+// Only the websocket transport is supported, so clients must connect with `transports: ["websocket"]`.
+func (ms *magicSocket) SocketIOHandler(opts SocketIOOpts) (http.Handler, error) {
+	if err := ms.subscribeBroker(); err != nil {
+		return nil, err
+	}
+
+	if opts.PingInterval == 0 {
+		opts.PingInterval = _DEFAULT_SOCKETIO_PING_INTERVAL
+	}
+	if opts.PingTimeout == 0 {
+		opts.PingTimeout = _DEFAULT_SOCKETIO_PING_TIMEOUT
+	}
+	if opts.MaxPayload == 0 {
+		opts.MaxPayload = _DEFAULT_SOCKETIO_MAX_PAYLOAD
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case query.Get("EIO") != "4":
+			writeEngineIOError(w, _ENGINEIO_UNSUPPORTED_PROTOCOL, "Unsupported protocol version")
+			return
+		case query.Get("transport") != "websocket":
+			writeEngineIOError(w, _ENGINEIO_TRANSPORT_UNKNOWN, "Transport unknown")
+			return
+		// Upgrades of sessions started with another transport.
+		case query.Has("sid"):
+			writeEngineIOError(w, _ENGINEIO_SESSION_ID_UNKNOWN, "Session ID unknown")
+			return
+		}
+
+		ms.handshake(w, r, ms.transport.Upgrade, func(cc *client) clientProtocol {
+			return &socketIOClient{
+				cc:         cc,
+				opts:       opts,
+				mutex:      &sync.Mutex{},
+				sockets:    make(map[string]*SocketIOSocket),
+				roomsMutex: &sync.Mutex{},
+			}
+		})
+	}), nil
+}
+
+func writeEngineIOError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// Sends the OPEN packet, and starts pinging the client.
+func (sio *socketIOClient) start(conn ControlConn) error {
+	sio.conn = conn
+	conn.SetReadLimit(int64(sio.opts.MaxPayload))
+
+	handshake, err := json.Marshal(map[string]any{
+		"sid":          sio.cc.id,
+		"upgrades":     []string{},
+		"pingInterval": sio.opts.PingInterval.Milliseconds(),
+		"pingTimeout":  sio.opts.PingTimeout.Milliseconds(),
+		"maxPayload":   sio.opts.MaxPayload,
+	})
+	if err != nil {
+		return err
+	}
+	// Written while holding the server mutex, before the client can be emitted to,
+	// so a client not reading from its connection must not block it for long.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = sio.cc.writeFrames(ctx, engineIOFrame(_ENGINEIO_OPEN, handshake))
+	if err != nil {
+		return err
+	}
+
+	sio.extendDeadline()
+	go func() {
+		ticker := time.NewTicker(sio.opts.PingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sio.cc.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := sio.cc.writeFrames(context.Background(), engineIOFrame(_ENGINEIO_PING, nil)); err != nil {
+					sio.cc.logger.Debug("Failed to ping Socket.IO client", zap.Error(err))
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Clients must answer the next ping before its timeout.
+func (sio *socketIOClient) extendDeadline() {
+	sio.conn.SetReadDeadline(time.Now().Add(sio.opts.PingInterval + sio.opts.PingTimeout))
+}
+
+// Sends a message written to the client to each of its namespaces.
+func (sio *socketIOClient) encode(ctx context.Context, messageType int, data []byte) ([]frame, error) {
+	if messageType != websocket.TextMessage {
+		return nil, ErrSocketIOBinaryUnsupported
+	}
+
+	name, args := _SOCKETIO_MESSAGE_EVENT, []any{string(data)}
+	if event, err := decodeEvent(data); err == nil {
+		name, args = event.Event, nil
+		if len(event.Data) > 0 {
+			args = []any{event.Data}
+		}
+	}
+
+	frames := []frame{}
+	for _, socket := range sio.connectedSockets() {
+		packet, err := encodeSocketIOEvent(socket.Namespace, name, args)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, packet)
+	}
+	return frames, nil
+}
+
+func (sio *socketIOClient) decode(messageType int, data []byte) (*frame, error) {
+	if messageType != websocket.TextMessage {
+		return nil, ErrSocketIOBinaryUnsupported
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: empty Engine.IO packet", ErrInvalidSocketIOPacket)
+	}
+
+	switch data[0] {
+	case _ENGINEIO_PING:
+		return nil, sio.cc.writeFrames(context.Background(), engineIOFrame(_ENGINEIO_PONG, data[1:]))
+	case _ENGINEIO_PONG:
+		sio.extendDeadline()
+		return nil, nil
+	case _ENGINEIO_CLOSE:
+		return nil, sio.cc.Close()
+	case _ENGINEIO_NOOP:
+		return nil, nil
+	case _ENGINEIO_MESSAGE:
+		packet, err := parseSocketIOPacket(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		return sio.handlePacket(packet)
+	}
+	return nil, fmt.Errorf("%w: unknown Engine.IO packet type %q", ErrInvalidSocketIOPacket, data[0])
+}
+
+// Engine.IO pings the client, see start.
+func (sio *socketIOClient) ownsLiveness() bool {
+	return true
+}
+
+func (sio *socketIOClient) keepAlive(messageType int, data []byte) bool {
+	if messageType != websocket.TextMessage || len(data) == 0 {
+		return false
+	}
+	return data[0] == _ENGINEIO_PING || data[0] == _ENGINEIO_PONG || data[0] == _ENGINEIO_NOOP
+}
+
+func (sio *socketIOClient) handlePacket(packet socketIOPacket) (*frame, error) {
+	switch packet.kind {
+	case _SOCKETIO_CONNECT:
+		return nil, sio.connect(packet)
+	case _SOCKETIO_DISCONNECT:
+		if socket := sio.socket(packet.namespace); socket != nil && sio.removeSocket(socket) {
+			sio.disconnected(socket)
+		}
+		return nil, nil
+	case _SOCKETIO_EVENT:
+		return sio.handleEvent(packet)
+	case _SOCKETIO_ACK:
+		// The server never asks for acknowledgements.
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected packet type %q", ErrInvalidSocketIOPacket, packet.kind)
+}
+
+func (sio *socketIOClient) connect(packet socketIOPacket) error {
+	namespace, ok := sio.namespace(packet.namespace)
+	if !ok {
+		return sio.writeConnectError(packet.namespace, "Invalid namespace")
+	}
+
+	socket := &SocketIOSocket{
+		ID:        uuid.NewString(),
+		Namespace: packet.namespace,
+		Client:    sio.cc,
+		sio:       sio,
+	}
+	if len(packet.payload) > 0 {
+		socket.Auth = json.RawMessage(packet.payload)
+	}
+
+	if onConnect := namespace.connectHandler(); onConnect != nil {
+		if err := onConnect(socket); err != nil {
+			return sio.writeConnectError(packet.namespace, err.Error())
+		}
+	}
+
+	sio.mutex.Lock()
+	sio.sockets[socket.Namespace] = socket
+	sio.mutex.Unlock()
+
+	payload, err := json.Marshal(map[string]string{"sid": socket.ID})
+	if err != nil {
+		return err
+	}
+	return sio.cc.writeFrames(context.Background(), encodeSocketIOPacket(socketIOPacket{
+		kind:      _SOCKETIO_CONNECT,
+		namespace: socket.Namespace,
+		payload:   payload,
+	}))
+}
+
+func (sio *socketIOClient) writeConnectError(namespace string, message string) error {
+	payload, err := json.Marshal(map[string]string{"message": message})
+	if err != nil {
+		return err
+	}
+	return sio.cc.writeFrames(context.Background(), encodeSocketIOPacket(socketIOPacket{
+		kind:      _SOCKETIO_CONNECT_ERROR,
+		namespace: namespace,
+		payload:   payload,
+	}))
+}
+
+// Calls the handler of the event, or returns it as an Event envelope if it has none.
+func (sio *socketIOClient) handleEvent(packet socketIOPacket) (*frame, error) {
+	socket := sio.socket(packet.namespace)
+	if socket == nil {
+		return nil, fmt.Errorf("%w: event sent to namespace %q without connecting", ErrInvalidSocketIOPacket, packet.namespace)
+	}
+
+	var payload []json.RawMessage
+	if err := json.Unmarshal(packet.payload, &payload); err != nil || len(payload) == 0 {
+		return nil, fmt.Errorf("%w: invalid event payload", ErrInvalidSocketIOPacket)
+	}
+	var name string
+	if err := json.Unmarshal(payload[0], &name); err != nil {
+		return nil, fmt.Errorf("%w: invalid event name", ErrInvalidSocketIOPacket)
+	}
+	args := payload[1:]
+
+	namespace, _ := sio.namespace(packet.namespace)
+	if handler := namespace.handler(name); handler != nil {
+		var ack SocketIOAck
+		if packet.ackID != nil {
+			ack = func(args ...any) error {
+				if args == nil {
+					args = []any{}
+				}
+				payload, err := json.Marshal(args)
+				if err != nil {
+					return fmt.Errorf("failed to encode acknowledgement of event %q: %w", name, err)
+				}
+				return sio.cc.writeFrames(context.Background(), encodeSocketIOPacket(socketIOPacket{
+					kind:      _SOCKETIO_ACK,
+					namespace: packet.namespace,
+					ackID:     packet.ackID,
+					payload:   payload,
+				}))
+			}
+		}
+		return nil, handler(socket, args, ack)
+	}
+
+	event := Event{Event: name}
+	switch len(args) {
+	case 0:
+	case 1:
+		event.Data = args[0]
+	default:
+		data, err := json.Marshal(args)
+		if err != nil {
+			return nil, err
+		}
+		event.Data = data
+	}
+	message, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return &frame{messageType: websocket.TextMessage, data: message}, nil
+}
+
+// Calls the disconnect handlers of the namespaces the client was connected to.
+func (sio *socketIOClient) closed() {
+	sio.mutex.Lock()
+	sockets := sio.sockets
+	sio.sockets = make(map[string]*SocketIOSocket)
+	sio.mutex.Unlock()
+
+	for _, socket := range sockets {
+		sio.disconnected(socket)
+	}
+}
+
+func (sio *socketIOClient) disconnected(socket *SocketIOSocket) {
+	namespace, _ := sio.namespace(socket.Namespace)
+	if onDisconnect := namespace.disconnectHandler(); onDisconnect != nil {
+		onDisconnect(socket)
+	}
+}
+
+// The namespace, nil for the main namespace when no namespaces are configured.
+func (sio *socketIOClient) namespace(name string) (*SocketIONamespace, bool) {
+	if sio.opts.Namespaces == nil {
+		return nil, name == _SOCKETIO_MAIN_NAMESPACE
+	}
+	namespace, ok := sio.opts.Namespaces[name]
+	return namespace, ok
+}
+
+func (sio *socketIOClient) socket(namespace string) *SocketIOSocket {
+	sio.mutex.Lock()
+	defer sio.mutex.Unlock()
+
+	return sio.sockets[namespace]
+}
+
+// Whether the socket was still connected.
+func (sio *socketIOClient) removeSocket(socket *SocketIOSocket) bool {
+	sio.mutex.Lock()
+	defer sio.mutex.Unlock()
+
+	if sio.sockets[socket.Namespace] != socket {
+		return false
+	}
+	delete(sio.sockets, socket.Namespace)
+	return true
+}
+
+func (sio *socketIOClient) connectedSockets() []*SocketIOSocket {
+	sio.mutex.Lock()
+	defer sio.mutex.Unlock()
+
+	sockets := make([]*SocketIOSocket, 0, len(sio.sockets))
+	for _, socket := range sio.sockets {
+		sockets = append(sockets, socket)
+	}
+	return sockets
+}
+
+func engineIOFrame(kind byte, payload []byte) frame {
+	return frame{
+		messageType: websocket.TextMessage,
+		data:        append([]byte{kind}, payload...),
+	}
+}
+
+// Parses a Socket.IO packet, without the type of the Engine.IO packet carrying it:
+// <type>[<namespace>,][<ack id>][<payload>]
+func parseSocketIOPacket(data []byte) (socketIOPacket, error) {
+	if len(data) == 0 {
+		return socketIOPacket{}, fmt.Errorf("%w: empty packet", ErrInvalidSocketIOPacket)
+	}
+
+	packet := socketIOPacket{
+		kind:      data[0],
+		namespace: _SOCKETIO_MAIN_NAMESPACE,
+	}
+	switch packet.kind {
+	case _SOCKETIO_BINARY_EVENT, _SOCKETIO_BINARY_ACK:
+		return socketIOPacket{}, ErrSocketIOBinaryUnsupported
+	case _SOCKETIO_CONNECT, _SOCKETIO_DISCONNECT, _SOCKETIO_EVENT, _SOCKETIO_ACK, _SOCKETIO_CONNECT_ERROR:
+	default:
+		return socketIOPacket{}, fmt.Errorf("%w: unknown packet type %q", ErrInvalidSocketIOPacket, packet.kind)
+	}
+
+	rest := data[1:]
+	if len(rest) > 0 && rest[0] == '/' {
+		end := bytes.IndexByte(rest, ',')
+		if end == -1 {
+			end = len(rest)
+		}
+		packet.namespace = string(rest[:end])
+		rest = rest[end:]
+		if len(rest) > 0 {
+			rest = rest[1:]
+		}
+	}
+
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 {
+		ackID, err := strconv.ParseUint(string(rest[:digits]), 10, 64)
+		if err != nil {
+			return socketIOPacket{}, fmt.Errorf("%w: invalid ack id", ErrInvalidSocketIOPacket)
+		}
+		packet.ackID = &ackID
+	}
+	packet.payload = rest[digits:]
+
+	return packet, nil
+}
+
+func encodeSocketIOPacket(packet socketIOPacket) frame {
+	data := []byte{_ENGINEIO_MESSAGE, packet.kind}
+	if packet.namespace != _SOCKETIO_MAIN_NAMESPACE {
+		data = append(data, packet.namespace...)
+		data = append(data, ',')
+	}
+	if packet.ackID != nil {
+		data = strconv.AppendUint(data, *packet.ackID, 10)
+	}
+	data = append(data, packet.payload...)
+
+	return frame{messageType: websocket.TextMessage, data: data}
+}
+
+func encodeSocketIOEvent(namespace string, event string, args []any) (frame, error) {
+	payload, err := json.Marshal(append([]any{event}, args...))
+	if err != nil {
+		return frame{}, fmt.Errorf("failed to encode Socket.IO event %q: %w", event, err)
+	}
+	return encodeSocketIOPacket(socketIOPacket{
+		kind:      _SOCKETIO_EVENT,
+		namespace: namespace,
+		payload:   payload,
+	}), nil
+}
@@ -0,0 +1,278 @@
+package magicsockets_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Socket.IO", func() {
+	var (
+		ms         magicsockets.MagicSocket
+		httpServer *httptest.Server
+
+		main      *magicsockets.SocketIONamespace
+		admin     *magicsockets.SocketIONamespace
+		opts      magicsockets.SocketIOOpts
+		rateLimit magicsockets.RateLimit
+	)
+
+	BeforeEach(func() {
+		main = magicsockets.NewSocketIONamespace()
+		admin = magicsockets.NewSocketIONamespace()
+		opts = magicsockets.SocketIOOpts{
+			Namespaces: map[string]*magicsockets.SocketIONamespace{
+				"/":      main,
+				"/admin": admin,
+			},
+		}
+		rateLimit = magicsockets.RateLimit{}
+	})
+
+	JustBeforeEach(func() {
+		ms = magicsockets.New(magicsockets.MagicSocketOpts{RateLimit: rateLimit})
+		handler, err := ms.SocketIOHandler(opts)
+		Expect(err).ToNot(HaveOccurred())
+
+		mux := http.NewServeMux()
+		mux.Handle("/socket.io/", handler)
+		httpServer = httptest.NewServer(mux)
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+		httpServer.Close()
+	})
+
+	socketIOURL := func(query string) string {
+		return "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/socket.io/?" + query
+	}
+
+	read := func(conn *websocket.Conn) string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, message, err := conn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		return string(message)
+	}
+
+	write := func(conn *websocket.Conn, packet string) {
+		Expect(conn.WriteMessage(websocket.TextMessage, []byte(packet))).To(Succeed())
+	}
+
+	// Opens an Engine.IO session, and connects to the main namespace.
+	connect := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(socketIOURL("EIO=4&transport=websocket"), nil)
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(func() { conn.Close() })
+
+		Expect(read(conn)).To(HavePrefix("0{"))
+		write(conn, "40")
+		Expect(read(conn)).To(MatchRegexp(`^40\{"sid":"[^"]+"\}$`))
+		return conn
+	}
+
+	It("Opens Engine.IO sessions", func() {
+		conn, _, err := websocket.DefaultDialer.Dial(socketIOURL("EIO=4&transport=websocket"), nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+
+		open := read(conn)
+		Expect(open).To(HavePrefix("0"))
+
+		var handshake struct {
+			SID          string   `json:"sid"`
+			Upgrades     []string `json:"upgrades"`
+			PingInterval int      `json:"pingInterval"`
+			PingTimeout  int      `json:"pingTimeout"`
+			MaxPayload   int      `json:"maxPayload"`
+		}
+		Expect(json.Unmarshal([]byte(open[1:]), &handshake)).To(Succeed())
+		Expect(handshake.SID).ToNot(BeEmpty())
+		Expect(handshake.Upgrades).To(BeEmpty())
+		Expect(handshake.PingInterval).To(Equal(25000))
+		Expect(handshake.PingTimeout).To(Equal(20000))
+		Expect(handshake.MaxPayload).To(Equal(1000000))
+
+		Eventually(ms.GetClients).Should(HaveLen(1))
+	})
+
+	It("Rejects unsupported handshakes", func() {
+		for query, expected := range map[string]string{
+			"EIO=3&transport=websocket":         `{"code":5,"message":"Unsupported protocol version"}`,
+			"EIO=4&transport=polling":           `{"code":0,"message":"Transport unknown"}`,
+			"EIO=4&transport=websocket&sid=abc": `{"code":1,"message":"Session ID unknown"}`,
+		} {
+			res, err := http.Get(httpServer.URL + "/socket.io/?" + query)
+			Expect(err).ToNot(HaveOccurred())
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(expected))
+		}
+	})
+
+	It("Connects to namespaces", func() {
+		admin.OnConnect(func(socket *magicsockets.SocketIOSocket) error {
+			var auth struct {
+				Token string `json:"token"`
+			}
+			json.Unmarshal(socket.Auth, &auth)
+			if auth.Token != "secret" {
+				return errors.New("Not authorized")
+			}
+			return nil
+		})
+
+		conn := connect()
+
+		write(conn, `40/admin,{"token":"wrong"}`)
+		Expect(read(conn)).To(Equal(`44/admin,{"message":"Not authorized"}`))
+
+		write(conn, `40/admin,{"token":"secret"}`)
+		Expect(read(conn)).To(MatchRegexp(`^40/admin,\{"sid":"[^"]+"\}$`))
+
+		write(conn, `40/unknown,`)
+		Expect(read(conn)).To(Equal(`44/unknown,{"message":"Invalid namespace"}`))
+	})
+
+	It("Calls event handlers, which can acknowledge events and emit", func() {
+		// Asserted by the spec, since handlers don't run in its goroutine.
+		received := make(chan []json.RawMessage, 1)
+		main.On("hello", func(socket *magicsockets.SocketIOSocket, args []json.RawMessage, ack magicsockets.SocketIOAck) error {
+			received <- args
+			if err := socket.Emit("greeting", "hi", 1); err != nil {
+				return err
+			}
+			return ack("world")
+		})
+
+		conn := connect()
+		write(conn, `4212["hello","a",{"b":1}]`)
+		Expect(read(conn)).To(Equal(`42["greeting","hi",1]`))
+		Expect(read(conn)).To(Equal(`4312["world"]`))
+
+		var args []json.RawMessage
+		Eventually(received).Should(Receive(&args))
+		Expect(args).To(HaveLen(2))
+		Expect(string(args[0])).To(Equal(`"a"`))
+	})
+
+	It("Disconnects sockets from namespaces", func() {
+		disconnected := make(chan string, 1)
+		admin.OnDisconnect(func(socket *magicsockets.SocketIOSocket) {
+			disconnected <- socket.Namespace
+		})
+		admin.On("leave", func(socket *magicsockets.SocketIOSocket, args []json.RawMessage, ack magicsockets.SocketIOAck) error {
+			return socket.Disconnect()
+		})
+
+		conn := connect()
+		write(conn, `40/admin,`)
+		Expect(read(conn)).To(HavePrefix("40/admin,"))
+
+		write(conn, `42/admin,["leave"]`)
+		Expect(read(conn)).To(Equal(`41/admin,`))
+		Eventually(disconnected).Should(Receive(Equal("/admin")))
+
+		write(conn, `40/admin,`)
+		Expect(read(conn)).To(HavePrefix("40/admin,"))
+		Expect(conn.Close()).To(Succeed())
+		Eventually(disconnected).Should(Receive(Equal("/admin")))
+	})
+
+	It("Maps rooms to topics", func() {
+		main.On("join", func(socket *magicsockets.SocketIOSocket, args []json.RawMessage, ack magicsockets.SocketIOAck) error {
+			var room string
+			if err := json.Unmarshal(args[0], &room); err != nil {
+				return err
+			}
+			socket.Join(room)
+			return ack(socket.Rooms())
+		})
+
+		conn := connect()
+		write(conn, `421["join","news"]`)
+		Expect(read(conn)).To(Equal(`431[["news"]]`))
+
+		message, err := magicsockets.EncodeEvent("headline", map[string]string{"title": "Hello"})
+		Expect(err).ToNot(HaveOccurred())
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{"sports"}}}}, message)
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{"news"}}}}, message)
+		Expect(read(conn)).To(Equal(`42["headline",{"title":"Hello"}]`))
+
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{"news"}}}}, []byte("plain"))
+		Expect(read(conn)).To(Equal(`42["message","plain"]`))
+	})
+
+	Context("Without namespaces", func() {
+		BeforeEach(func() {
+			opts.Namespaces = nil
+		})
+
+		It("Passes events to the event routers", func() {
+			events := magicsockets.NewEventRouter()
+			events.On("greet", func(ec *magicsockets.EventContext) error {
+				return ec.Reply("greeted", ec.Data)
+			})
+			ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{Key: "socket.io", Events: events}, nil
+			})
+
+			conn := connect()
+			write(conn, `42["greet",{"name":"world"}]`)
+			Expect(read(conn)).To(Equal(`42["greeted",{"name":"world"}]`))
+
+			write(conn, `40/admin,`)
+			Expect(read(conn)).To(Equal(`44/admin,{"message":"Invalid namespace"}`))
+		})
+	})
+
+	Context("With a short ping interval", func() {
+		BeforeEach(func() {
+			opts.PingInterval = 50 * time.Millisecond
+			opts.PingTimeout = 50 * time.Millisecond
+		})
+
+		It("Pings clients, disconnecting those not answering", func() {
+			conn := connect()
+
+			for i := 0; i < 3; i++ {
+				Expect(read(conn)).To(Equal("2"))
+				write(conn, "3")
+			}
+			Expect(ms.GetClients()).To(HaveLen(1))
+
+			Expect(read(conn)).To(Equal("2"))
+			Eventually(ms.GetClients).Should(BeEmpty())
+		})
+
+		Context("And a rate limit", func() {
+			BeforeEach(func() {
+				rateLimit = magicsockets.RateLimit{MessagesPerSecond: 1, Action: magicsockets.RateLimitClose}
+			})
+
+			It("Doesn't charge pongs to the rate limit", func() {
+				conn := connect()
+
+				for i := 0; i < 3; i++ {
+					Expect(read(conn)).To(Equal("2"))
+					write(conn, "3")
+				}
+				Expect(ms.GetClients()).To(HaveLen(1))
+			})
+		})
+	})
+})
@@ -0,0 +1,175 @@
+package magicsockets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	_DEFAULT_SSE_KEEP_ALIVE = 15 * time.Second
+)
+
+// Serves clients over Server-Sent Events, for clients that can only receive messages.
+//
+// Text messages are sent as "message" events, one "data" line per line of the message.
+// Binary messages are sent base64 encoded, as "binary" events.
+type SSEOpts struct {
+	// How often a comment is sent to keep proxies from closing idle streams.
+	// Defaults to _DEFAULT_SSE_KEEP_ALIVE.
+	KeepAlive time.Duration
+}
+
+// Stream of a client connected through Server-Sent Events.
+type sseConn struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	// Serializes writes, and keeps the stream from being written once closed.
+	mutex *sync.Mutex
+	// Closed once the stream is closed.
+	done      chan struct{}
+	closeOnce *sync.Once
+	// Done once the client goes away.
+	requestDone <-chan struct{}
+}
+
+// Returns an http.Handler serving Server-Sent Events streams, registering clients through the OnConnect of the server.
+// Clients are disconnected once they close the stream.
+func (ms *magicSocket) SSEHandler(opts SSEOpts) (http.Handler, error) {
+	if err := ms.subscribeBroker(); err != nil {
+		return nil, err
+	}
+
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = _DEFAULT_SSE_KEEP_ALIVE
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		var conn *sseConn
+		ms.handshake(w, r, func(w http.ResponseWriter, r *http.Request) (Conn, error) {
+			var err error
+			conn, err = newSSEConn(w, r, opts)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}, nil)
+
+		// The stream can't be written once the handler returns.
+		if conn != nil {
+			<-conn.done
+		}
+	}), nil
+}
+
+func newSSEConn(w http.ResponseWriter, r *http.Request, opts SSEOpts) (*sseConn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response writer doesn't support flushing")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Disables buffering by nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	conn := &sseConn{
+		w:           w,
+		flusher:     flusher,
+		mutex:       &sync.Mutex{},
+		done:        make(chan struct{}),
+		closeOnce:   &sync.Once{},
+		requestDone: r.Context().Done(),
+	}
+	go conn.keepAlive(opts.KeepAlive)
+	return conn, nil
+}
+
+func (c *sseConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Clients can't send messages over the stream, so this blocks until it's closed.
+func (c *sseConn) ReadMessage() (int, []byte, error) {
+	select {
+	case <-c.done:
+	case <-c.requestDone:
+	}
+	return 0, nil, ErrTransportClosed
+}
+
+func (c *sseConn) WriteMessage(messageType int, data []byte) error {
+	var event bytes.Buffer
+	if messageType == websocket.BinaryMessage {
+		event.WriteString("event: binary\n")
+		data = []byte(base64.StdEncoding.EncodeToString(data))
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(bytes.TrimSuffix(line, []byte("\r")))
+		event.WriteString("\n")
+	}
+	event.WriteString("\n")
+
+	return c.write(event.Bytes())
+}
+
+func (c *sseConn) write(data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrTransportClosed
+	default:
+	}
+
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// Writes aren't bounded by deadlines.
+func (c *sseConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sseConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		close(c.done)
+	})
+	return nil
+}
@@ -0,0 +1,675 @@
+package magicsockets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	_STOMP_SUBPROTOCOL = "v12.stomp"
+	_STOMP_VERSION     = "1.2"
+
+	_DEFAULT_STOMP_MAX_FRAME_SIZE = 1000000
+	// Messages of a subscription waiting to be acknowledged, beyond which the oldest can't be acknowledged anymore.
+	_STOMP_MAX_PENDING_ACKS = 1000
+)
+
+// STOMP 1.2 commands.
+const (
+	_STOMP_CONNECT     = "CONNECT"
+	_STOMP_STOMP       = "STOMP"
+	_STOMP_SEND        = "SEND"
+	_STOMP_SUBSCRIBE   = "SUBSCRIBE"
+	_STOMP_UNSUBSCRIBE = "UNSUBSCRIBE"
+	_STOMP_ACK         = "ACK"
+	_STOMP_NACK        = "NACK"
+	_STOMP_BEGIN       = "BEGIN"
+	_STOMP_COMMIT      = "COMMIT"
+	_STOMP_ABORT       = "ABORT"
+	_STOMP_DISCONNECT  = "DISCONNECT"
+
+	_STOMP_CONNECTED = "CONNECTED"
+	_STOMP_MESSAGE   = "MESSAGE"
+	_STOMP_RECEIPT   = "RECEIPT"
+	_STOMP_ERROR     = "ERROR"
+)
+
+var (
+	ErrInvalidSTOMPFrame = errors.New("invalid STOMP frame")
+)
+
+// Serves STOMP 1.2 clients, negotiating the "v12.stomp" websocket subprotocol.
+//
+// Subscriptions are mapped to the topics of the client, their destination being the topic,
+// so emit rules match them. Messages emitted to topics are sent as a MESSAGE frame
+// to each subscription of the client to one of them, while other messages, e.g. written with WriteMessage,
+// are sent to every subscription of the client.
+// Transactions aren't supported.
+type STOMPOpts struct {
+	// Called on the CONNECT frame of the client, e.g. to check its login and passcode.
+	// Returning an error sends it to the client as an ERROR frame, and closes the connection.
+	OnConnect func(session *STOMPSession) error
+	// Called for the SEND frames of the client. Returning an error sends it to the client as an ERROR frame,
+	// and closes the connection.
+	// When nil, they are passed on to the OnIncoming hook and the event routers as an Event envelope
+	// named after the destination, whose data is the body if it's JSON, or the body as a JSON string otherwise.
+	OnSend func(session *STOMPSession, message STOMPMessage) error
+	// Called when the client acknowledges, or refuses, messages of a subscription in client or client-individual mode,
+	// with the IDs of the messages, in the order they were sent.
+	OnAck  func(session *STOMPSession, subscription STOMPSubscription, messageIDs []string)
+	OnNack func(session *STOMPSession, subscription STOMPSubscription, messageIDs []string)
+
+	// Maximum size of the frames read from clients. Defaults to _DEFAULT_STOMP_MAX_FRAME_SIZE.
+	MaxFrameSize int
+}
+
+type STOMPAckMode string
+
+const (
+	// Messages are considered acknowledged once sent.
+	STOMPAckAuto STOMPAckMode = "auto"
+	// Acknowledging a message acknowledges every message of the subscription sent before it.
+	STOMPAckClient STOMPAckMode = "client"
+	// Messages are acknowledged one by one.
+	STOMPAckClientIndividual STOMPAckMode = "client-individual"
+)
+
+type STOMPSubscription struct {
+	ID          string
+	Destination string
+	Ack         STOMPAckMode
+}
+
+// Message sent by the client with a SEND frame.
+type STOMPMessage struct {
+	Destination string
+	// Every header of the frame, including the destination.
+	Headers map[string]string
+	Body    []byte
+}
+
+// Connection of a STOMP client, once it has sent its CONNECT frame.
+type STOMPSession struct {
+	ID     string
+	Client ClientConn
+	// Headers of the CONNECT frame, e.g. login and passcode.
+	Headers map[string]string
+
+	stomp *stompClient
+}
+
+// Protocol of a STOMP client.
+type stompClient struct {
+	cc   *client
+	opts STOMPOpts
+
+	// Guards session and subscriptions. Never held while calling out of the client.
+	mutex *sync.Mutex
+	// Nil until the client is connected.
+	session *STOMPSession
+	// In the order they were made.
+	subscriptions []*stompSubscription
+	// Guards updating the topics of the client on SUBSCRIBE and UNSUBSCRIBE.
+	topicsMutex *sync.Mutex
+}
+
+type stompSubscription struct {
+	STOMPSubscription
+	// IDs of the messages waiting to be acknowledged, oldest first.
+	pending []string
+}
+
+type stompFrame struct {
+	command string
+	// Only the first occurrence of repeated headers is kept.
+	headers map[string]string
+	body    []byte
+}
+
+type stompHeader struct {
+	name  string
+	value string
+}
+
+// Subscriptions of the client, in the order they were made.
+func (s *STOMPSession) Subscriptions() []STOMPSubscription {
+	s.stomp.mutex.Lock()
+	defer s.stomp.mutex.Unlock()
+
+	subscriptions := make([]STOMPSubscription, 0, len(s.stomp.subscriptions))
+	for _, subscription := range s.stomp.subscriptions {
+		subscriptions = append(subscriptions, subscription.STOMPSubscription)
+	}
+	return subscriptions
+}
+
+// Returns an http.Handler serving STOMP clients over websockets.
+// Clients are registered through the OnConnect of the server, like those connecting through Handler,
+// and must ask for the "v12.stomp" subprotocol.
+func (ms *magicSocket) STOMPHandler(opts STOMPOpts) (http.Handler, error) {
+	if err := ms.subscribeBroker(); err != nil {
+		return nil, err
+	}
+
+	if opts.MaxFrameSize == 0 {
+		opts.MaxFrameSize = _DEFAULT_STOMP_MAX_FRAME_SIZE
+	}
+
+	upgrade := ms.subprotocolUpgrade(_STOMP_SUBPROTOCOL)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !contains(websocket.Subprotocols(r), _STOMP_SUBPROTOCOL) {
+			http.Error(w, fmt.Sprintf("the %s subprotocol is required", _STOMP_SUBPROTOCOL), http.StatusBadRequest)
+			return
+		}
+
+		ms.handshake(w, r, upgrade, func(cc *client) clientProtocol {
+			return &stompClient{
+				cc:          cc,
+				opts:        opts,
+				mutex:       &sync.Mutex{},
+				topicsMutex: &sync.Mutex{},
+			}
+		})
+	}), nil
+}
+
+// Waits for the CONNECT frame of the client.
+func (sc *stompClient) start(conn ControlConn) error {
+	conn.SetReadLimit(int64(sc.opts.MaxFrameSize))
+	return nil
+}
+
+// Sends the message as a MESSAGE frame to each subscription it's for.
+func (sc *stompClient) encode(ctx context.Context, messageType int, data []byte) ([]frame, error) {
+	topics := emittedTopics(ctx)
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	frames := []frame{}
+	for _, subscription := range sc.subscriptions {
+		if topics != nil && !contains(topics, subscription.Destination) {
+			continue
+		}
+
+		messageID := uuid.NewString()
+		headers := []stompHeader{
+			{"subscription", subscription.ID},
+			{"message-id", messageID},
+			{"destination", subscription.Destination},
+		}
+		if subscription.Ack != STOMPAckAuto {
+			headers = append(headers, stompHeader{"ack", messageID})
+			subscription.pending = append(subscription.pending, messageID)
+			if len(subscription.pending) > _STOMP_MAX_PENDING_ACKS {
+				subscription.pending = subscription.pending[1:]
+			}
+		}
+		if messageType == websocket.BinaryMessage {
+			headers = append(headers, stompHeader{"content-type", "application/octet-stream"})
+		}
+
+		frames = append(frames, frame{
+			messageType: messageType,
+			data:        encodeSTOMPFrame(_STOMP_MESSAGE, headers, data),
+		})
+	}
+	return frames, nil
+}
+
+func (sc *stompClient) decode(messageType int, data []byte) (*frame, error) {
+	received, err := parseSTOMPFrame(data)
+	if err != nil {
+		return nil, sc.fail(nil, "malformed frame", err)
+	}
+	// Heart-beat.
+	if received == nil {
+		return nil, nil
+	}
+
+	sc.mutex.Lock()
+	session := sc.session
+	sc.mutex.Unlock()
+
+	switch {
+	case received.command == _STOMP_CONNECT || received.command == _STOMP_STOMP:
+		if session != nil {
+			return nil, sc.fail(received, "already connected", nil)
+		}
+		return nil, sc.connect(received)
+	case session == nil:
+		return nil, sc.fail(received, "not connected", fmt.Errorf("%w: %s frame sent before CONNECT", ErrInvalidSTOMPFrame, received.command))
+	}
+
+	var incoming *frame
+	switch received.command {
+	case _STOMP_SEND:
+		incoming, err = sc.send(session, received)
+	case _STOMP_SUBSCRIBE:
+		err = sc.subscribe(received)
+	case _STOMP_UNSUBSCRIBE:
+		err = sc.unsubscribe(received)
+	case _STOMP_ACK, _STOMP_NACK:
+		err = sc.acknowledge(session, received)
+	case _STOMP_DISCONNECT:
+		if err := sc.writeReceipt(received); err != nil {
+			return nil, err
+		}
+		return nil, sc.cc.Close()
+	case _STOMP_BEGIN, _STOMP_COMMIT, _STOMP_ABORT:
+		return nil, sc.fail(received, "transactions are not supported", nil)
+	default:
+		return nil, sc.fail(received, "unknown command", fmt.Errorf("%w: unknown command %q", ErrInvalidSTOMPFrame, received.command))
+	}
+	if err != nil {
+		return nil, sc.fail(received, err.Error(), err)
+	}
+
+	return incoming, sc.writeReceipt(received)
+}
+
+// Heart-beats are EOLs only, see parseSTOMPFrame.
+func (sc *stompClient) keepAlive(messageType int, data []byte) bool {
+	return len(bytes.TrimLeft(data, "\r\n")) == 0
+}
+
+func (sc *stompClient) ownsLiveness() bool {
+	return false
+}
+
+func (sc *stompClient) connect(received *stompFrame) error {
+	if !contains(strings.Split(received.headers["accept-version"], ","), _STOMP_VERSION) {
+		return sc.fail(received, "unsupported protocol version", fmt.Errorf("supported protocol versions are %s", _STOMP_VERSION))
+	}
+
+	session := &STOMPSession{
+		ID:      sc.cc.id,
+		Client:  sc.cc,
+		Headers: received.headers,
+		stomp:   sc,
+	}
+	if sc.opts.OnConnect != nil {
+		if err := sc.opts.OnConnect(session); err != nil {
+			return sc.fail(received, "connection refused", err)
+		}
+	}
+
+	sc.mutex.Lock()
+	sc.session = session
+	sc.mutex.Unlock()
+
+	return sc.cc.writeFrames(context.Background(), frame{
+		messageType: websocket.TextMessage,
+		data: encodeSTOMPFrame(_STOMP_CONNECTED, []stompHeader{
+			{"version", _STOMP_VERSION},
+			// Heartbeats are left to websockets.
+			{"heart-beat", "0,0"},
+			{"session", session.ID},
+			{"server", "magicsockets"},
+		}, nil),
+	})
+}
+
+// Calls OnSend, or returns the message as an Event envelope if it's not set.
+func (sc *stompClient) send(session *STOMPSession, received *stompFrame) (*frame, error) {
+	destination, err := requireSTOMPHeader(received, "destination")
+	if err != nil {
+		return nil, err
+	}
+
+	if sc.opts.OnSend != nil {
+		return nil, sc.opts.OnSend(session, STOMPMessage{
+			Destination: destination,
+			Headers:     received.headers,
+			Body:        received.body,
+		})
+	}
+
+	event := Event{Event: destination}
+	if len(received.body) > 0 {
+		event.Data = received.body
+		if !json.Valid(received.body) {
+			event.Data, err = json.Marshal(string(received.body))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	message, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return &frame{messageType: websocket.TextMessage, data: message}, nil
+}
+
+// Adds the destination to the topics of the client.
+func (sc *stompClient) subscribe(received *stompFrame) error {
+	id, err := requireSTOMPHeader(received, "id")
+	if err != nil {
+		return err
+	}
+	destination, err := requireSTOMPHeader(received, "destination")
+	if err != nil {
+		return err
+	}
+	ack := STOMPAckMode(received.headers["ack"])
+	switch ack {
+	case "":
+		ack = STOMPAckAuto
+	case STOMPAckAuto, STOMPAckClient, STOMPAckClientIndividual:
+	default:
+		return fmt.Errorf("%w: unknown ack mode %q", ErrInvalidSTOMPFrame, ack)
+	}
+
+	sc.topicsMutex.Lock()
+	defer sc.topicsMutex.Unlock()
+
+	sc.mutex.Lock()
+	if sc.subscription(id) != nil {
+		sc.mutex.Unlock()
+		return fmt.Errorf("%w: subscription %q already exists", ErrInvalidSTOMPFrame, id)
+	}
+	sc.subscriptions = append(sc.subscriptions, &stompSubscription{
+		STOMPSubscription: STOMPSubscription{ID: id, Destination: destination, Ack: ack},
+	})
+	sc.mutex.Unlock()
+
+	if topics := sc.cc.GetTopics(); !contains(topics, destination) {
+		sc.cc.SetTopics(append(append([]string{}, topics...), destination))
+	}
+	return nil
+}
+
+// Removes the destination from the topics of the client, unless another subscription is for it.
+func (sc *stompClient) unsubscribe(received *stompFrame) error {
+	id, err := requireSTOMPHeader(received, "id")
+	if err != nil {
+		return err
+	}
+
+	sc.topicsMutex.Lock()
+	defer sc.topicsMutex.Unlock()
+
+	sc.mutex.Lock()
+	removed := sc.subscription(id)
+	if removed == nil {
+		sc.mutex.Unlock()
+		return fmt.Errorf("%w: unknown subscription %q", ErrInvalidSTOMPFrame, id)
+	}
+	subscribed := false
+	subscriptions := []*stompSubscription{}
+	for _, subscription := range sc.subscriptions {
+		if subscription == removed {
+			continue
+		}
+		subscriptions = append(subscriptions, subscription)
+		subscribed = subscribed || subscription.Destination == removed.Destination
+	}
+	sc.subscriptions = subscriptions
+	sc.mutex.Unlock()
+
+	if subscribed {
+		return nil
+	}
+	topics := []string{}
+	for _, topic := range sc.cc.GetTopics() {
+		if topic != removed.Destination {
+			topics = append(topics, topic)
+		}
+	}
+	sc.cc.SetTopics(topics)
+	return nil
+}
+
+// Handles ACK and NACK frames.
+func (sc *stompClient) acknowledge(session *STOMPSession, received *stompFrame) error {
+	id, err := requireSTOMPHeader(received, "id")
+	if err != nil {
+		return err
+	}
+
+	var (
+		subscription STOMPSubscription
+		messageIDs   []string
+	)
+	sc.mutex.Lock()
+	for _, s := range sc.subscriptions {
+		for i, pending := range s.pending {
+			if pending != id {
+				continue
+			}
+
+			subscription = s.STOMPSubscription
+			if s.Ack == STOMPAckClient {
+				messageIDs = append([]string{}, s.pending[:i+1]...)
+				s.pending = s.pending[i+1:]
+			} else {
+				messageIDs = []string{id}
+				s.pending = append(s.pending[:i:i], s.pending[i+1:]...)
+			}
+			break
+		}
+	}
+	sc.mutex.Unlock()
+
+	if messageIDs == nil {
+		return fmt.Errorf("%w: unknown message %q", ErrInvalidSTOMPFrame, id)
+	}
+
+	handler := sc.opts.OnAck
+	if received.command == _STOMP_NACK {
+		handler = sc.opts.OnNack
+	}
+	if handler != nil {
+		handler(session, subscription, messageIDs)
+	}
+	return nil
+}
+
+// Must be called while holding the mutex of the client.
+func (sc *stompClient) subscription(id string) *stompSubscription {
+	for _, subscription := range sc.subscriptions {
+		if subscription.ID == id {
+			return subscription
+		}
+	}
+	return nil
+}
+
+// Sends a RECEIPT frame if the client asked for one.
+func (sc *stompClient) writeReceipt(received *stompFrame) error {
+	receipt, ok := received.headers["receipt"]
+	if !ok {
+		return nil
+	}
+	return sc.cc.writeFrames(context.Background(), frame{
+		messageType: websocket.TextMessage,
+		data:        encodeSTOMPFrame(_STOMP_RECEIPT, []stompHeader{{"receipt-id", receipt}}, nil),
+	})
+}
+
+// Sends an ERROR frame and closes the connection, as required by STOMP.
+// received is the frame that caused the error, if any, and err its details.
+func (sc *stompClient) fail(received *stompFrame, message string, err error) error {
+	headers := []stompHeader{{"message", message}}
+	if received != nil {
+		if receipt, ok := received.headers["receipt"]; ok {
+			headers = append(headers, stompHeader{"receipt-id", receipt})
+		}
+	}
+	var body []byte
+	if err != nil {
+		headers = append(headers, stompHeader{"content-type", "text/plain"})
+		body = []byte(err.Error())
+	}
+
+	writeErr := sc.cc.writeFrames(context.Background(), frame{
+		messageType: websocket.TextMessage,
+		data:        encodeSTOMPFrame(_STOMP_ERROR, headers, body),
+	})
+	if closeErr := sc.cc.Close(); closeErr != nil {
+		return closeErr
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if err == nil {
+		err = errors.New(message)
+	}
+	return fmt.Errorf("STOMP client failed: %w", err)
+}
+
+func (sc *stompClient) closed() {}
+
+func requireSTOMPHeader(received *stompFrame, name string) (string, error) {
+	value, ok := received.headers[name]
+	if !ok {
+		return "", fmt.Errorf("%w: missing %s header in %s frame", ErrInvalidSTOMPFrame, name, received.command)
+	}
+	return value, nil
+}
+
+// Parses a STOMP frame, returning nil for heart-beats:
+// <command>EOL (<header>:<value>EOL)* EOL <body> NUL
+func parseSTOMPFrame(data []byte) (*stompFrame, error) {
+	// EOLs are allowed between frames, and used as heart-beats.
+	data = bytes.TrimLeft(data, "\r\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	readLine := func() (string, error) {
+		end := bytes.IndexByte(data, '\n')
+		if end == -1 {
+			return "", fmt.Errorf("%w: unterminated line", ErrInvalidSTOMPFrame)
+		}
+		line := data[:end]
+		data = data[end+1:]
+		return string(bytes.TrimSuffix(line, []byte("\r"))), nil
+	}
+
+	command, err := readLine()
+	if err != nil {
+		return nil, err
+	}
+	parsed := &stompFrame{command: command, headers: make(map[string]string)}
+	// Headers of CONNECT frames aren't escaped, for compatibility with STOMP 1.0.
+	escaped := command != _STOMP_CONNECT && command != _STOMP_STOMP
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid header %q", ErrInvalidSTOMPFrame, line)
+		}
+		if escaped {
+			if name, err = unescapeSTOMPHeader(name); err != nil {
+				return nil, err
+			}
+			if value, err = unescapeSTOMPHeader(value); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := parsed.headers[name]; !ok {
+			parsed.headers[name] = value
+		}
+	}
+
+	end := bytes.IndexByte(data, 0)
+	if contentLength, ok := parsed.headers["content-length"]; ok {
+		length, err := strconv.Atoi(contentLength)
+		if err != nil || length < 0 || length >= len(data) || data[length] != 0 {
+			return nil, fmt.Errorf("%w: body doesn't match content-length", ErrInvalidSTOMPFrame)
+		}
+		end = length
+	}
+	if end == -1 {
+		return nil, fmt.Errorf("%w: missing NUL terminator", ErrInvalidSTOMPFrame)
+	}
+	if end > 0 {
+		parsed.body = data[:end]
+	}
+
+	return parsed, nil
+}
+
+func encodeSTOMPFrame(command string, headers []stompHeader, body []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(command)
+	buffer.WriteByte('\n')
+	escaped := command != _STOMP_CONNECTED
+	for _, header := range headers {
+		name, value := header.name, header.value
+		if escaped {
+			name, value = escapeSTOMPHeader(name), escapeSTOMPHeader(value)
+		}
+		buffer.WriteString(name)
+		buffer.WriteByte(':')
+		buffer.WriteString(value)
+		buffer.WriteByte('\n')
+	}
+	if body != nil {
+		buffer.WriteString("content-length:")
+		buffer.WriteString(strconv.Itoa(len(body)))
+		buffer.WriteByte('\n')
+	}
+	buffer.WriteByte('\n')
+	buffer.Write(body)
+	buffer.WriteByte(0)
+	return buffer.Bytes()
+}
+
+var stompHeaderEscaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+
+func escapeSTOMPHeader(s string) string {
+	return stompHeaderEscaper.Replace(s)
+}
+
+func unescapeSTOMPHeader(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			builder.WriteByte(s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return "", fmt.Errorf("%w: unterminated escape sequence", ErrInvalidSTOMPFrame)
+		}
+		i++
+		switch s[i] {
+		case '\\':
+			builder.WriteByte('\\')
+		case 'r':
+			builder.WriteByte('\r')
+		case 'n':
+			builder.WriteByte('\n')
+		case 'c':
+			builder.WriteByte(':')
+		default:
+			return "", fmt.Errorf("%w: invalid escape sequence \\%c", ErrInvalidSTOMPFrame, s[i])
+		}
+	}
+	return builder.String(), nil
+}
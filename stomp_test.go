@@ -0,0 +1,325 @@
+package magicsockets_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+type stompTestFrame struct {
+	command string
+	headers map[string]string
+	body    string
+}
+
+func parseSTOMPTestFrame(data string) stompTestFrame {
+	ExpectWithOffset(1, data).To(HaveSuffix("\x00"))
+	head, body, _ := strings.Cut(strings.TrimSuffix(data, "\x00"), "\n\n")
+	lines := strings.Split(head, "\n")
+
+	frame := stompTestFrame{command: lines[0], headers: map[string]string{}, body: body}
+	for _, line := range lines[1:] {
+		name, value, _ := strings.Cut(line, ":")
+		frame.headers[name] = value
+	}
+	return frame
+}
+
+var _ = Describe("STOMP", func() {
+	var (
+		ms         magicsockets.MagicSocket
+		httpServer *httptest.Server
+
+		opts      magicsockets.STOMPOpts
+		events    *magicsockets.EventRouter
+		sent      chan magicsockets.STOMPMessage
+		rateLimit magicsockets.RateLimit
+	)
+
+	BeforeEach(func() {
+		sent = make(chan magicsockets.STOMPMessage, 1)
+		opts = magicsockets.STOMPOpts{
+			OnConnect: func(session *magicsockets.STOMPSession) error {
+				if session.Headers["passcode"] == "guess" {
+					return errors.New("wrong passcode")
+				}
+				return nil
+			},
+			OnSend: func(session *magicsockets.STOMPSession, message magicsockets.STOMPMessage) error {
+				if string(message.Body) == "refused" {
+					return errors.New("orders are closed")
+				}
+				sent <- message
+				return nil
+			},
+		}
+		events = magicsockets.NewEventRouter()
+		rateLimit = magicsockets.RateLimit{}
+	})
+
+	JustBeforeEach(func() {
+		ms = magicsockets.New(magicsockets.MagicSocketOpts{
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{Key: r.URL.Query().Get("key")}, nil
+			},
+			Events:    events,
+			RateLimit: rateLimit,
+		})
+		handler, err := ms.STOMPHandler(opts)
+		Expect(err).ToNot(HaveOccurred())
+		httpServer = httptest.NewServer(handler)
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+		httpServer.Close()
+	})
+
+	read := func(conn *websocket.Conn) stompTestFrame {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, message, err := conn.ReadMessage()
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		return parseSTOMPTestFrame(string(message))
+	}
+
+	write := func(conn *websocket.Conn, frame string) {
+		ExpectWithOffset(1, conn.WriteMessage(websocket.TextMessage, []byte(frame+"\x00"))).To(Succeed())
+	}
+
+	dial := func() *websocket.Conn {
+		dialer := websocket.Dialer{Subprotocols: []string{"v12.stomp"}}
+		conn, res, err := dialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/?key=stomp", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.Header.Get("Sec-WebSocket-Protocol")).To(Equal("v12.stomp"))
+		DeferCleanup(func() { conn.Close() })
+		return conn
+	}
+
+	connect := func() *websocket.Conn {
+		conn := dial()
+		write(conn, "CONNECT\naccept-version:1.0,1.1,1.2\nhost:localhost\n\n")
+		connected := read(conn)
+		Expect(connected.command).To(Equal("CONNECTED"))
+		Expect(connected.headers).To(HaveKeyWithValue("version", "1.2"))
+		return conn
+	}
+
+	emit := func(topic string, message string) {
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{topic}}}}, []byte(message))
+	}
+
+	It("Requires the v12.stomp subprotocol", func() {
+		_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/", nil)
+		Expect(err).To(HaveOccurred())
+		Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(ms.GetClients()).To(BeEmpty())
+	})
+
+	It("Maps subscriptions to topics", func() {
+		conn := connect()
+
+		write(conn, "SUBSCRIBE\nid:sub-0\ndestination:/topic/news\nreceipt:r-1\n\n")
+		Expect(read(conn)).To(Equal(stompTestFrame{command: "RECEIPT", headers: map[string]string{"receipt-id": "r-1"}}))
+		Expect(ms.GetClientsByKey("stomp")[0].GetTopics()).To(Equal([]string{"/topic/news"}))
+
+		emit("/topic/news", "hello")
+		message := read(conn)
+		Expect(message.command).To(Equal("MESSAGE"))
+		Expect(message.headers).To(HaveKeyWithValue("subscription", "sub-0"))
+		Expect(message.headers).To(HaveKeyWithValue("destination", "/topic/news"))
+		Expect(message.headers).To(HaveKey("message-id"))
+		Expect(message.headers).ToNot(HaveKey("ack"))
+		Expect(message.body).To(Equal("hello"))
+
+		write(conn, "UNSUBSCRIBE\nid:sub-0\nreceipt:r-2\n\n")
+		Expect(read(conn).headers).To(HaveKeyWithValue("receipt-id", "r-2"))
+		Expect(ms.GetClientsByKey("stomp")[0].GetTopics()).To(BeEmpty())
+	})
+
+	It("Sends emitted messages to the subscriptions of the topics they were emitted to", func() {
+		conn := connect()
+		write(conn, "SUBSCRIBE\nid:news\ndestination:news\n\n")
+		write(conn, "SUBSCRIBE\nid:sports\ndestination:sports\nreceipt:subscribed\n\n")
+		Expect(read(conn).command).To(Equal("RECEIPT"))
+
+		emit("sports", "goal")
+		message := read(conn)
+		Expect(message.headers).To(HaveKeyWithValue("subscription", "sports"))
+		Expect(message.body).To(Equal("goal"))
+
+		// Written to every subscription.
+		Expect(ms.GetClientsByKey("stomp")[0].WriteMessage(websocket.TextMessage, []byte("direct"))).To(Succeed())
+		Expect([]string{read(conn).headers["subscription"], read(conn).headers["subscription"]}).To(Equal([]string{"news", "sports"}))
+	})
+
+	Context("Acknowledgements", func() {
+		var acks chan []string
+
+		BeforeEach(func() {
+			acks = make(chan []string, 10)
+			opts.OnAck = func(session *magicsockets.STOMPSession, subscription magicsockets.STOMPSubscription, messageIDs []string) {
+				acks <- append([]string{"ack", subscription.ID}, messageIDs...)
+			}
+			opts.OnNack = func(session *magicsockets.STOMPSession, subscription magicsockets.STOMPSubscription, messageIDs []string) {
+				acks <- append([]string{"nack", subscription.ID}, messageIDs...)
+			}
+		})
+
+		receive := func(conn *websocket.Conn, count int) []string {
+			ids := []string{}
+			for i := 0; i < count; i++ {
+				message := read(conn)
+				Expect(message.headers).To(HaveKeyWithValue("ack", message.headers["message-id"]))
+				ids = append(ids, message.headers["ack"])
+			}
+			return ids
+		}
+
+		It("Acknowledges every previous message in client mode", func() {
+			conn := connect()
+			write(conn, "SUBSCRIBE\nid:sub-0\ndestination:news\nack:client\nreceipt:subscribed\n\n")
+			Expect(read(conn).command).To(Equal("RECEIPT"))
+
+			for _, message := range []string{"first", "second", "third"} {
+				emit("news", message)
+			}
+			ids := receive(conn, 3)
+
+			write(conn, "ACK\nid:"+ids[1]+"\n\n")
+			Eventually(acks).Should(Receive(Equal([]string{"ack", "sub-0", ids[0], ids[1]})))
+			write(conn, "NACK\nid:"+ids[2]+"\n\n")
+			Eventually(acks).Should(Receive(Equal([]string{"nack", "sub-0", ids[2]})))
+		})
+
+		It("Acknowledges messages one by one in client-individual mode", func() {
+			conn := connect()
+			write(conn, "SUBSCRIBE\nid:sub-0\ndestination:news\nack:client-individual\nreceipt:subscribed\n\n")
+			Expect(read(conn).command).To(Equal("RECEIPT"))
+
+			emit("news", "first")
+			emit("news", "second")
+			ids := receive(conn, 2)
+
+			write(conn, "ACK\nid:"+ids[1]+"\n\n")
+			Eventually(acks).Should(Receive(Equal([]string{"ack", "sub-0", ids[1]})))
+			write(conn, "ACK\nid:"+ids[0]+"\n\n")
+			Eventually(acks).Should(Receive(Equal([]string{"ack", "sub-0", ids[0]})))
+		})
+
+		It("Fails on acknowledgements of unknown messages", func() {
+			conn := connect()
+			write(conn, "ACK\nid:unknown\n\n")
+
+			Expect(read(conn).command).To(Equal("ERROR"))
+			Eventually(ms.GetClients).Should(BeEmpty())
+		})
+	})
+
+	Context("SEND frames", func() {
+		It("Are handled by OnSend", func() {
+			conn := connect()
+			write(conn, "SEND\ndestination:/queue/orders\ncontent-type:text/plain\nreceipt:sent\n\nbuy")
+			Expect(read(conn).headers).To(HaveKeyWithValue("receipt-id", "sent"))
+
+			var message magicsockets.STOMPMessage
+			Eventually(sent).Should(Receive(&message))
+			Expect(message.Destination).To(Equal("/queue/orders"))
+			Expect(message.Headers).To(HaveKeyWithValue("content-type", "text/plain"))
+			Expect(string(message.Body)).To(Equal("buy"))
+		})
+
+		It("Send the errors of OnSend as ERROR frames", func() {
+			conn := connect()
+			write(conn, "SEND\ndestination:/queue/orders\nreceipt:sent\n\nrefused")
+			failure := read(conn)
+			Expect(failure.command).To(Equal("ERROR"))
+			Expect(failure.headers).To(HaveKeyWithValue("receipt-id", "sent"))
+			Expect(failure.body).To(Equal("orders are closed"))
+			Eventually(ms.GetClients).Should(BeEmpty())
+		})
+	})
+
+	Context("SEND frames without OnSend", func() {
+		BeforeEach(func() {
+			opts.OnSend = nil
+		})
+
+		It("Are routed as events named after their destination", func() {
+			routed := make(chan string, 2)
+			events.On("/queue/orders", func(ctx *magicsockets.EventContext) error {
+				routed <- string(ctx.Data)
+				return nil
+			})
+
+			conn := connect()
+			write(conn, "SEND\ndestination:/queue/orders\n\n{\"item\":\"book\"}")
+			write(conn, "SEND\ndestination:/queue/orders\n\nbuy")
+
+			Eventually(routed).Should(Receive(Equal(`{"item":"book"}`)))
+			Eventually(routed).Should(Receive(Equal(`"buy"`)))
+		})
+	})
+
+	It("Refuses connections failing OnConnect", func() {
+		conn := dial()
+		write(conn, "CONNECT\naccept-version:1.2\nlogin:user\npasscode:guess\n\n")
+		failure := read(conn)
+		Expect(failure.command).To(Equal("ERROR"))
+		Expect(failure.headers).To(HaveKeyWithValue("message", "connection refused"))
+		Expect(failure.body).To(Equal("wrong passcode"))
+		Eventually(ms.GetClients).Should(BeEmpty())
+	})
+
+	It("Refuses frames sent before CONNECT", func() {
+		conn := dial()
+		write(conn, "SUBSCRIBE\nid:sub-0\ndestination:news\n\n")
+
+		Expect(read(conn).command).To(Equal("ERROR"))
+		Eventually(ms.GetClients).Should(BeEmpty())
+	})
+
+	It("Disconnects clients sending DISCONNECT after sending the receipt", func() {
+		conn := connect()
+		write(conn, "DISCONNECT\nreceipt:bye\n\n")
+
+		Expect(read(conn)).To(Equal(stompTestFrame{command: "RECEIPT", headers: map[string]string{"receipt-id": "bye"}}))
+		Eventually(ms.GetClients).Should(BeEmpty())
+	})
+
+	Context("With a rate limit", func() {
+		BeforeEach(func() {
+			rateLimit = magicsockets.RateLimit{MessagesPerSecond: 1, MessageBurst: 2, Action: magicsockets.RateLimitClose}
+		})
+
+		It("Doesn't charge heart-beats to the rate limit", func() {
+			conn := connect()
+			for i := 0; i < 3; i++ {
+				Expect(conn.WriteMessage(websocket.TextMessage, []byte("\n"))).To(Succeed())
+			}
+
+			write(conn, "SEND\ndestination:/queue/orders\nreceipt:sent\n\nbuy")
+			Expect(read(conn).headers).To(HaveKeyWithValue("receipt-id", "sent"))
+		})
+	})
+
+	It("Escapes the headers of MESSAGE frames", func() {
+		conn := connect()
+		write(conn, "SUBSCRIBE\nid:sub-0\ndestination:a\\cb\\nc\nreceipt:subscribed\n\n")
+		Expect(read(conn).command).To(Equal("RECEIPT"))
+		Expect(ms.GetClientsByKey("stomp")[0].GetTopics()).To(Equal([]string{"a:b\nc"}))
+
+		emit("a:b\nc", "escaped")
+		_, message, err := conn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(message)).To(ContainSubstring("destination:a\\cb\\nc\n"))
+	})
+})
@@ -0,0 +1,264 @@
+package magicsockets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type TracingOpts struct {
+	// Tracing is disabled when nil. See the magicsocketsotel package for an OpenTelemetry Tracer.
+	Tracer Tracer
+
+	// Wraps emitted messages in a TraceEnvelope carrying the trace context of the emit,
+	// and unwraps incoming messages in a TraceEnvelope, linking their spans to the trace context they carry.
+	// This way, a client's reply can be linked to the emit that caused it.
+	PropagateInMessages bool
+}
+
+// Creates the spans of a MagicSocket, and propagates their trace context.
+// Implemented by the magicsocketsotel package, so the core package doesn't depend on a tracing library.
+type Tracer interface {
+	// Starts a span, as a child of the span of ctx unless opts.NewRoot is set.
+	Start(ctx context.Context, name string, opts SpanOpts) (context.Context, Span)
+	// The span carried by ctx, or nil if it carries none.
+	SpanFromContext(ctx context.Context) Span
+	// Returns ctx carrying span, e.g. to pass it to hooks along with the values of a client context.
+	ContextWithSpan(ctx context.Context, span Span) context.Context
+
+	// Writes the trace context of ctx into carrier.
+	Inject(ctx context.Context, carrier TraceCarrier)
+	// Reads the trace context in carrier, returning ctx carrying it.
+	Extract(ctx context.Context, carrier TraceCarrier) context.Context
+}
+
+type Span interface {
+	SetAttributes(attributes ...TraceAttribute)
+	AddEvent(name string, attributes ...TraceAttribute)
+	// Records the error, and marks the span as failed.
+	RecordError(err error)
+	End()
+}
+
+type SpanOpts struct {
+	Attributes []TraceAttribute
+	// Starts a trace of its own instead of a child of the span of the context.
+	NewRoot bool
+	Links   []Span
+}
+
+// Value is a string, an int or a bool.
+type TraceAttribute struct {
+	Key   string
+	Value any
+}
+
+// Holds trace context, e.g. the headers of a handshake or the TraceContext of a TraceEnvelope.
+// Matches the TextMapCarrier of OpenTelemetry.
+type TraceCarrier interface {
+	Get(key string) string
+	Set(key string, value string)
+	Keys() []string
+}
+
+// Message carrying the trace context it was sent with.
+type TraceEnvelope struct {
+	TraceContext map[string]string `json:"trace_context"`
+	// The original message. Messages that aren't valid JSON are encoded as JSON strings, see Encoding.
+	Data json.RawMessage `json:"data"`
+	// TraceEnvelopeText if Data is the original message encoded as a JSON string, empty if it's the message as is.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+const (
+	TraceEnvelopeText = "text"
+)
+
+const (
+	_SPAN_HANDSHAKE   = "magicsockets.handshake"
+	_SPAN_ON_CONNECT  = "magicsockets.on_connect"
+	_SPAN_EMIT        = "magicsockets.emit"
+	_SPAN_ON_INCOMING = "magicsockets.on_incoming"
+	_SPAN_ON_OUTGOING = "magicsockets.on_outgoing"
+	_SPAN_DELIVER     = "magicsockets.deliver"
+
+	_ATTRIBUTE_NAMESPACE    = traceAttributeKey("magicsockets.namespace")
+	_ATTRIBUTE_CLIENT_ID    = traceAttributeKey("magicsockets.client.id")
+	_ATTRIBUTE_CLIENT_KEY   = traceAttributeKey("magicsockets.client.key")
+	_ATTRIBUTE_FAN_OUT      = traceAttributeKey("magicsockets.emit.fan_out")
+	_ATTRIBUTE_MESSAGE_TYPE = traceAttributeKey("magicsockets.message.type")
+	_ATTRIBUTE_MESSAGE_SIZE = traceAttributeKey("magicsockets.message.size")
+	_ATTRIBUTE_POLICY       = traceAttributeKey("policy")
+	_ATTRIBUTE_ERROR        = traceAttributeKey("error")
+)
+
+type traceAttributeKey string
+
+func (k traceAttributeKey) String(value string) TraceAttribute {
+	return TraceAttribute{Key: string(k), Value: value}
+}
+
+func (k traceAttributeKey) Int(value int) TraceAttribute {
+	return TraceAttribute{Key: string(k), Value: value}
+}
+
+type tracing struct {
+	tracer              Tracer
+	propagateInMessages bool
+}
+
+func newTracing(opts TracingOpts) *tracing {
+	tracer := opts.Tracer
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+
+	return &tracing{
+		tracer:              tracer,
+		propagateInMessages: opts.PropagateInMessages && opts.Tracer != nil,
+	}
+}
+
+func (t *tracing) start(ctx context.Context, name string, attributes ...TraceAttribute) (context.Context, Span) {
+	return t.tracer.Start(ctx, name, SpanOpts{Attributes: attributes})
+}
+
+// The span of ctx, or one doing nothing if it carries none.
+func (t *tracing) span(ctx context.Context) Span {
+	if span := t.tracer.SpanFromContext(ctx); span != nil {
+		return span
+	}
+	return noopSpan{}
+}
+
+// Records the error, if any, and ends the span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// Wraps the message in a TraceEnvelope with the trace context of ctx.
+// Returns the message as is when not propagating trace context in messages.
+func (t *tracing) wrap(ctx context.Context, message []byte) []byte {
+	if !t.propagateInMessages || t.tracer.SpanFromContext(ctx) == nil {
+		return message
+	}
+
+	carrier := mapCarrier{}
+	t.tracer.Inject(ctx, carrier)
+
+	envelope := TraceEnvelope{
+		TraceContext: carrier,
+		Data:         json.RawMessage(message),
+	}
+	if !json.Valid(message) {
+		envelope.Data, _ = json.Marshal(string(message))
+		envelope.Encoding = TraceEnvelopeText
+	}
+
+	wrapped, err := json.Marshal(envelope)
+	if err != nil {
+		return message
+	}
+	return wrapped
+}
+
+// Unwraps a message in a TraceEnvelope, returning the original message and the span it was sent from,
+// nil if it carries none.
+// Messages that aren't in a TraceEnvelope are returned as is.
+func (t *tracing) unwrap(message []byte) ([]byte, Span) {
+	if !t.propagateInMessages {
+		return message, nil
+	}
+
+	var envelope TraceEnvelope
+	if err := json.Unmarshal(message, &envelope); err != nil || envelope.TraceContext == nil || envelope.Data == nil {
+		return message, nil
+	}
+
+	ctx := t.tracer.Extract(context.Background(), mapCarrier(envelope.TraceContext))
+
+	// Only messages wrapped as text are decoded: other JSON strings are messages of their own.
+	if envelope.Encoding == TraceEnvelopeText {
+		var text string
+		if err := json.Unmarshal(envelope.Data, &text); err == nil {
+			return []byte(text), t.tracer.SpanFromContext(ctx)
+		}
+	}
+	return envelope.Data, t.tracer.SpanFromContext(ctx)
+}
+
+// Reads the trace context of a handshake from its headers.
+func (t *tracing) extractRequest(r *http.Request) context.Context {
+	return t.tracer.Extract(r.Context(), headerCarrier(r.Header))
+}
+
+type mapCarrier map[string]string
+
+func (c mapCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c mapCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c mapCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+type headerCarrier http.Header
+
+func (c headerCarrier) Get(key string) string {
+	return http.Header(c).Get(key)
+}
+
+func (c headerCarrier) Set(key string, value string) {
+	http.Header(c).Set(key, value)
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, strings.ToLower(key))
+	}
+	return keys
+}
+
+// Used when tracing is disabled.
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, opts SpanOpts) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) SpanFromContext(ctx context.Context) Span {
+	return nil
+}
+
+func (noopTracer) ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return ctx
+}
+
+func (noopTracer) Inject(ctx context.Context, carrier TraceCarrier) {}
+
+func (noopTracer) Extract(ctx context.Context, carrier TraceCarrier) context.Context {
+	return ctx
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attributes ...TraceAttribute) {}
+
+func (noopSpan) AddEvent(name string, attributes ...TraceAttribute) {}
+
+func (noopSpan) RecordError(err error) {}
+
+func (noopSpan) End() {}
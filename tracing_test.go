@@ -0,0 +1,188 @@
+package magicsockets_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+	"github.com/problem-company-toolkit/magicsockets/magicsocketsotel"
+)
+
+var _ = Describe("Tracing", func() {
+	var (
+		ms      magicsockets.MagicSocket
+		address string
+
+		exporter *tracetest.InMemoryExporter
+
+		key      string
+		incoming chan []byte
+
+		websocketClientConn *websocket.Conn
+	)
+
+	BeforeEach(func() {
+		key = gofakeit.UUID()
+		incoming = make(chan []byte, 1)
+
+		exporter = tracetest.NewInMemoryExporter()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+		ms, address = startMagicSocket(magicsockets.MagicSocketOpts{
+			Tracing: magicsockets.TracingOpts{
+				Tracer:              magicsocketsotel.NewTracer(magicsocketsotel.TracerOpts{TracerProvider: provider}),
+				PropagateInMessages: true,
+			},
+		})
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key: key,
+				OnIncoming: func(messageType int, data []byte) error {
+					incoming <- data
+					return nil
+				},
+			}, nil
+		})
+
+		var err error
+		websocketClientConn, err = newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		websocketClientConn.Close()
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	spanNamed := func(name string) func() *tracetest.SpanStub {
+		return func() *tracetest.SpanStub {
+			for _, span := range exporter.GetSpans() {
+				if span.Name == name {
+					return &span
+				}
+			}
+			return nil
+		}
+	}
+
+	It("Traces the handshake and onConnect", func() {
+		handshake := spanNamed("magicsockets.handshake")()
+		Expect(handshake).ToNot(BeNil())
+
+		onConnect := spanNamed("magicsockets.on_connect")()
+		Expect(onConnect).ToNot(BeNil())
+		Expect(onConnect.Parent.SpanID()).To(Equal(handshake.SpanContext.SpanID()))
+	})
+
+	It("Traces queued messages in a delivery span linked to the emit", func() {
+		queuedKey := gofakeit.UUID()
+		ms.SetOnConnect(func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+			return magicsockets.RegisterClientOpts{
+				Key:           queuedKey,
+				OutboundLimit: &magicsockets.OutboundLimit{MaxQueuedMessages: 8},
+			}, nil
+		})
+		queuedClientConn, err := newWebsocketClientConn(address)
+		Expect(err).ToNot(HaveOccurred())
+		defer queuedClientConn.Close()
+
+		ms.Emit(magicsockets.EmitOpts{
+			Rules: []magicsockets.EmitRule{
+				{
+					OnlyKeys: []string{queuedKey},
+				},
+			},
+		}, []byte(`"hello"`))
+
+		_, _, err = queuedClientConn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+
+		emit := spanNamed("magicsockets.emit")()
+		Expect(emit).ToNot(BeNil())
+		Expect(emit.Events).To(HaveLen(1))
+		Expect(emit.Events[0].Name).To(Equal("queued"))
+
+		Eventually(spanNamed("magicsockets.deliver")).ShouldNot(BeNil())
+		deliver := spanNamed("magicsockets.deliver")()
+		Expect(deliver.Links).To(HaveLen(1))
+		Expect(deliver.Links[0].SpanContext.SpanID()).To(Equal(emit.SpanContext.SpanID()))
+		Expect(deliver.Events).To(HaveLen(1))
+		Expect(deliver.Events[0].Name).To(Equal("delivered"))
+	})
+
+	// The client echoes the envelope it received, with its trace context.
+	DescribeTable("Round-trips messages through envelopes",
+		func(message string, encoding string) {
+			ms.Emit(magicsockets.EmitOpts{
+				Rules: []magicsockets.EmitRule{
+					{
+						OnlyKeys: []string{key},
+					},
+				},
+			}, []byte(message))
+
+			_, wrapped, err := websocketClientConn.ReadMessage()
+			Expect(err).ToNot(HaveOccurred())
+
+			var envelope magicsockets.TraceEnvelope
+			Expect(json.Unmarshal(wrapped, &envelope)).To(Succeed())
+			Expect(envelope.Encoding).To(Equal(encoding))
+
+			Expect(websocketClientConn.WriteMessage(websocket.TextMessage, wrapped)).To(Succeed())
+			Eventually(incoming).Should(Receive(Equal([]byte(message))))
+		},
+		Entry("A JSON string", `"abc"`, ""),
+		Entry("A JSON object", `{"a":"b"}`, ""),
+		Entry("Text", "abc", magicsockets.TraceEnvelopeText),
+	)
+
+	It("Links a client's reply to the emit that caused it", func() {
+		ms.Emit(magicsockets.EmitOpts{
+			Rules: []magicsockets.EmitRule{
+				{
+					OnlyKeys: []string{key},
+				},
+			},
+		}, []byte(`{"question":"ready?"}`))
+
+		emit := spanNamed("magicsockets.emit")()
+		Expect(emit).ToNot(BeNil())
+		Expect(emit.Events).To(HaveLen(1))
+		Expect(emit.Events[0].Name).To(Equal("delivered"))
+
+		_, message, err := websocketClientConn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+
+		var envelope magicsockets.TraceEnvelope
+		Expect(json.Unmarshal(message, &envelope)).To(Succeed())
+		Expect(string(envelope.Data)).To(Equal(`{"question":"ready?"}`))
+
+		// The client replies with the trace context it received.
+		ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier(envelope.TraceContext))
+		carrier := propagation.MapCarrier{}
+		propagation.TraceContext{}.Inject(ctx, carrier)
+		reply, err := json.Marshal(magicsockets.TraceEnvelope{
+			TraceContext: carrier,
+			Data:         json.RawMessage(`"yes"`),
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(websocketClientConn.WriteMessage(websocket.TextMessage, reply)).To(Succeed())
+
+		Eventually(incoming).Should(Receive(Equal([]byte(`"yes"`))))
+		Eventually(spanNamed("magicsockets.on_incoming")).ShouldNot(BeNil())
+
+		onIncoming := spanNamed("magicsockets.on_incoming")()
+		Expect(onIncoming.Links).To(HaveLen(1))
+		Expect(onIncoming.Links[0].SpanContext.TraceID()).To(Equal(emit.SpanContext.TraceID()))
+	})
+})
@@ -0,0 +1,136 @@
+package magicsockets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrTransportClosed = errors.New("transport closed")
+)
+
+// Connection of a client, used by the registry, Emit and the read loop.
+// Writes are serialized by the client, while reads only happen from its read loop.
+type Conn interface {
+	ReadMessage() (messageType int, data []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	// No deadline when t is zero.
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// Implemented by connections supporting websocket control frames, like *websocket.Conn.
+// Heartbeats, OnPing, close codes and protocols like Socket.IO are only available over them.
+type ControlConn interface {
+	Conn
+
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPingHandler(handler func(appData string) error)
+	SetPongHandler(handler func(appData string) error)
+}
+
+// Implemented by connections able to write a message framed once for every connection it's written to,
+// like *websocket.Conn. Used by Emit, so large broadcasts don't frame, and compress, the message for each client.
+type PreparedConn interface {
+	Conn
+
+	WritePreparedMessage(pm *websocket.PreparedMessage) error
+}
+
+// Establishes the connections of clients during their handshake.
+type Transport interface {
+	// Upgrades the handshake request to a connection.
+	// Must write the response itself when failing.
+	Upgrade(w http.ResponseWriter, r *http.Request) (Conn, error)
+}
+
+// Transport upgrading handshakes to websockets with gorilla/websocket.
+// Used by default, configured by MagicSocketOpts.Upgrader and MagicSocketOpts.CheckOrigin.
+type WebsocketTransport struct {
+	Upgrader websocket.Upgrader
+}
+
+func (t *WebsocketTransport) Upgrade(w http.ResponseWriter, r *http.Request) (Conn, error) {
+	conn, err := t.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Establishes the connection of a client during its handshake,
+// e.g. Transport.Upgrade or the fallback transports.
+type upgradeFunc func(w http.ResponseWriter, r *http.Request) (Conn, error)
+
+type upgradedContextKey struct{}
+
+// Marks a handshake whose connection is upgraded before its client is registered, e.g. by GraphQLHandler.
+// Refusing it can't send a status anymore, so it's closed instead, see registerClient.
+func withUpgraded(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), upgradedContextKey{}, true))
+}
+
+func isUpgraded(r *http.Request) bool {
+	upgraded, _ := r.Context().Value(upgradedContextKey{}).(bool)
+	return upgraded
+}
+
+// Records a response instead of sending it, e.g. for handshakes without a network connection,
+// or whose connection was already upgraded.
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newRecordedResponse() *recordedResponse {
+	return &recordedResponse{header: http.Header{}}
+}
+
+func (w *recordedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *recordedResponse) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func (w *recordedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Sends the recorded response to w.
+func (w *recordedResponse) writeTo(rw http.ResponseWriter) {
+	for name, values := range w.header {
+		rw.Header()[name] = values
+	}
+	if w.status != 0 {
+		rw.WriteHeader(w.status)
+	}
+	rw.Write(w.body.Bytes())
+}
+
+// Upgrades with the transport of the server, negotiating the subprotocol if it's a WebsocketTransport.
+// Other transports negotiate subprotocols themselves.
+func (ms *magicSocket) subprotocolUpgrade(subprotocol string) upgradeFunc {
+	transport, ok := ms.transport.(*WebsocketTransport)
+	if !ok {
+		return ms.transport.Upgrade
+	}
+
+	subprotocolTransport := &WebsocketTransport{Upgrader: transport.Upgrader}
+	subprotocolTransport.Upgrader.Subprotocols = []string{subprotocol}
+	return subprotocolTransport.Upgrade
+}
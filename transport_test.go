@@ -0,0 +1,308 @@
+package magicsockets_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/problem-company-toolkit/magicsockets"
+)
+
+var _ = Describe("Fallback transports", func() {
+	var (
+		ms         magicsockets.MagicSocket
+		httpServer *httptest.Server
+
+		incoming chan string
+	)
+
+	BeforeEach(func() {
+		incoming = make(chan string, 10)
+
+		ms = magicsockets.New(magicsockets.MagicSocketOpts{
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				return magicsockets.RegisterClientOpts{
+					Key:    r.URL.Query().Get("key"),
+					Topics: r.URL.Query()["topic"],
+					OnIncomingContext: func(ctx context.Context, client magicsockets.ClientConn, messageType int, data []byte) error {
+						incoming <- client.GetKey() + " " + string(data)
+						return nil
+					},
+				}, nil
+			},
+		})
+
+		sse, err := ms.SSEHandler(magicsockets.SSEOpts{})
+		Expect(err).ToNot(HaveOccurred())
+		longPolling, err := ms.LongPollingHandler(magicsockets.LongPollingOpts{
+			PollTimeout:    100 * time.Millisecond,
+			SessionTimeout: 300 * time.Millisecond,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		mux := http.NewServeMux()
+		mux.Handle("/sse", sse)
+		mux.Handle("/poll", longPolling)
+		httpServer = httptest.NewServer(mux)
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+		httpServer.Close()
+	})
+
+	emit := func(topic string, message string) {
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{topic}}}}, []byte(message))
+	}
+
+	Context("Server-Sent Events", func() {
+		It("Streams emitted messages", func() {
+			res, err := http.Get(httpServer.URL + "/sse?key=streamed&topic=news")
+			Expect(err).ToNot(HaveOccurred())
+			defer res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+			Eventually(func() []magicsockets.ClientConn { return ms.GetClientsByKey("streamed") }).Should(HaveLen(1))
+			emit("news", "first line\nsecond line")
+			ms.GetClientsByKey("streamed")[0].WriteMessage(websocket.BinaryMessage, []byte("binary"))
+
+			reader := bufio.NewReader(res.Body)
+			readEvent := func() string {
+				lines := []string{}
+				for {
+					line, err := reader.ReadString('\n')
+					Expect(err).ToNot(HaveOccurred())
+					if line == "\n" {
+						return strings.Join(lines, "")
+					}
+					lines = append(lines, line)
+				}
+			}
+			Expect(readEvent()).To(Equal("data: first line\ndata: second line\n"))
+			Expect(readEvent()).To(Equal("event: binary\ndata: YmluYXJ5\n"))
+		})
+
+		It("Disconnects clients closing the stream", func() {
+			res, err := http.Get(httpServer.URL + "/sse?key=streamed")
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() []magicsockets.ClientConn { return ms.GetClientsByKey("streamed") }).Should(HaveLen(1))
+
+			Expect(res.Body.Close()).To(Succeed())
+			Eventually(ms.GetClients).Should(BeEmpty())
+		})
+	})
+
+	Context("Long polling", func() {
+		var sid string
+
+		openSession := func(query string) string {
+			res, err := http.Get(httpServer.URL + "/poll?" + query)
+			Expect(err).ToNot(HaveOccurred())
+			defer res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var session struct {
+				SID string `json:"sid"`
+			}
+			Expect(json.NewDecoder(res.Body).Decode(&session)).To(Succeed())
+			Expect(session.SID).ToNot(BeEmpty())
+			return session.SID
+		}
+
+		poll := func() (int, []magicsockets.LongPollingMessage) {
+			res, err := http.Get(httpServer.URL + "/poll?sid=" + sid)
+			Expect(err).ToNot(HaveOccurred())
+			defer res.Body.Close()
+
+			messages := []magicsockets.LongPollingMessage{}
+			if res.StatusCode == http.StatusOK {
+				Expect(json.NewDecoder(res.Body).Decode(&messages)).To(Succeed())
+			}
+			return res.StatusCode, messages
+		}
+
+		BeforeEach(func() {
+			sid = openSession("key=polled&topic=news")
+		})
+
+		It("Returns the messages queued since the last poll", func() {
+			emit("news", "first")
+			emit("news", "second")
+			ms.GetClientsByKey("polled")[0].WriteMessage(websocket.BinaryMessage, []byte("binary"))
+
+			status, messages := poll()
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(messages).To(Equal([]magicsockets.LongPollingMessage{
+				{Type: "text", Data: "first"},
+				{Type: "text", Data: "second"},
+				{Type: "binary", Data: "YmluYXJ5"},
+			}))
+
+			status, messages = poll()
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(messages).To(BeEmpty())
+		})
+
+		It("Waits for messages emitted during the poll", func() {
+			go func() {
+				defer GinkgoRecover()
+				Eventually(func() []magicsockets.ClientConn { return ms.GetClientsByKey("polled") }).Should(HaveLen(1))
+				time.Sleep(20 * time.Millisecond)
+				emit("news", "late")
+			}()
+
+			_, messages := poll()
+			Expect(messages).To(Equal([]magicsockets.LongPollingMessage{{Type: "text", Data: "late"}}))
+		})
+
+		It("Receives messages sent by clients", func() {
+			res, err := http.Post(httpServer.URL+"/poll?sid="+sid, "text/plain", strings.NewReader("hello"))
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusNoContent))
+
+			Eventually(incoming).Should(Receive(Equal("polled hello")))
+		})
+
+		It("Disconnects clients ending their session", func() {
+			req, err := http.NewRequest(http.MethodDelete, httpServer.URL+"/poll?sid="+sid, nil)
+			Expect(err).ToNot(HaveOccurred())
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusNoContent))
+
+			Eventually(ms.GetClients).Should(BeEmpty())
+			status, _ := poll()
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+
+		It("Disconnects clients that stop polling", func() {
+			for i := 0; i < 3; i++ {
+				status, _ := poll()
+				Expect(status).To(Equal(http.StatusOK))
+			}
+			Expect(ms.GetClients()).To(HaveLen(1))
+
+			Eventually(ms.GetClients, time.Second).Should(BeEmpty())
+		})
+
+		It("Mixes clients of every transport", func() {
+			handler, err := ms.Handler()
+			Expect(err).ToNot(HaveOccurred())
+			wsServer := httptest.NewServer(handler)
+			defer wsServer.Close()
+
+			websocketClientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(wsServer.URL, "http")+"/?key=websocket&topic=news", nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer websocketClientConn.Close()
+
+			Eventually(func() []magicsockets.ClientConn { return ms.GetClientsByKey("websocket") }).Should(HaveLen(1))
+			emit("news", "everyone")
+
+			_, message, err := websocketClientConn.ReadMessage()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(message)).To(Equal("everyone"))
+			_, messages := poll()
+			Expect(messages).To(Equal([]magicsockets.LongPollingMessage{{Type: "text", Data: "everyone"}}))
+		})
+	})
+})
+
+var _ = Describe("Pipe transport", func() {
+	var (
+		ms        magicsockets.MagicSocket
+		transport *magicsockets.PipeTransport
+		handler   http.Handler
+
+		incoming chan string
+	)
+
+	BeforeEach(func() {
+		incoming = make(chan string, 10)
+		transport = magicsockets.NewPipeTransport()
+
+		ms = magicsockets.New(magicsockets.MagicSocketOpts{
+			Transport: transport,
+			OnConnect: func(r *http.Request) (magicsockets.RegisterClientOpts, error) {
+				if r.URL.Query().Get("key") == "" {
+					return magicsockets.RegisterClientOpts{}, errors.New("missing key")
+				}
+				return magicsockets.RegisterClientOpts{
+					Key:    r.URL.Query().Get("key"),
+					Topics: r.URL.Query()["topic"],
+					OnIncomingContext: func(ctx context.Context, client magicsockets.ClientConn, messageType int, data []byte) error {
+						incoming <- client.GetKey() + " " + string(data)
+						return nil
+					},
+				}, nil
+			},
+		})
+
+		var err error
+		handler, err = ms.Handler()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(ms.Stop()).To(Succeed())
+	})
+
+	It("Exchanges messages with clients", func() {
+		conn, err := transport.Dial(handler, "/?key=piped&topic=news", nil)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(ms.GetClientsByKey("piped")).To(HaveLen(1))
+
+		ms.Emit(magicsockets.EmitOpts{Rules: []magicsockets.EmitRule{{AnyOfTopics: []string{"news"}}}}, []byte("emitted"))
+		messageType, message, err := conn.ReadMessage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(messageType).To(Equal(websocket.TextMessage))
+		Expect(string(message)).To(Equal("emitted"))
+
+		Expect(conn.WriteMessage(websocket.TextMessage, []byte("hello"))).To(Succeed())
+		Eventually(incoming).Should(Receive(Equal("piped hello")))
+	})
+
+	It("Disconnects clients closing their end", func() {
+		conn, err := transport.Dial(handler, "/?key=piped", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(conn.Close()).To(Succeed())
+		Eventually(ms.GetClients).Should(BeEmpty())
+	})
+
+	It("Closes the end of clients once they are disconnected", func() {
+		conn, err := transport.Dial(handler, "/?key=piped", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ms.GetClientsByKey("piped")[0].Close()).To(Succeed())
+		_, _, err = conn.ReadMessage()
+		Expect(err).To(MatchError(magicsockets.ErrTransportClosed))
+	})
+
+	It("Fails to dial handshakes rejected by the server", func() {
+		_, err := transport.Dial(handler, "/", nil)
+		Expect(err).To(MatchError(magicsockets.ErrHandshakeFailed))
+		Expect(ms.GetClients()).To(BeEmpty())
+	})
+
+	It("Rejects requests not made through Dial", func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/?key=piped", nil))
+
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(ms.GetClients()).To(BeEmpty())
+	})
+})